@@ -0,0 +1,60 @@
+// Package auth socks5 credential store backends
+package auth
+
+import (
+	"fmt"
+	"lproxyc/socks5"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+)
+
+// Config auth settings in config file
+type Config struct {
+	// Backend one of:
+	//   htpasswd:/path/to/file
+	//   cmd:/path/to/program
+	//   http://host/path or https://host/path
+	// empty to use Users
+	Backend string `json:"backend"`
+
+	// Users static user to password list
+	Users map[string]string `json:"users"`
+
+	// Timeout seconds to wait external command or http callback
+	Timeout int `json:"timeout"`
+}
+
+// Build build credential store, nil if auth is not configured
+func (c *Config) Build() (socks5.CredentialStore, error) {
+	timeout := defaultTimeout
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout) * time.Second
+	}
+
+	backend := c.Backend
+	switch {
+	case backend == "":
+		if len(c.Users) == 0 {
+			return nil, nil
+		}
+		return socks5.StaticCredentials(c.Users), nil
+	case strings.HasPrefix(backend, "htpasswd:"):
+		return NewHtpasswd(strings.TrimPrefix(backend, "htpasswd:"))
+	case strings.HasPrefix(backend, "cmd:"):
+		return &Command{
+			Path:    strings.TrimPrefix(backend, "cmd:"),
+			Timeout: timeout,
+		}, nil
+	case strings.HasPrefix(backend, "http://"), strings.HasPrefix(backend, "https://"):
+		return &HTTP{
+			URL:     backend,
+			Timeout: timeout,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown auth backend: %s", backend)
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Command external program decides, username and password are passed
+// in env SOCKS_USERNAME and SOCKS_PASSWORD so that they don't show in
+// process list, exit code 0 means valid
+type Command struct {
+	Path    string
+	Timeout time.Duration
+}
+
+// Valid implement socks5.CredentialStore
+func (c *Command) Valid(user, password string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.Path)
+	cmd.Env = append(os.Environ(),
+		"SOCKS_USERNAME="+user,
+		"SOCKS_PASSWORD="+password)
+
+	err := cmd.Run()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			log.Println("auth command failed:", err)
+		}
+		return false
+	}
+
+	return true
+}
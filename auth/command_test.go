@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package auth
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestCommand(t *testing.T) {
+	path, cleanup := tempFile(t, "auth.sh")
+	defer cleanup()
+
+	script := "#!/bin/sh\n" +
+		"[ \"$SOCKS_USERNAME\" = alice ] && [ \"$SOCKS_PASSWORD\" = 'p w' ] && exit 0\n" +
+		"[ \"$SOCKS_USERNAME\" = slow ] && exec sleep 5\n" +
+		"exit 1\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Command{Path: path, Timeout: 200 * time.Millisecond}
+
+	// credentials are passed in env, exit code decides
+	if !c.Valid("alice", "p w") {
+		t.Fatal("alice not valid")
+	}
+	if c.Valid("alice", "wrong") {
+		t.Fatal("wrong password valid")
+	}
+
+	start := time.Now()
+	if c.Valid("slow", "") {
+		t.Fatal("timed out command valid")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("command not killed at timeout, took %v", d)
+	}
+
+	c.Path = path + ".missing"
+	if c.Valid("alice", "p w") {
+		t.Fatal("missing command valid")
+	}
+}
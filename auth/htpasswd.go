@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd apache htpasswd file, bcrypt and {SHA} hashes are
+// supported, the file is reloaded when modified
+type Htpasswd struct {
+	path string
+
+	lock    sync.Mutex
+	modTime time.Time
+	users   map[string]string
+}
+
+// NewHtpasswd load htpasswd file
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *Htpasswd) reload() error {
+	st, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+
+	if st.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+
+		user, hash := line[:i], line[i+1:]
+		if !isBcrypt(hash) && !strings.HasPrefix(hash, "{SHA}") {
+			log.Printf("htpasswd %s: unsupported hash for user %s, use bcrypt", h.path, user)
+			continue
+		}
+
+		users[user] = hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.users = users
+	h.modTime = st.ModTime()
+
+	return nil
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2y$") ||
+		strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$")
+}
+
+// Valid implement socks5.CredentialStore
+func (h *Htpasswd) Valid(user, password string) bool {
+	h.lock.Lock()
+	if err := h.reload(); err != nil {
+		// keep the users loaded last time
+		log.Println("htpasswd reload failed:", err)
+	}
+	hash, ok := h.users[user]
+	h.lock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expect := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(expect)) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
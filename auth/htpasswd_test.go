@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func tempFile(t *testing.T, name string) (string, func()) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, name), func() { os.RemoveAll(dir) }
+}
+
+func bcryptLine(t *testing.T, user string, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fmt.Sprintf("%s:%s\n", user, hash)
+}
+
+func shaLine(user string, password string) string {
+	sum := sha1.Sum([]byte(password))
+	return fmt.Sprintf("%s:{SHA}%s\n", user, base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+func TestHtpasswd(t *testing.T) {
+	path, cleanup := tempFile(t, "htpasswd")
+	defer cleanup()
+
+	content := "# comment\n\n" +
+		bcryptLine(t, "alice", "secret") +
+		shaLine("bob", "hunter2") +
+		"carol:plaintext\n" +
+		"broken line\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		user, password string
+		valid          bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "hunter2", true},
+		{"bob", "hunter", false},
+		// unsupported hash is skipped
+		{"carol", "plaintext", false},
+		{"dave", "", false},
+	}
+
+	for _, c := range cases {
+		if got := h.Valid(c.user, c.password); got != c.valid {
+			t.Fatalf("Valid(%s, %s):%v, want %v", c.user, c.password, got, c.valid)
+		}
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	path, cleanup := tempFile(t, "htpasswd")
+	defer cleanup()
+
+	if err := ioutil.WriteFile(path, []byte(shaLine("alice", "secret")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !h.Valid("alice", "secret") {
+		t.Fatal("alice not valid")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(shaLine("bob", "secret")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Valid("alice", "secret") || !h.Valid("bob", "secret") {
+		t.Fatal("not reloaded on mtime change")
+	}
+
+	// users loaded last time are kept if the file is gone
+	os.Remove(path)
+	if !h.Valid("bob", "secret") {
+		t.Fatal("users lost on failed reload")
+	}
+}
+
+func TestHtpasswdMissing(t *testing.T) {
+	if _, err := NewHtpasswd(filepath.Join(os.TempDir(), "no-such-htpasswd")); err == nil {
+		t.Fatal("missing file loaded")
+	}
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HTTP callback, POST {"username":"","password":""} to URL,
+// status 2xx means valid
+type HTTP struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// Valid implement socks5.CredentialStore
+func (h *HTTP) Valid(user, password string) bool {
+	body, err := json.Marshal(map[string]string{
+		"username": user,
+		"password": password,
+	})
+	if err != nil {
+		return false
+	}
+
+	client := &http.Client{Timeout: h.Timeout}
+	resp, err := client.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("auth callback failed:", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	// drain so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case body["username"] == "alice" && body["password"] == "secret":
+			w.WriteHeader(http.StatusNoContent)
+		case body["username"] == "error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case body["username"] == "slow":
+			time.Sleep(time.Second)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	h := &HTTP{URL: srv.URL, Timeout: 200 * time.Millisecond}
+
+	cases := []struct {
+		user, password string
+		valid          bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"error", "", false},
+		// timed out before the 200 arrives
+		{"slow", "", false},
+	}
+
+	for _, c := range cases {
+		if got := h.Valid(c.user, c.password); got != c.valid {
+			t.Fatalf("Valid(%s, %s):%v, want %v", c.user, c.password, got, c.valid)
+		}
+	}
+
+	h.URL = "http://127.0.0.1:1"
+	if h.Valid("alice", "secret") {
+		t.Fatal("unreachable callback valid")
+	}
+}
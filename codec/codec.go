@@ -0,0 +1,143 @@
+// Package codec tunnel protocol frames encoding and decoding,
+// every frame starts with a 5 bytes header: cmd + idx + tag,
+// multi-byte integers are little endian
+//
+// Frames carry no version, the protocol version is sent once per
+// tunnel as the VersionParam query parameter of the handshake uri,
+// the websocket url or the hello frame of tcp/tls, a server rejects
+// versions newer than it knows before any frame is exchanged
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Version protocol version, sent to server when tunnel is built
+	Version = 1
+	// VersionParam handshake uri query parameter carrying Version
+	VersionParam = "ver"
+
+	// HeaderSize cmd + idx + tag
+	HeaderSize = 1 + 2 + 2
+
+	// MaxFrameParam url query parameter, max frame size the client
+	// accepts and sends
+	MaxFrameParam = "maxframe"
+	// MaxFrameHeader websocket handshake response header, max frame
+	// size of the server, the smaller one is used by both sides,
+	// tcp/tls have no handshake response, they don't negotiate
+	MaxFrameHeader = "X-Max-Frame"
+	// DefaultMaxFrame max frame size if not negotiated, also the
+	// largest one for tcp/tls
+	DefaultMaxFrame = 1 << 20
+	// MinMaxFrame smallest max frame size, the largest control frame
+	// and some data fit in it
+	MinMaxFrame = 1024
+)
+
+// tunnel commands
+const (
+	CmdNone              = 0
+	CmdReqData           = 1
+	CmdReqCreated        = 2
+	CmdReqClientClosed   = 3
+	CmdReqClientFinished = 4
+	CmdReqServerFinished = 5
+	CmdReqServerClosed   = 6
+	CmdReqClientQuota    = 7
+)
+
+var (
+	// ErrShortFrame frame is shorter than required by its cmd
+	ErrShortFrame = errors.New("codec: short frame")
+	// ErrUnknownCmd cmd is not supported in this direction
+	ErrUnknownCmd = errors.New("codec: unsupport cmd")
+)
+
+// Header frame header
+type Header struct {
+	Cmd uint8
+	Idx uint16
+	Tag uint16
+}
+
+// Message frame with typed body
+type Message interface {
+	GetHeader() Header
+	Encode() []byte
+}
+
+// GetHeader return header
+func (h Header) GetHeader() Header {
+	return h
+}
+
+// Put write header to the first HeaderSize bytes of buf, frames can
+// be built in place with the header space reserved before the body
+func (h Header) Put(buf []byte) {
+	buf[0] = h.Cmd
+	binary.LittleEndian.PutUint16(buf[1:], h.Idx)
+	binary.LittleEndian.PutUint16(buf[3:], h.Tag)
+}
+
+// DecodeHeader decode frame header
+func DecodeHeader(b []byte) (Header, error) {
+	if len(b) < HeaderSize {
+		return Header{}, ErrShortFrame
+	}
+
+	h := Header{
+		Cmd: b[0],
+		Idx: binary.LittleEndian.Uint16(b[1:]),
+		Tag: binary.LittleEndian.Uint16(b[3:]),
+	}
+
+	return h, nil
+}
+
+// DecodeServerMessage decode frame sent by server
+func DecodeServerMessage(b []byte) (Message, error) {
+	h, err := DecodeHeader(b)
+	if err != nil {
+		return nil, err
+	}
+
+	body := b[HeaderSize:]
+	switch h.Cmd {
+	case CmdReqData:
+		m := &ServerData{Header: h}
+		return m, m.decode(body)
+	case CmdReqServerFinished, CmdReqServerClosed:
+		m := &ServerEnd{Header: h}
+		return m, m.decode(body)
+	default:
+		return nil, fmt.Errorf("%w:%d", ErrUnknownCmd, h.Cmd)
+	}
+}
+
+// DecodeClientMessage decode frame sent by client
+func DecodeClientMessage(b []byte) (Message, error) {
+	h, err := DecodeHeader(b)
+	if err != nil {
+		return nil, err
+	}
+
+	body := b[HeaderSize:]
+	switch h.Cmd {
+	case CmdReqData:
+		return &ClientData{Header: h, Data: body}, nil
+	case CmdReqCreated:
+		m := &ReqCreated{Header: h}
+		return m, m.decode(body)
+	case CmdReqClientClosed, CmdReqClientFinished:
+		return &ClientEnd{Header: h}, nil
+	case CmdReqClientQuota:
+		m := &ClientQuota{Header: h}
+		return m, m.decode(body)
+	default:
+		return nil, fmt.Errorf("%w:%d", ErrUnknownCmd, h.Cmd)
+	}
+}
@@ -0,0 +1,142 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestServerRoundTrip(t *testing.T) {
+	msgs := []Message{
+		NewServerData(1, 2, 3, []byte("hello")),
+		NewServerData(0xffff, 0xffff, 0xffffffff, []byte{}),
+		NewServerEnd(CmdReqServerFinished, 4, 5, 6),
+		NewServerEnd(CmdReqServerClosed, 7, 8, 0),
+	}
+
+	for _, m := range msgs {
+		got, err := DecodeServerMessage(m.Encode())
+		if err != nil {
+			t.Fatalf("%#v: %v", m, err)
+		}
+
+		if !reflect.DeepEqual(got, m) {
+			t.Fatalf("got %#v, want %#v", got, m)
+		}
+	}
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	msgs := []Message{
+		NewClientData(1, 2, []byte("hello")),
+		NewClientEnd(CmdReqClientFinished, 3, 4),
+		NewClientEnd(CmdReqClientClosed, 5, 6),
+		NewClientQuota(7, 8, 20),
+		NewReqCreated(9, 10, []byte("example.com"), 443),
+		NewReqCreated(11, 12, []byte{1, 2, 3, 4}, 80),
+	}
+
+	for _, m := range msgs {
+		got, err := DecodeClientMessage(m.Encode())
+		if err != nil {
+			t.Fatalf("%#v: %v", m, err)
+		}
+
+		if !reflect.DeepEqual(got, m) {
+			t.Fatalf("got %#v, want %#v", got, m)
+		}
+	}
+}
+
+func TestShortFrame(t *testing.T) {
+	frames := [][]byte{
+		nil,
+		{CmdReqData, 0, 0, 0},
+		// data without seq
+		{CmdReqData, 0, 0, 0, 0, 1, 2, 3},
+		// finished without last seq
+		{CmdReqServerFinished, 0, 0, 0, 0},
+		{CmdReqServerClosed, 0, 0, 0, 0, 1},
+	}
+
+	for _, b := range frames {
+		if _, err := DecodeServerMessage(b); !errors.Is(err, ErrShortFrame) {
+			t.Fatalf("%v: err %v, want %v", b, err, ErrShortFrame)
+		}
+	}
+
+	created := NewReqCreated(1, 2, []byte("example.com"), 443).Encode()
+	for n := 0; n < len(created); n++ {
+		if _, err := DecodeClientMessage(created[:n]); !errors.Is(err, ErrShortFrame) {
+			t.Fatalf("created[:%d]: err %v, want %v", n, err, ErrShortFrame)
+		}
+	}
+}
+
+func TestUnknownCmd(t *testing.T) {
+	// client commands are not valid from server and the reverse
+	for _, cmd := range []uint8{CmdNone, CmdReqCreated, CmdReqClientClosed, CmdReqClientQuota, 0xff} {
+		if _, err := DecodeServerMessage([]byte{cmd, 0, 0, 0, 0, 0, 0, 0, 0}); !errors.Is(err, ErrUnknownCmd) {
+			t.Fatalf("server cmd %d: err %v, want %v", cmd, err, ErrUnknownCmd)
+		}
+	}
+
+	for _, cmd := range []uint8{CmdNone, CmdReqServerFinished, CmdReqServerClosed, 0xff} {
+		if _, err := DecodeClientMessage([]byte{cmd, 0, 0, 0, 0, 0, 0, 0, 0}); !errors.Is(err, ErrUnknownCmd) {
+			t.Fatalf("client cmd %d: err %v, want %v", cmd, err, ErrUnknownCmd)
+		}
+	}
+}
+
+func TestHeaderPut(t *testing.T) {
+	m := NewServerData(0x0102, 0x0304, 5, []byte("x"))
+	frame := make([]byte, HeaderSize+4+1)
+	copy(frame[HeaderSize:], m.Encode()[HeaderSize:])
+	m.Put(frame)
+
+	if !bytes.Equal(frame, m.Encode()) {
+		t.Fatalf("got %v, want %v", frame, m.Encode())
+	}
+}
+
+// fuzzDecode decode must not panic, a decoded message encodes to
+// a frame that decodes to the same message
+func fuzzDecode(t *testing.T, b []byte, decode func([]byte) (Message, error)) {
+	m, err := decode(b)
+	if err != nil {
+		return
+	}
+
+	again, err := decode(m.Encode())
+	if err != nil {
+		t.Fatalf("re-decode %#v: %v", m, err)
+	}
+
+	if !reflect.DeepEqual(again, m) {
+		t.Fatalf("got %#v, want %#v", again, m)
+	}
+}
+
+func FuzzDecodeServerMessage(f *testing.F) {
+	f.Add(NewServerData(1, 2, 3, []byte("hello")).Encode())
+	f.Add(NewServerEnd(CmdReqServerFinished, 1, 2, 3).Encode())
+	f.Add(NewServerEnd(CmdReqServerClosed, 1, 2, 3).Encode())
+	f.Add([]byte{CmdReqData, 0, 0, 0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		fuzzDecode(t, b, DecodeServerMessage)
+	})
+}
+
+func FuzzDecodeClientMessage(f *testing.F) {
+	f.Add(NewClientData(1, 2, []byte("hello")).Encode())
+	f.Add(NewClientEnd(CmdReqClientFinished, 1, 2).Encode())
+	f.Add(NewClientQuota(1, 2, 3).Encode())
+	f.Add(NewReqCreated(1, 2, []byte("example.com"), 443).Encode())
+	f.Add([]byte{CmdReqCreated, 0, 0, 0, 0, 1, 0xff})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		fuzzDecode(t, b, DecodeClientMessage)
+	})
+}
@@ -0,0 +1,201 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// AddressTypeDefault address type in ReqCreated, server parses
+	// address bytes as domain or raw ip
+	AddressTypeDefault = 1
+)
+
+// ClientData data from client to server
+type ClientData struct {
+	Header
+	Data []byte
+}
+
+// NewClientData build client data frame
+func NewClientData(idx uint16, tag uint16, data []byte) *ClientData {
+	return &ClientData{Header: Header{CmdReqData, idx, tag}, Data: data}
+}
+
+// Encode encode to frame
+func (m *ClientData) Encode() []byte {
+	buf := make([]byte, HeaderSize+len(m.Data))
+	m.Put(buf)
+	copy(buf[HeaderSize:], m.Data)
+
+	return buf
+}
+
+// ServerData data from server to client, with sequence number
+type ServerData struct {
+	Header
+	Seq  uint32
+	Data []byte
+}
+
+// NewServerData build server data frame
+func NewServerData(idx uint16, tag uint16, seq uint32, data []byte) *ServerData {
+	return &ServerData{Header: Header{CmdReqData, idx, tag}, Seq: seq, Data: data}
+}
+
+// Encode encode to frame
+func (m *ServerData) Encode() []byte {
+	buf := make([]byte, HeaderSize+4+len(m.Data))
+	m.Put(buf)
+	binary.LittleEndian.PutUint32(buf[HeaderSize:], m.Seq)
+	copy(buf[HeaderSize+4:], m.Data)
+
+	return buf
+}
+
+func (m *ServerData) decode(body []byte) error {
+	if len(body) < 4 {
+		return ErrShortFrame
+	}
+
+	m.Seq = binary.LittleEndian.Uint32(body)
+	m.Data = body[4:]
+
+	return nil
+}
+
+// ServerEnd server finished or closed, with last sequence number
+type ServerEnd struct {
+	Header
+	LastSeqNo uint32
+}
+
+// NewServerEnd build server finished or closed frame
+func NewServerEnd(cmd uint8, idx uint16, tag uint16, lastSeqNo uint32) *ServerEnd {
+	return &ServerEnd{Header: Header{cmd, idx, tag}, LastSeqNo: lastSeqNo}
+}
+
+// Encode encode to frame
+func (m *ServerEnd) Encode() []byte {
+	buf := make([]byte, HeaderSize+4)
+	m.Put(buf)
+	binary.LittleEndian.PutUint32(buf[HeaderSize:], m.LastSeqNo)
+
+	return buf
+}
+
+func (m *ServerEnd) decode(body []byte) error {
+	if len(body) < 4 {
+		return ErrShortFrame
+	}
+
+	m.LastSeqNo = binary.LittleEndian.Uint32(body)
+
+	return nil
+}
+
+// ClientEnd client finished or closed
+type ClientEnd struct {
+	Header
+}
+
+// NewClientEnd build client finished or closed frame
+func NewClientEnd(cmd uint8, idx uint16, tag uint16) *ClientEnd {
+	return &ClientEnd{Header: Header{cmd, idx, tag}}
+}
+
+// Encode encode to frame
+func (m *ClientEnd) Encode() []byte {
+	buf := make([]byte, HeaderSize)
+	m.Put(buf)
+
+	return buf
+}
+
+// ClientQuota client report consumed packets
+type ClientQuota struct {
+	Header
+	Quota uint16
+}
+
+// NewClientQuota build quota report frame
+func NewClientQuota(idx uint16, tag uint16, quota uint16) *ClientQuota {
+	return &ClientQuota{Header: Header{CmdReqClientQuota, idx, tag}, Quota: quota}
+}
+
+// Encode encode to frame
+func (m *ClientQuota) Encode() []byte {
+	buf := make([]byte, HeaderSize+2)
+	m.Put(buf)
+	binary.LittleEndian.PutUint16(buf[HeaderSize:], m.Quota)
+
+	return buf
+}
+
+func (m *ClientQuota) decode(body []byte) error {
+	if len(body) < 2 {
+		return ErrShortFrame
+	}
+
+	m.Quota = binary.LittleEndian.Uint16(body)
+
+	return nil
+}
+
+// ReqCreated client create request
+type ReqCreated struct {
+	Header
+	AddressType uint8
+	// Address domain name or raw ip bytes
+	Address []byte
+	Port    uint16
+}
+
+// NewReqCreated build request created frame
+func NewReqCreated(idx uint16, tag uint16, address []byte, port uint16) *ReqCreated {
+	return &ReqCreated{
+		Header:      Header{CmdReqCreated, idx, tag},
+		AddressType: AddressTypeDefault,
+		Address:     address,
+		Port:        port,
+	}
+}
+
+// Encode encode to frame, addressType + addressLength + address + port
+func (m *ReqCreated) Encode() []byte {
+	addressLength := len(m.Address)
+	buf := make([]byte, HeaderSize+1+1+addressLength+2)
+	m.Put(buf)
+	buf[HeaderSize] = m.AddressType
+	buf[HeaderSize+1] = byte(addressLength)
+	copy(buf[HeaderSize+2:], m.Address)
+	binary.LittleEndian.PutUint16(buf[HeaderSize+2+addressLength:], m.Port)
+
+	return buf
+}
+
+func (m *ReqCreated) decode(body []byte) error {
+	if len(body) < 2 {
+		return ErrShortFrame
+	}
+
+	m.AddressType = body[0]
+	addressLength := int(body[1])
+	if len(body) < 2+addressLength+2 {
+		return ErrShortFrame
+	}
+
+	m.Address = body[2 : 2+addressLength]
+	m.Port = binary.LittleEndian.Uint16(body[2+addressLength:])
+
+	return nil
+}
+
+// Validate check fields can be encoded
+func (m *ReqCreated) Validate() error {
+	if len(m.Address) == 0 || len(m.Address) > 255 {
+		return fmt.Errorf("codec: invalid address length:%d", len(m.Address))
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+// Package config json config file, settings that don't fit in
+// command line flags
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"lproxyc/auth"
+	"lproxyc/guard"
+	"lproxyc/policy"
+	"lproxyc/rewrite"
+	"lproxyc/server"
+)
+
+// Config config file
+type Config struct {
+	// Guard source filter and connection limits of the listener
+	Guard guard.Config `json:"guard"`
+
+	// Rewrite socks5 destination rewriting
+	Rewrite rewrite.Config `json:"rewrite"`
+
+	// Auth socks5 username/password auth
+	Auth auth.Config `json:"auth"`
+
+	// Policy per-user limits
+	Policy policy.Config `json:"policy"`
+
+	// Accounts extra upstream accounts besides -url and -uuid,
+	// which is named "default"
+	Accounts []server.AccountConfig `json:"accounts"`
+
+	// Routes choose account by socks5 username or source cidr
+	Routes []server.Route `json:"routes"`
+
+	// Listeners extra listeners, each with its own settings
+	Listeners []Listener `json:"listeners"`
+}
+
+// Listener listener with its own protocol, auth, guard and routing
+type Listener struct {
+	// Addr tcp address, or unix socket path with "unix:" prefix
+	Addr string `json:"addr"`
+	// Protocol socks5, http, mixed or transparent
+	Protocol string `json:"protocol"`
+	// Auth nil for no auth
+	Auth *auth.Config `json:"auth"`
+	// Guard source filter and connection limits
+	Guard guard.Config `json:"guard"`
+	// HandshakeTimeout seconds, 0 to use -handshake-timeout
+	HandshakeTimeout int `json:"handshake_timeout"`
+	// Account fixed account name, empty to route by Routes
+	Account string `json:"account"`
+	// Routes empty to use the global routes
+	Routes []server.Route `json:"routes"`
+}
+
+// Load read config file
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
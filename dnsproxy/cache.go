@@ -0,0 +1,101 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	maxCacheEntries = 4096
+)
+
+// cacheEntry cached response
+type cacheEntry struct {
+	msg        []byte
+	ttlOffsets []int
+	stored     time.Time
+	expire     time.Time
+}
+
+// cache response cache, entries expire by min record ttl
+type cache struct {
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+func newCache() *cache {
+	return &cache{entries: make(map[string]*cacheEntry)}
+}
+
+// get return a copy of cached response with ttls decreased
+// by the time it has been cached
+func (c *cache) get(key string, id uint16) []byte {
+	c.lock.Lock()
+	e, ok := c.entries[key]
+	if ok && !time.Now().Before(e.expire) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	elapsed := uint32(time.Since(e.stored) / time.Second)
+	msg := make([]byte, len(e.msg))
+	copy(msg, e.msg)
+	for _, off := range e.ttlOffsets {
+		ttl := binary.BigEndian.Uint32(msg[off:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(msg[off:], ttl)
+	}
+	setID(msg, id)
+
+	return msg
+}
+
+func (c *cache) put(key string, msg []byte, m *message) {
+	ttl, ok := m.minTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	e := &cacheEntry{
+		msg:        msg,
+		ttlOffsets: m.ttlOffsets,
+		stored:     now,
+		expire:     now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.entries) >= maxCacheEntries {
+		c.evictExpired(now)
+	}
+
+	if len(c.entries) >= maxCacheEntries {
+		// still full, drop an arbitrary entry
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+
+	c.entries[key] = e
+}
+
+func (c *cache) evictExpired(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expire) {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	c := newCache()
+	query := buildQuery(1, "example.com", typeA)
+	resp := buildResponse(query, 300, 60)
+
+	m, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := m.question.key()
+	c.put(key, resp, m)
+
+	got := c.get(key, 9)
+	if got == nil {
+		t.Fatal("not cached")
+	}
+	if binary.BigEndian.Uint16(got) != 9 {
+		t.Fatal("id not set to the query id")
+	}
+
+	// cached 100s ago, ttls decreased, the 60s one floors at 0
+	c.lock.Lock()
+	e := c.entries[key]
+	e.stored = e.stored.Add(-100 * time.Second)
+	c.lock.Unlock()
+
+	got = c.get(key, 9)
+	if got == nil {
+		t.Fatal("dropped before expire")
+	}
+	for i, want := range []uint32{200, 0} {
+		if ttl := binary.BigEndian.Uint32(got[m.ttlOffsets[i]:]); ttl != want {
+			t.Fatalf("record %d ttl %d, want %d", i, ttl, want)
+		}
+	}
+
+	// entry itself is untouched
+	if ttl := binary.BigEndian.Uint32(resp[m.ttlOffsets[0]:]); ttl != 300 {
+		t.Fatalf("cached ttl changed to %d", ttl)
+	}
+
+	c.lock.Lock()
+	e.expire = time.Now()
+	c.lock.Unlock()
+
+	if c.get(key, 9) != nil {
+		t.Fatal("got expired entry")
+	}
+	c.lock.Lock()
+	n := len(c.entries)
+	c.lock.Unlock()
+	if n != 0 {
+		t.Fatalf("%d entries after expire, want 0", n)
+	}
+}
+
+func TestCacheSkip(t *testing.T) {
+	c := newCache()
+	query := buildQuery(1, "example.com", typeA)
+
+	// no records or zero ttl are not cached
+	for _, resp := range [][]byte{buildResponse(query), buildResponse(query, 300, 0)} {
+		m, err := parseMessage(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.put(m.question.key(), resp, m)
+		if c.get(m.question.key(), 1) != nil {
+			t.Fatalf("cached response with ttls %v", m.ttlOffsets)
+		}
+	}
+}
+
+func TestCacheFull(t *testing.T) {
+	c := newCache()
+	resp := buildResponse(buildQuery(1, "example.com", typeA), 300)
+	m, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxCacheEntries+10; i++ {
+		c.put(strconv.Itoa(i), resp, m)
+	}
+
+	c.lock.Lock()
+	n := len(c.entries)
+	c.lock.Unlock()
+	if n > maxCacheEntries {
+		t.Fatalf("%d entries, want <= %d", n, maxCacheEntries)
+	}
+}
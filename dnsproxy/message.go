@@ -0,0 +1,230 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	headerSize = 12
+
+	flagTC   = 0x0200
+	typeA    = 1
+	typeAAAA = 28
+	typeOPT  = 41
+	classIN  = 1
+
+	flagQR = 0x8000
+	flagRD = 0x0100
+	flagRA = 0x0080
+)
+
+var (
+	errShortMessage = errors.New("dns: short message")
+	errBadName      = errors.New("dns: bad name")
+)
+
+// question first question of a message
+type question struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// key cache key
+func (q question) key() string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.name), q.qtype, q.qclass)
+}
+
+// parsed message layout
+type message struct {
+	id       uint16
+	flags    uint16
+	question question
+	// questionEnd offset after question section
+	questionEnd int
+	// ttlOffsets offsets of ttl fields in answer, authority
+	// and additional(except OPT) records
+	ttlOffsets []int
+	hasOPT     bool
+}
+
+// readName read a possibly compressed name at off, return name
+// and offset after it
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	jumps := 0
+	for {
+		if off >= len(b) {
+			return "", 0, errShortMessage
+		}
+
+		l := int(b[off])
+		switch {
+		case l == 0:
+			off++
+			if end < 0 {
+				end = off
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, errShortMessage
+			}
+
+			jumps++
+			if jumps > 16 {
+				return "", 0, errBadName
+			}
+
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		case l&0xC0 == 0:
+			if off+1+l > len(b) {
+				return "", 0, errShortMessage
+			}
+
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		default:
+			return "", 0, errBadName
+		}
+	}
+}
+
+// parseMessage parse header, first question and record ttls
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < headerSize {
+		return nil, errShortMessage
+	}
+
+	m := &message{
+		id:    binary.BigEndian.Uint16(b[0:]),
+		flags: binary.BigEndian.Uint16(b[2:]),
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	rrcount := int(binary.BigEndian.Uint16(b[6:])) +
+		int(binary.BigEndian.Uint16(b[8:])) +
+		int(binary.BigEndian.Uint16(b[10:]))
+
+	off := headerSize
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+
+		if next+4 > len(b) {
+			return nil, errShortMessage
+		}
+
+		if i == 0 {
+			m.question = question{
+				name:   name,
+				qtype:  binary.BigEndian.Uint16(b[next:]),
+				qclass: binary.BigEndian.Uint16(b[next+2:]),
+			}
+		}
+
+		off = next + 4
+	}
+	m.questionEnd = off
+
+	for i := 0; i < rrcount; i++ {
+		_, next, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+
+		// type + class + ttl + rdlength
+		if next+10 > len(b) {
+			return nil, errShortMessage
+		}
+
+		rrtype := binary.BigEndian.Uint16(b[next:])
+		rdlength := int(binary.BigEndian.Uint16(b[next+8:]))
+		if next+10+rdlength > len(b) {
+			return nil, errShortMessage
+		}
+
+		if rrtype == typeOPT {
+			// ttl field of OPT carries flags, not a ttl
+			m.hasOPT = true
+		} else {
+			m.ttlOffsets = append(m.ttlOffsets, next+4)
+		}
+
+		off = next + 10 + rdlength
+	}
+
+	return m, nil
+}
+
+// minTTL min ttl of all records, false if no records
+func (m *message) minTTL(b []byte) (uint32, bool) {
+	if len(m.ttlOffsets) == 0 {
+		return 0, false
+	}
+
+	min := binary.BigEndian.Uint32(b[m.ttlOffsets[0]:])
+	for _, off := range m.ttlOffsets[1:] {
+		ttl := binary.BigEndian.Uint32(b[off:])
+		if ttl < min {
+			min = ttl
+		}
+	}
+
+	return min, true
+}
+
+// setID set message id
+func setID(b []byte, id uint16) {
+	binary.BigEndian.PutUint16(b, id)
+}
+
+// truncate keep header and question, set TC flag, clear record counts
+func truncate(b []byte, m *message) []byte {
+	t := make([]byte, m.questionEnd)
+	copy(t, b[:m.questionEnd])
+	binary.BigEndian.PutUint16(t[2:], m.flags|flagTC)
+	binary.BigEndian.PutUint16(t[6:], 0)
+	binary.BigEndian.PutUint16(t[8:], 0)
+	binary.BigEndian.PutUint16(t[10:], 0)
+
+	return t
+}
+
+// buildAnswer build response of query with a single A record,
+// no answer if ip is nil
+func buildAnswer(query []byte, m *message, ip net.IP, ttl uint32) []byte {
+	resp := make([]byte, m.questionEnd, m.questionEnd+16)
+	copy(resp, query[:m.questionEnd])
+	binary.BigEndian.PutUint16(resp[2:], flagQR|flagRA|(m.flags&flagRD))
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+
+	if ip == nil {
+		return resp
+	}
+
+	binary.BigEndian.PutUint16(resp[6:], 1)
+	rr := make([]byte, 16)
+	// pointer to the question name
+	binary.BigEndian.PutUint16(rr[0:], 0xC000|headerSize)
+	binary.BigEndian.PutUint16(rr[2:], typeA)
+	binary.BigEndian.PutUint16(rr[4:], classIN)
+	binary.BigEndian.PutUint32(rr[6:], ttl)
+	binary.BigEndian.PutUint16(rr[10:], 4)
+	copy(rr[12:], ip.To4())
+
+	return append(resp, rr...)
+}
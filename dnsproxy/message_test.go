@@ -0,0 +1,191 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// buildQuery query of one question, rd set
+func buildQuery(id uint16, name string, qtype uint16) []byte {
+	b := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], flagRD)
+	binary.BigEndian.PutUint16(b[4:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+
+	q := make([]byte, 4)
+	binary.BigEndian.PutUint16(q[0:], qtype)
+	binary.BigEndian.PutUint16(q[2:], classIN)
+
+	return append(b, q...)
+}
+
+// buildResponse response to query with one A record per ttl,
+// names compressed to the question
+func buildResponse(query []byte, ttls ...uint32) []byte {
+	b := make([]byte, len(query))
+	copy(b, query)
+	binary.BigEndian.PutUint16(b[2:], flagQR|flagRD|flagRA)
+	binary.BigEndian.PutUint16(b[6:], uint16(len(ttls)))
+
+	for i, ttl := range ttls {
+		rr := make([]byte, 16)
+		binary.BigEndian.PutUint16(rr[0:], 0xC000|headerSize)
+		binary.BigEndian.PutUint16(rr[2:], typeA)
+		binary.BigEndian.PutUint16(rr[4:], classIN)
+		binary.BigEndian.PutUint32(rr[6:], ttl)
+		binary.BigEndian.PutUint16(rr[10:], 4)
+		copy(rr[12:], net.IPv4(10, 0, 0, byte(i+1)).To4())
+		b = append(b, rr...)
+	}
+
+	return b
+}
+
+func TestParseMessage(t *testing.T) {
+	query := buildQuery(0x1234, "Example.COM.", typeA)
+	resp := buildResponse(query, 300, 60)
+
+	m, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.id != 0x1234 || m.question.name != "Example.COM." || m.question.qtype != typeA {
+		t.Fatalf("parsed %+v", m)
+	}
+	if m.question.key() != "example.com./1/1" {
+		t.Fatalf("key %s", m.question.key())
+	}
+	if m.questionEnd != len(query) || len(m.ttlOffsets) != 2 {
+		t.Fatalf("question end %d, ttl offsets %v", m.questionEnd, m.ttlOffsets)
+	}
+	if ttl, ok := m.minTTL(resp); !ok || ttl != 60 {
+		t.Fatalf("min ttl %d %v, want 60", ttl, ok)
+	}
+
+	for n := 0; n < len(resp); n++ {
+		if _, err := parseMessage(resp[:n]); err == nil {
+			t.Fatalf("parsed message cut at %d", n)
+		}
+	}
+
+	// pointer loop
+	loop := append([]byte{}, query[:headerSize]...)
+	loop = append(loop, 0xC0, headerSize, 0, 1, 0, 1)
+	if _, err := parseMessage(loop); err != errBadName {
+		t.Fatalf("pointer loop err %v, want %v", err, errBadName)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	query := buildQuery(1, "example.com", typeA)
+	resp := buildResponse(query, 300, 300)
+
+	m, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := truncate(resp, m)
+	if !bytes.Equal(tr[headerSize:], query[headerSize:]) {
+		t.Fatal("question not kept")
+	}
+
+	tm, err := parseMessage(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm.flags&flagTC == 0 || tm.flags&flagQR == 0 {
+		t.Fatalf("flags %#x, want QR and TC", tm.flags)
+	}
+	if tm.question != m.question || len(tm.ttlOffsets) != 0 {
+		t.Fatalf("truncated %+v", tm)
+	}
+
+	// response itself untouched
+	if binary.BigEndian.Uint16(resp[6:]) != 2 {
+		t.Fatal("truncate modified the response")
+	}
+}
+
+func TestBuildAnswer(t *testing.T) {
+	query := buildQuery(7, "example.com", typeA)
+	qm, err := parseMessage(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("198.18.0.5")
+	resp := buildAnswer(query, qm, ip, 1)
+
+	m, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.id != 7 || m.flags != flagQR|flagRA|flagRD || m.question != qm.question {
+		t.Fatalf("answer %+v", m)
+	}
+	if ttl, ok := m.minTTL(resp); !ok || ttl != 1 {
+		t.Fatalf("ttl %d %v, want 1", ttl, ok)
+	}
+	if got := net.IP(resp[len(resp)-4:]); !got.Equal(ip) {
+		t.Fatalf("answer ip %s, want %s", got, ip)
+	}
+
+	// no ip, empty answer
+	resp = buildAnswer(query, qm, nil, 0)
+	m, err = parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != len(query) || len(m.ttlOffsets) != 0 || m.flags&flagQR == 0 {
+		t.Fatalf("empty answer %+v", m)
+	}
+}
+
+// FuzzParseMessage parse must not panic, a parsed message has its
+// offsets in bounds and truncates to its header and question
+func FuzzParseMessage(f *testing.F) {
+	query := buildQuery(1, "example.com", typeA)
+	f.Add(query)
+	f.Add(buildResponse(query, 300, 60))
+	f.Add(append(append([]byte{}, query[:headerSize]...), 0xC0, headerSize, 0, 1, 0, 1))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for off := 0; off < len(b) && off < 64; off++ {
+			readName(b, off)
+		}
+
+		m, err := parseMessage(b)
+		if err != nil {
+			return
+		}
+
+		if m.questionEnd > len(b) {
+			t.Fatalf("question end %d over %d", m.questionEnd, len(b))
+		}
+		for _, off := range m.ttlOffsets {
+			if off+4 > len(b) {
+				t.Fatalf("ttl offset %d over %d", off, len(b))
+			}
+		}
+		m.minTTL(b)
+
+		tr := truncate(b, m)
+		if !bytes.Equal(tr[headerSize:], b[headerSize:m.questionEnd]) {
+			t.Fatal("truncated question changed")
+		}
+		if binary.BigEndian.Uint16(tr[2:])&flagTC == 0 {
+			t.Fatal("truncated without TC")
+		}
+	})
+}
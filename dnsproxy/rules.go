@@ -0,0 +1,67 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rule split rule, queries for Domain and its subdomains are resolved
+// by the local resolver if Local, otherwise through the tunnel
+type Rule struct {
+	Domain string
+	Local  bool
+}
+
+// ParseRules parse rules like "lan:local,corp.example.com:local,example.com:remote"
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid dns rule:%s", item)
+		}
+
+		r := Rule{Domain: normalize(parts[0])}
+		switch parts[1] {
+		case "local":
+			r.Local = true
+		case "remote":
+		default:
+			return nil, fmt.Errorf("invalid dns rule action:%s", parts[1])
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// normalize lower case, without trailing dot
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// matchLocal longest matched rule decides, default remote
+func matchLocal(rules []Rule, name string) bool {
+	name = normalize(name)
+
+	best := -1
+	local := false
+	for _, r := range rules {
+		if name != r.Domain && !strings.HasSuffix(name, "."+r.Domain) {
+			continue
+		}
+
+		if len(r.Domain) > best {
+			best = len(r.Domain)
+			local = r.Local
+		}
+	}
+
+	return local
+}
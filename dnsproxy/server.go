@@ -0,0 +1,337 @@
+// Package dnsproxy local dns server, queries are forwarded through the
+// tunnel as DNS over TCP to a remote resolver, so names are resolved
+// at the server side and don't leak locally
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"lproxyc/fakeip"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	maxUDPSize     = 512
+	// maxUDPQueries udp queries resolved at once, more are dropped,
+	// clients retry
+	maxUDPQueries = 256
+
+	// fakeIPTTL keep it short, clients don't cache fake answers for long
+	fakeIPTTL          = 1
+	fakeIPSaveInterval = 30 * time.Second
+)
+
+// Dialer dial function, Client.DialContext to dial through tunnel
+type Dialer func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// Config dns server config
+type Config struct {
+	// ListenAddr udp and tcp listen address
+	ListenAddr string
+	// RemoteResolver resolver reached through the tunnel
+	RemoteResolver string
+	// RemoteDial dial through the tunnel
+	RemoteDial Dialer
+	// LocalResolver resolver for domains matched by local rules,
+	// queried directly, if empty local rules resolve remotely
+	LocalResolver string
+	Rules         []Rule
+	// FakeIP if set, A queries not matched by local rules are answered
+	// with fake ips mapped to the queried name, AAAA get empty answers
+	FakeIP *fakeip.Pool
+	// Timeout per query timeout
+	Timeout time.Duration
+}
+
+// Server local dns server
+type Server struct {
+	cfg   Config
+	cache *cache
+
+	lock     sync.Mutex
+	udpConn  net.PacketConn
+	listener net.Listener
+	wg       sync.WaitGroup
+	done     chan struct{}
+	closed   bool
+}
+
+// New create dns server
+func New(cfg Config) (*Server, error) {
+	if cfg.RemoteResolver == "" || cfg.RemoteDial == nil {
+		return nil, fmt.Errorf("remote resolver and dialer are required")
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	return &Server{cfg: cfg, cache: newCache(), done: make(chan struct{})}, nil
+}
+
+// Start listen udp and tcp, serve until ctx is done or Close is called
+func (s *Server) Start(ctx context.Context) error {
+	pc, err := net.ListenPacket("udp", s.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	s.lock.Lock()
+	s.udpConn = pc
+	s.listener = l
+	s.lock.Unlock()
+
+	log.Printf("dns server listen at:%s", pc.LocalAddr())
+
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		s.serveUDP(pc)
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.serveTCP(l)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	if s.cfg.FakeIP != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.saveFakeIPLoop()
+		}()
+	}
+
+	return nil
+}
+
+func (s *Server) saveFakeIPLoop() {
+	ticker := time.NewTicker(fakeIPSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		if err := s.cfg.FakeIP.Save(); err != nil {
+			log.Println("save fake ip pool failed:", err)
+		}
+	}
+}
+
+// Addr udp listen address, nil before Start
+func (s *Server) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.udpConn == nil {
+		return nil
+	}
+
+	return s.udpConn.LocalAddr()
+}
+
+// Close stop serving
+func (s *Server) Close() error {
+	s.lock.Lock()
+	if s.closed || s.udpConn == nil {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	close(s.done)
+	s.udpConn.Close()
+	s.listener.Close()
+	s.wg.Wait()
+
+	if s.cfg.FakeIP != nil {
+		return s.cfg.FakeIP.Save()
+	}
+
+	return nil
+}
+
+func (s *Server) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	inflight := make(chan struct{}, maxUDPQueries)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		select {
+		case inflight <- struct{}{}:
+		default:
+			log.Debugf("dns queries over %d, drop query from %s", maxUDPQueries, addr)
+			continue
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+
+		go func() {
+			defer func() { <-inflight }()
+
+			resp, m, err := s.resolve(query)
+			if err != nil {
+				log.Printf("dns query failed:%v", err)
+				return
+			}
+
+			if len(resp) > maxUDPSize && !m.hasOPT {
+				resp = truncate(resp, m)
+			}
+
+			pc.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (s *Server) serveTCP(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.serveTCPConn(c)
+	}
+}
+
+func (s *Server) serveTCPConn(c net.Conn) {
+	defer c.Close()
+
+	for {
+		c.SetReadDeadline(time.Now().Add(s.cfg.Timeout * 2))
+		query, err := readTCPMessage(c)
+		if err != nil {
+			return
+		}
+
+		resp, _, err := s.resolve(query)
+		if err != nil {
+			log.Printf("dns query failed:%v", err)
+			return
+		}
+
+		if err := writeTCPMessage(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// resolve answer from cache, or forward to resolver selected by rules
+func (s *Server) resolve(query []byte) ([]byte, *message, error) {
+	qm, err := parseMessage(query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	q := qm.question
+	local := s.cfg.LocalResolver != "" && matchLocal(s.cfg.Rules, q.name)
+	if s.cfg.FakeIP != nil && !local && q.qclass == classIN {
+		switch q.qtype {
+		case typeA:
+			ip := s.cfg.FakeIP.Lookup(q.name)
+			return buildAnswer(query, qm, ip, fakeIPTTL), qm, nil
+		case typeAAAA:
+			// no fake ipv6, let clients use ipv4
+			return buildAnswer(query, qm, nil, 0), qm, nil
+		}
+	}
+
+	key := q.key()
+	if resp := s.cache.get(key, qm.id); resp != nil {
+		m, err := parseMessage(resp)
+		return resp, m, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+
+	var conn net.Conn
+	if local {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", s.cfg.LocalResolver)
+	} else {
+		conn, err = s.cfg.RemoteDial(ctx, "tcp", s.cfg.RemoteResolver)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m, err := parseMessage(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if m.id != qm.id {
+		return nil, nil, fmt.Errorf("dns response id mismatch")
+	}
+
+	s.cache.put(key, resp, m)
+
+	return resp, m, nil
+}
+
+// readTCPMessage read 2 bytes length prefixed message
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(l))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// writeTCPMessage write 2 bytes length prefixed message
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,153 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"lproxyc/fakeip"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.RemoteResolver = "resolver.test:53"
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// exchange udp query, wait the response
+func exchange(t *testing.T, s *Server, query []byte) []byte {
+	t.Helper()
+
+	c, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(query); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 65535)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf[:n]
+}
+
+func TestFakeIPAnswer(t *testing.T) {
+	pool, err := fakeip.New("198.18.0.0/16", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := startTestServer(t, Config{
+		FakeIP: pool,
+		RemoteDial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, fmt.Errorf("fake ip queries must not be forwarded")
+		},
+	})
+	defer s.Close()
+
+	resp := exchange(t, s, buildQuery(3, "example.com", typeA))
+	m, err := parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.id != 3 || m.question.name != "example.com." || len(m.ttlOffsets) != 1 {
+		t.Fatalf("answer %+v", m)
+	}
+
+	ip := net.IP(resp[len(resp)-4:])
+	if name, ok := pool.Reverse(ip); !ok || name != "example.com" {
+		t.Fatalf("answer ip %s maps to %q %v", ip, name, ok)
+	}
+	if ttl, _ := m.minTTL(resp); ttl != fakeIPTTL {
+		t.Fatalf("ttl %d, want %d", ttl, fakeIPTTL)
+	}
+
+	// same name, same ip
+	again := exchange(t, s, buildQuery(4, "example.com", typeA))
+	if !net.IP(again[len(again)-4:]).Equal(ip) {
+		t.Fatal("name mapped to another ip")
+	}
+
+	// no fake ipv6
+	resp = exchange(t, s, buildQuery(5, "example.com", typeAAAA))
+	if m, err = parseMessage(resp); err != nil || len(m.ttlOffsets) != 0 {
+		t.Fatalf("AAAA answer %+v, err %v", m, err)
+	}
+}
+
+// TestUDPQueriesBounded queries over maxUDPQueries are dropped
+// while the resolver is stuck, not spawned
+func TestUDPQueriesBounded(t *testing.T) {
+	var dials int32
+	release := make(chan struct{})
+	s := startTestServer(t, Config{
+		RemoteDial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return nil, fmt.Errorf("resolver down")
+		},
+	})
+	defer s.Close()
+
+	c, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < maxUDPQueries+50; i++ {
+		if _, err := c.Write(buildQuery(uint16(i), fmt.Sprintf("host%d.example.com", i), typeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&dials) < maxUDPQueries && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&dials); n != maxUDPQueries {
+		t.Fatalf("%d queries in flight, want %d", n, maxUDPQueries)
+	}
+
+	// slots freed once the resolver answers
+	close(release)
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := c.Write(buildQuery(1, "late.example.com", typeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&dials) == maxUDPQueries {
+		if time.Now().After(deadline) {
+			t.Fatal("query not resolved after slots freed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
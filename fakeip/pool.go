@@ -0,0 +1,199 @@
+// Package fakeip hand out addresses from a reserved range, each
+// mapped to a domain name, so a connect to the address can be
+// turned back into the domain
+package fakeip
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultRange benchmark range reserved by RFC 2544
+	DefaultRange = "198.18.0.0/15"
+)
+
+// Pool fake ip pool, addresses are allocated in a ring, when
+// exhausted the oldest mapping is reused
+type Pool struct {
+	lock    sync.Mutex
+	network *net.IPNet
+	base    uint32
+	size    uint32
+	next    uint32
+
+	byName map[string]uint32
+	byIP   map[uint32]string
+
+	path  string
+	dirty bool
+}
+
+// poolFile persisted pool
+type poolFile struct {
+	Range   string            `json:"range"`
+	Next    uint32            `json:"next"`
+	Mapping map[string]string `json:"mapping"`
+}
+
+// New create pool of an ipv4 cidr, mapping is loaded from
+// path if it exists, path can be empty to disable persistence
+func New(cidr string, path string) (*Pool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("fake ip range must be ipv4 and at least /30:%s", cidr)
+	}
+
+	p := &Pool{
+		network: network,
+		base:    binary.BigEndian.Uint32(network.IP.To4()),
+		// exclude network and broadcast address
+		size:   uint32(1)<<uint(bits-ones) - 2,
+		byName: make(map[string]uint32),
+		byIP:   make(map[uint32]string),
+		path:   path,
+	}
+
+	if path != "" {
+		if err := p.load(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Pool) load() error {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	var pf poolFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return err
+	}
+
+	if pf.Range != p.network.String() {
+		// range changed, old mapping is useless
+		return nil
+	}
+
+	for ipStr, name := range pf.Mapping {
+		ip := net.ParseIP(ipStr).To4()
+		if ip == nil || !p.network.Contains(ip) {
+			continue
+		}
+
+		// network and broadcast address are never handed out
+		off := binary.BigEndian.Uint32(ip) - p.base
+		if off == 0 || off > p.size {
+			continue
+		}
+
+		p.byIP[off] = name
+		p.byName[name] = off
+	}
+
+	p.next = pf.Next % p.size
+
+	return nil
+}
+
+// Save write mapping to file if changed
+func (p *Pool) Save() error {
+	p.lock.Lock()
+	if p.path == "" || !p.dirty {
+		p.lock.Unlock()
+		return nil
+	}
+
+	pf := poolFile{
+		Range:   p.network.String(),
+		Next:    p.next,
+		Mapping: make(map[string]string, len(p.byIP)),
+	}
+
+	for off, name := range p.byIP {
+		pf.Mapping[p.ip(off).String()] = name
+	}
+	p.dirty = false
+	p.lock.Unlock()
+
+	data, err := json.Marshal(&pf)
+	if err != nil {
+		return err
+	}
+
+	tmp := p.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p.path)
+}
+
+func (p *Pool) ip(off uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, p.base+off)
+
+	return ip
+}
+
+// Lookup return the fake ip of name, allocate one if not exist
+func (p *Pool) Lookup(name string) net.IP {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if off, ok := p.byName[name]; ok {
+		return p.ip(off)
+	}
+
+	// offset 0 is the network address
+	off := p.next + 1
+	p.next = (p.next + 1) % p.size
+
+	if old, ok := p.byIP[off]; ok {
+		delete(p.byName, old)
+	}
+
+	p.byIP[off] = name
+	p.byName[name] = off
+	p.dirty = true
+
+	return p.ip(off)
+}
+
+// Contains ip is in the pool range
+func (p *Pool) Contains(ip net.IP) bool {
+	return p.network.Contains(ip)
+}
+
+// Reverse return the name mapped to ip
+func (p *Pool) Reverse(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !p.network.Contains(ip4) {
+		return "", false
+	}
+
+	off := binary.BigEndian.Uint32(ip4) - p.base
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	name, ok := p.byIP[off]
+	return name, ok
+}
@@ -0,0 +1,196 @@
+package fakeip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	for _, cidr := range []string{"198.18.0.0/31", "fd00::/64", "bad"} {
+		if _, err := New(cidr, ""); err == nil {
+			t.Fatalf("range %s accepted", cidr)
+		}
+	}
+
+	p, err := New(DefaultRange, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Contains(net.ParseIP("198.19.255.254")) || p.Contains(net.ParseIP("198.20.0.1")) {
+		t.Fatal("contains wrong range")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	p, err := New("198.18.0.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := p.Lookup("Example.COM.")
+	if !ip.Equal(net.ParseIP("198.18.0.1")) {
+		t.Fatalf("first ip %s, want 198.18.0.1", ip)
+	}
+
+	// names are case and trailing dot insensitive
+	if again := p.Lookup("example.com"); !again.Equal(ip) {
+		t.Fatalf("same name got %s, want %s", again, ip)
+	}
+
+	if name, ok := p.Reverse(ip); !ok || name != "example.com" {
+		t.Fatalf("reverse %s: %q %v", ip, name, ok)
+	}
+	if _, ok := p.Reverse(net.ParseIP("198.18.0.2")); ok {
+		t.Fatal("reverse of unallocated ip")
+	}
+	if _, ok := p.Reverse(net.ParseIP("10.0.0.1")); ok {
+		t.Fatal("reverse of ip out of range")
+	}
+}
+
+// TestRingReuse a /29 has 6 addresses, the 7th name takes the
+// oldest one, whose name no longer reverses
+func TestRingReuse(t *testing.T) {
+	p, err := New("198.18.0.0/29", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ips []net.IP
+	for i := 0; i < 6; i++ {
+		ips = append(ips, p.Lookup(fmt.Sprintf("host%d", i)))
+	}
+
+	for i, ip := range ips {
+		want := net.IPv4(198, 18, 0, byte(i+1))
+		if !ip.Equal(want) {
+			t.Fatalf("ip %d is %s, want %s", i, ip, want)
+		}
+	}
+
+	// wraps around, network and broadcast address are skipped
+	ip := p.Lookup("host6")
+	if !ip.Equal(ips[0]) {
+		t.Fatalf("wrapped ip %s, want %s", ip, ips[0])
+	}
+
+	if name, ok := p.Reverse(ips[0]); !ok || name != "host6" {
+		t.Fatalf("reverse of reused ip %q %v, want host6", name, ok)
+	}
+
+	// the evicted name gets a new address, evicting the next oldest
+	ip = p.Lookup("host0")
+	if !ip.Equal(ips[1]) {
+		t.Fatalf("evicted name got %s, want %s", ip, ips[1])
+	}
+	if name, ok := p.Reverse(ips[1]); !ok || name != "host0" {
+		t.Fatalf("reverse %s is %q %v, want host0", ips[1], name, ok)
+	}
+
+	// host1 was evicted, host2 kept
+	if ip := p.Lookup("host2"); !ip.Equal(ips[2]) {
+		t.Fatalf("kept name moved to %s", ip)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakeip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fakeip.json")
+
+	p, err := New("198.18.0.0/29", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := p.Lookup("a.example.com")
+	b := p.Lookup("b.example.com")
+
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("tmp file left after save: %v", err)
+	}
+
+	p, err = New("198.18.0.0/29", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip := p.Lookup("a.example.com"); !ip.Equal(a) {
+		t.Fatalf("loaded a.example.com at %s, want %s", ip, a)
+	}
+	if name, ok := p.Reverse(b); !ok || name != "b.example.com" {
+		t.Fatalf("loaded reverse %s: %q %v", b, name, ok)
+	}
+
+	// allocation continues after the loaded ones
+	if ip := p.Lookup("c.example.com"); !ip.Equal(net.ParseIP("198.18.0.3")) {
+		t.Fatalf("next ip %s, want 198.18.0.3", ip)
+	}
+
+	// another range drops the mapping
+	p, err = New("198.19.0.0/29", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Reverse(net.ParseIP("198.19.0.1")); ok {
+		t.Fatal("mapping of another range loaded")
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakeip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fakeip.json")
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New("198.18.0.0/29", path); err == nil {
+		t.Fatal("corrupt file accepted")
+	}
+
+	// bad entries are skipped, not loaded
+	data := `{"range":"198.18.0.0/29","next":1,"mapping":{
+		"198.18.0.0":"network",
+		"198.18.0.7":"broadcast",
+		"10.0.0.1":"outside",
+		"bad":"bad",
+		"198.18.0.1":"good"}}`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := New("198.18.0.0/29", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name, ok := p.Reverse(net.ParseIP("198.18.0.1")); !ok || name != "good" {
+		t.Fatalf("good entry %q %v", name, ok)
+	}
+	for _, ip := range []string{"198.18.0.0", "198.18.0.7"} {
+		if name, ok := p.Reverse(net.ParseIP(ip)); ok {
+			t.Fatalf("%s loaded as %q", ip, name)
+		}
+	}
+	for _, name := range []string{"network", "broadcast", "outside", "bad"} {
+		if ip := p.Lookup(name); ip.Equal(net.ParseIP("198.18.0.0")) || ip.Equal(net.ParseIP("198.18.0.7")) {
+			t.Fatalf("%s got %s", name, ip)
+		}
+	}
+}
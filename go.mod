@@ -5,5 +5,6 @@ go 1.13
 require (
 	github.com/gorilla/websocket v1.4.1
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 	golang.org/x/net v0.0.0-20191021144547-ec77196f6094
 )
@@ -0,0 +1,285 @@
+// Package guard listener wrapper that filters accepted connections by
+// source address and limits connection counts and rates
+package guard
+
+import (
+	"fmt"
+	"lproxyc/metrics"
+	"lproxyc/socks5"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// bucket entries are pruned when the table grows over this
+	bucketPruneSize = 4096
+)
+
+var (
+	metricRejected = metrics.Default.NewCounterVec("lproxyc_listener_rejected_total",
+		"Accepted connections closed by guard.", "reason")
+	metricConns = metrics.Default.NewGaugeVec("lproxyc_listener_conns_active",
+		"Connections accepted and not closed yet.")
+)
+
+// reject reasons
+const (
+	rejectDenied   = "denied"
+	rejectMaxConns = "max_conns"
+	rejectRate     = "rate"
+)
+
+// Config guard settings, zero values disable each check
+type Config struct {
+	// Allow if not empty, only sources in these cidrs are accepted
+	Allow []string `json:"allow"`
+	// Deny sources in these cidrs are rejected, checked before Allow
+	Deny []string `json:"deny"`
+	// MaxConns max concurrent connections
+	MaxConns int `json:"max_conns"`
+	// RatePerIP new connections per second per source ip
+	RatePerIP float64 `json:"rate_per_ip"`
+	// BurstPerIP connections allowed at once, default one second of rate
+	BurstPerIP int `json:"burst_per_ip"`
+}
+
+// Guard guard
+type Guard struct {
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	maxConns int
+	rate     float64
+	burst    float64
+
+	lock    sync.Mutex
+	conns   int
+	buckets map[string]*bucket
+
+	metricConns *metrics.Value
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Build build guard, nil if nothing configured
+func (c *Config) Build() (*Guard, error) {
+	if len(c.Allow) == 0 && len(c.Deny) == 0 && c.MaxConns <= 0 && c.RatePerIP <= 0 {
+		return nil, nil
+	}
+
+	return New(c)
+}
+
+// New new guard
+func New(c *Config) (*Guard, error) {
+	g := &Guard{
+		maxConns:    c.MaxConns,
+		rate:        c.RatePerIP,
+		burst:       float64(c.BurstPerIP),
+		buckets:     make(map[string]*bucket),
+		metricConns: metricConns.With(),
+	}
+
+	if g.burst <= 0 {
+		g.burst = g.rate
+	}
+	if g.burst < 1 {
+		g.burst = 1
+	}
+
+	var err error
+	if g.allow, err = ParseCIDRs(c.Allow); err != nil {
+		return nil, err
+	}
+
+	if g.deny, err = ParseCIDRs(c.Deny); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// ParseCIDRs parse cidrs or single ips
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		n, err := ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// ParseCIDR parse a cidr, or a single ip as a net of only it
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid cidr or ip %q", s)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// admit check source ip, count the connection if admitted
+func (g *Guard) admit(ip net.IP) string {
+	if ip != nil {
+		if contains(g.deny, ip) {
+			return rejectDenied
+		}
+
+		if len(g.allow) > 0 && !contains(g.allow, ip) {
+			return rejectDenied
+		}
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.maxConns > 0 && g.conns >= g.maxConns {
+		return rejectMaxConns
+	}
+
+	if g.rate > 0 && ip != nil && !g.take(ip.String()) {
+		return rejectRate
+	}
+
+	g.conns++
+	g.metricConns.Inc()
+
+	return ""
+}
+
+// take take a token of ip bucket, lock held
+func (g *Guard) take(ip string) bool {
+	now := time.Now()
+	b, ok := g.buckets[ip]
+	if !ok {
+		if len(g.buckets) >= bucketPruneSize {
+			g.prune(now)
+		}
+
+		b = &bucket{tokens: g.burst, last: now}
+		g.buckets[ip] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * g.rate
+	if b.tokens > g.burst {
+		b.tokens = g.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// prune drop buckets refilled to full, lock held
+func (g *Guard) prune(now time.Time) {
+	for ip, b := range g.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*g.rate >= g.burst {
+			delete(g.buckets, ip)
+		}
+	}
+}
+
+func (g *Guard) release() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.conns--
+	g.metricConns.Dec()
+}
+
+// Listener wrap l, rejected connections are closed right after accept
+func (g *Guard) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, g: g}
+}
+
+type listener struct {
+	net.Listener
+	g *Guard
+}
+
+// Accept implement net.Listener
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		var ip net.IP
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP
+		}
+
+		if reason := l.g.admit(ip); reason != "" {
+			log.Printf("guard reject %s: %s", c.RemoteAddr(), reason)
+			metricRejected.With(reason).Inc()
+			c.Close()
+			continue
+		}
+
+		return &conn{Conn: c, g: l.g}, nil
+	}
+}
+
+// conn release guard count once on Close
+type conn struct {
+	net.Conn
+	g    *Guard
+	once sync.Once
+}
+
+// Close implement net.Conn
+func (c *conn) Close() error {
+	c.once.Do(c.g.release)
+	return c.Conn.Close()
+}
+
+// CloseWrite half close, if the wrapped conn supports it
+func (c *conn) CloseWrite() error {
+	return socks5.CloseWrite(c.Conn)
+}
+
+// Unwrap return the wrapped conn
+func (c *conn) Unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,240 @@
+package guard
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", " 1.2.3.4 ", "", "::1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"10.0.0.0/8", "1.2.3.4/32", "::1/128", "2001:db8::/32"}
+	if len(nets) != len(want) {
+		t.Fatalf("nets:%v, want %v", nets, want)
+	}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Fatalf("net %d:%s, want %s", i, n, want[i])
+		}
+	}
+
+	if _, err := ParseCIDRs([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("invalid cidr parsed")
+	}
+	if _, err := ParseCIDRs([]string{"example.com"}); err == nil {
+		t.Fatal("hostname parsed")
+	}
+}
+
+func TestAllowDeny(t *testing.T) {
+	g, err := New(&Config{
+		Allow: []string{"10.0.0.0/8", "::1"},
+		Deny:  []string{"10.1.0.0/16", "10.0.0.5"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ip     string
+		reason string
+	}{
+		{"10.2.3.4", ""},
+		{"::1", ""},
+		// deny wins over allow
+		{"10.1.2.3", rejectDenied},
+		{"10.0.0.5", rejectDenied},
+		// not allowed
+		{"192.168.1.1", rejectDenied},
+		{"::2", rejectDenied},
+	}
+
+	for _, c := range cases {
+		reason := g.admit(net.ParseIP(c.ip))
+		if reason != c.reason {
+			t.Fatalf("admit %s:%q, want %q", c.ip, reason, c.reason)
+		}
+		if reason == "" {
+			g.release()
+		}
+	}
+
+	// deny only, everything else allowed
+	g, err = New(&Config{Deny: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := g.admit(net.ParseIP("192.168.1.1")); reason != "" {
+		t.Fatalf("admit:%q, want admitted", reason)
+	}
+	if reason := g.admit(net.ParseIP("10.0.0.1")); reason != rejectDenied {
+		t.Fatalf("admit:%q, want %q", reason, rejectDenied)
+	}
+}
+
+func TestRatePerIP(t *testing.T) {
+	g, err := New(&Config{RatePerIP: 10, BurstPerIP: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("1.2.3.4")
+	for i := 0; i < 2; i++ {
+		if reason := g.admit(ip); reason != "" {
+			t.Fatalf("burst admit %d:%q", i, reason)
+		}
+	}
+
+	if reason := g.admit(ip); reason != rejectRate {
+		t.Fatalf("admit over burst:%q, want %q", reason, rejectRate)
+	}
+
+	// buckets are per ip
+	if reason := g.admit(net.ParseIP("5.6.7.8")); reason != "" {
+		t.Fatalf("other ip:%q", reason)
+	}
+
+	// a token refills in 100ms
+	time.Sleep(150 * time.Millisecond)
+	if reason := g.admit(ip); reason != "" {
+		t.Fatalf("admit after refill:%q", reason)
+	}
+}
+
+// guarded tcp listener and a dial function returning both ends
+func guardedListener(t *testing.T, g *Guard) (net.Listener, func() (net.Conn, net.Conn)) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gl := g.Listener(l)
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := gl.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	dial := func() (net.Conn, net.Conn) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case s := <-accepted:
+			return c, s
+		case <-time.After(200 * time.Millisecond):
+			return c, nil
+		}
+	}
+
+	return gl, dial
+}
+
+func TestMaxConns(t *testing.T) {
+	g, err := New(&Config{MaxConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, dial := guardedListener(t, g)
+	defer l.Close()
+
+	c1, s1 := dial()
+	defer c1.Close()
+	if s1 == nil {
+		t.Fatal("first conn not accepted")
+	}
+
+	// over limit, closed right after accept
+	c2, s2 := dial()
+	defer c2.Close()
+	if s2 != nil {
+		t.Fatal("conn over limit accepted")
+	}
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(c2); err != nil {
+		t.Fatal("rejected conn not closed:", err)
+	}
+
+	// closing releases the count, once
+	s1.Close()
+	s1.Close()
+
+	c3, s3 := dial()
+	defer c3.Close()
+	if s3 == nil {
+		t.Fatal("conn not accepted after release")
+	}
+	defer s3.Close()
+
+	g.lock.Lock()
+	conns := g.conns
+	g.lock.Unlock()
+	if conns != 1 {
+		t.Fatalf("conns:%d, want 1", conns)
+	}
+}
+
+func TestConnWrapper(t *testing.T) {
+	g, err := New(&Config{MaxConns: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, dial := guardedListener(t, g)
+	defer l.Close()
+
+	c, s := dial()
+	defer c.Close()
+	if s == nil {
+		t.Fatal("conn not accepted")
+	}
+	defer s.Close()
+
+	u, ok := s.(interface{ Unwrap() net.Conn })
+	if !ok {
+		t.Fatal("wrapper has no Unwrap")
+	}
+	if _, ok := u.Unwrap().(*net.TCPConn); !ok {
+		t.Fatalf("Unwrap:%T, want *net.TCPConn", u.Unwrap())
+	}
+
+	cw, ok := s.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("wrapper has no CloseWrite")
+	}
+	if _, err := s.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// peer reads to EOF, the other direction stays open
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := ioutil.ReadAll(c)
+	if err != nil || string(data) != "bye" {
+		t.Fatalf("read %q %v, want bye and EOF", data, err)
+	}
+
+	if _, err := c.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := s.Read(buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("read %q %v after CloseWrite", buf, err)
+	}
+}
@@ -0,0 +1,309 @@
+// Package httpproxy http proxy front end, CONNECT and plain http
+// requests are turned into socks5 requests and passed to the same
+// request handler as the socks5 server
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"lproxyc/socks5"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// auth methods, same as socks5
+	methodNoAuth   = 0
+	methodUserPass = 2
+)
+
+var (
+	// hopHeaders not forwarded to server
+	hopHeaders = []string{
+		"Connection",
+		"Proxy-Connection",
+		"Proxy-Authorization",
+		"Proxy-Authenticate",
+		"Keep-Alive",
+		"Te",
+		"Trailer",
+		"Upgrade",
+	}
+)
+
+// Config http proxy config, fields have the same meaning as in
+// socks5.Config
+type Config struct {
+	Credentials socks5.CredentialStore
+	AuthLimiter *socks5.AuthLimiter
+	Rewriter    socks5.AddressRewriter
+	Rules       socks5.RuleSet
+
+	// HandshakeTimeout if set, connections must send request
+	// header within it
+	HandshakeTimeout time.Duration
+
+	ReqHandler socks5.RequestHandler
+}
+
+// Server http proxy
+type Server struct {
+	config *Config
+}
+
+// New new http proxy
+func New(conf *Config) *Server {
+	return &Server{config: conf}
+}
+
+// ServeConn serve one proxy request, the connection is closed after
+// the request, keep-alive is not supported
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	if s.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	}
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return fmt.Errorf("read request failed: %v", err)
+	}
+
+	ac, err := s.authenticate(conn, req)
+	if err != nil {
+		return err
+	}
+
+	dest, err := destination(req)
+	if err != nil {
+		writeStatus(conn, http.StatusBadRequest)
+		return err
+	}
+
+	sreq := &socks5.SocksRequest{
+		Version:     5,
+		Command:     socks5.ConnectCommand,
+		AuthContext: ac,
+		DestAddr:    dest,
+	}
+
+	if !socks5.Prepare(sreq, s.config.Rewriter, s.config.Rules) {
+		writeStatus(conn, http.StatusForbidden)
+		return fmt.Errorf("request to %v blocked by rules", sreq.DestAddr)
+	}
+
+	if req.Method == http.MethodConnect {
+		sreq.Conn = socks5.NewBufConn(conn, br)
+	} else {
+		// header is rewritten, body bytes are still in br
+		header := requestHeader(req)
+		sreq.Conn = socks5.NewBufConn(conn, io.MultiReader(bytes.NewReader(header), br))
+	}
+
+	allocator, ok := s.config.ReqHandler.(socks5.Allocator)
+	if !ok {
+		if err := s.connected(conn, req); err != nil {
+			return err
+		}
+
+		err = s.config.ReqHandler.HandleRequest(sreq)
+		if err != nil {
+			return fmt.Errorf("Failed to HandleRequest: %v", err)
+		}
+
+		return nil
+	}
+
+	run, err := allocator.Allocate(sreq)
+	if err != nil {
+		writeStatus(conn, replyStatus(socks5.ReplyCode(err)))
+		return fmt.Errorf("Failed to allocate request: %v", err)
+	}
+
+	if err := s.connected(conn, req); err != nil {
+		// run owns conn, it ends when conn is closed
+		conn.Close()
+	}
+
+	run()
+
+	return nil
+}
+
+// connected reply CONNECT established, clear handshake deadline
+func (s *Server) connected(conn net.Conn, req *http.Request) error {
+	if req.Method == http.MethodConnect {
+		_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+
+	return nil
+}
+
+// replyStatus http status of a socks5 reply code
+func replyStatus(code uint8) int {
+	switch code {
+	case socks5.ReplyRuleFailure:
+		return http.StatusForbidden
+	case socks5.ReplyNetworkUnreachable, socks5.ReplyHostUnreachable,
+		socks5.ReplyConnectionRefused:
+		return http.StatusBadGateway
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// authenticate check Proxy-Authorization basic credentials, reply
+// 407 if failed
+func (s *Server) authenticate(conn net.Conn, req *http.Request) (*socks5.AuthContext, error) {
+	if s.config.Credentials == nil {
+		return &socks5.AuthContext{Method: methodNoAuth}, nil
+	}
+
+	limiter := s.config.AuthLimiter
+	ip := socks5.RemoteIP(conn)
+	if limiter != nil && !limiter.Allow(ip) {
+		writeStatus(conn, http.StatusTooManyRequests)
+		return nil, fmt.Errorf("too many failed authentications from %s", ip)
+	}
+
+	user, pass, ok := parseBasicAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok || !s.config.Credentials.Valid(user, pass) {
+		if ok && limiter != nil {
+			limiter.Fail(ip)
+		}
+
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Basic realm=\"proxy\"\r\n"+
+			"Connection: close\r\n"+
+			"Content-Length: 0\r\n\r\n")
+		if ok {
+			return nil, socks5.ErrUserAuthFailed
+		}
+		return nil, fmt.Errorf("no proxy credentials")
+	}
+
+	if limiter != nil {
+		limiter.Reset(ip)
+	}
+
+	return &socks5.AuthContext{
+		Method:  methodUserPass,
+		Payload: map[string]string{"Username": user},
+	}, nil
+}
+
+func parseBasicAuth(auth string) (string, string, bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	i := strings.IndexByte(string(b), ':')
+	if i < 0 {
+		return "", "", false
+	}
+
+	return string(b[:i]), string(b[i+1:]), true
+}
+
+// destination host:port of CONNECT, or of the absolute url of a
+// plain request
+func destination(req *http.Request) (*socks5.AddrSpec, error) {
+	hostport := req.Host
+	defaultPort := "80"
+	if req.Method == http.MethodConnect {
+		defaultPort = "443"
+	} else {
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			return nil, fmt.Errorf("unsupported url %q", req.RequestURI)
+		}
+		hostport = req.URL.Host
+	}
+
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, portStr = strings.Trim(hostport, "[]"), defaultPort
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 || host == "" {
+		return nil, fmt.Errorf("invalid host %q", hostport)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		// 4 bytes for ipv4, as socks5 requests carry it
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &socks5.AddrSpec{IP: ip, Port: port}, nil
+	}
+
+	return &socks5.AddrSpec{FQDN: host, Port: port}, nil
+}
+
+// requestHeader origin-form request header sent to server,
+// hop-by-hop headers removed
+func requestHeader(req *http.Request) []byte {
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+
+	// server must close after response, the rest of conn is piped
+	// as is, a next request on it may be for another host
+	req.Header.Set("Connection", "close")
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	} else if req.ContentLength > 0 {
+		req.Header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	req.Header.Write(&buf)
+	buf.WriteString("\r\n")
+
+	return buf.Bytes()
+}
+
+func writeStatus(w io.Writer, code int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n",
+		code, http.StatusText(code))
+}
+
+// Serve serve connections from l, until l is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				log.Println("httpproxy ServeConn failed:", err)
+			}
+		}()
+	}
+}
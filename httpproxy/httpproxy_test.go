@@ -0,0 +1,41 @@
+package httpproxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDestination(t *testing.T) {
+	cases := []struct {
+		req  string
+		ip   net.IP
+		fqdn string
+		port int
+	}{
+		{"CONNECT 1.2.3.4:443 HTTP/1.1\r\nHost: 1.2.3.4:443\r\n\r\n", net.IP{1, 2, 3, 4}, "", 443},
+		{"GET http://1.2.3.4/ HTTP/1.1\r\nHost: 1.2.3.4\r\n\r\n", net.IP{1, 2, 3, 4}, "", 80},
+		{"CONNECT [::1]:8443 HTTP/1.1\r\nHost: [::1]:8443\r\n\r\n", net.IPv6loopback, "", 8443},
+		{"GET http://example.com:8080/ HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", nil, "example.com", 8080},
+	}
+
+	for _, c := range cases {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(c.req)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dest, err := destination(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// ipv4 is 4 bytes on the wire
+		if len(dest.IP) != len(c.ip) || !dest.IP.Equal(c.ip) ||
+			dest.FQDN != c.fqdn || dest.Port != c.port {
+			t.Fatalf("%q: dest %v %q %d", c.req, []byte(dest.IP), dest.FQDN, dest.Port)
+		}
+	}
+}
@@ -1,35 +1,129 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"lproxyc/config"
+	"lproxyc/dnsproxy"
+	"lproxyc/fakeip"
+	"lproxyc/metrics"
+	"lproxyc/rotate"
 	"lproxyc/server"
+	"lproxyc/socks5"
 )
 
 var (
 	listenAddr = ""
+	configFile = ""
 	wsPath     = ""
 	daemon     = ""
 
 	uuid      = ""
 	url       = ""
 	tunnelCap = 2
+	tunnelMax = 0
+	tunScale  = 64
+	tunCool   = 60
 	reqCap    = 200
+	reqInit   = 64
+	reqWait   = 5
+	reqQueue  = 256
+	grace     = 10
+
+	metricsAddr = ""
+	adminAddr   = ""
+
+	dnsAddr   = ""
+	dnsRemote = "8.8.8.8:53"
+	dnsLocal  = ""
+	dnsRules  = ""
+
+	fakeIPRange = ""
+	fakeIPFile  = "fakeip.json"
+
+	allowCIDRs       = ""
+	denyCIDRs        = ""
+	maxConns         = 0
+	connRate         = 0.0
+	handshakeTimeout = 10
+	idleTimeout      = 0
+	lingerTimeout    = 0
+	keepAlive        = 30
+
+	chunkSize     = 4096
+	adaptiveChunk = false
+	quotaReport   = 20
+	wsReadBuffer  = 0
+	wsWriteBuffer = 0
+	maxFrame      = 1 << 20
+	pingInterval  = 30
+	pingTimeout   = 10
+
+	authBackend     = ""
+	authMaxFailures = 5
+	authFailWindow  = 300
+
+	accessLog        = ""
+	accessLogSize    = 100
+	accessLogHours   = 24
+	accessLogBackups = 7
 )
 
 func init() {
-	flag.StringVar(&listenAddr, "l", "127.0.0.1:8020", "specify the listen address")
+	flag.StringVar(&listenAddr, "l", "127.0.0.1:8020", "specify comma separated listen addresses, [protocol://]addr, protocol is socks5 (default), http, mixed or transparent, addr can be unix:/path")
 	flag.StringVar(&daemon, "d", "yes", "specify daemon mode")
-	flag.StringVar(&url, "url", "", "specify the url")
+	flag.StringVar(&configFile, "c", "", "specify the json config file")
+	flag.StringVar(&url, "url", "", "specify the url, scheme ws/wss/tcp/tls selects the transport, comma separated urls are raced as endpoints")
 	flag.StringVar(&uuid, "uuid", "", "specify uuid")
-	flag.IntVar(&tunnelCap, "tunc", 2, "specify tunnel capacity")
-	flag.IntVar(&reqCap, "reqc", 200, "specify request capacity")
+	flag.IntVar(&tunnelCap, "tunc", 2, "specify tunnel capacity, the min tunnel count if -tunmax is larger")
+	flag.IntVar(&tunnelMax, "tunmax", 0, "specify max tunnels opened on load, with a standby tunnel kept ready, 0 to keep -tunc tunnels")
+	flag.IntVar(&tunScale, "tun-scale", 64, "specify average requests per tunnel to open more tunnels, up to -tunmax")
+	flag.IntVar(&tunCool, "tun-cooldown", 60, "specify seconds before surplus tunnels are closed, down to -tunc")
+	flag.IntVar(&reqCap, "reqc", 200, "specify max request capacity per account, at most 65535")
+	flag.IntVar(&reqInit, "reqinit", 64, "specify request slots allocated at start, grown on demand up to -reqc")
+	flag.IntVar(&reqWait, "req-wait", 5, "specify seconds a request waits for a free slot when -reqc is reached, 0 to fail at once")
+	flag.IntVar(&reqQueue, "req-queue", 256, "specify max requests waiting for a free slot")
+	flag.IntVar(&grace, "grace", 10, "specify seconds to wait requests finish when shutdown")
+	flag.StringVar(&metricsAddr, "metrics", "", "specify the metrics listen address, empty to disable")
+	flag.StringVar(&dnsAddr, "dns", "", "specify the dns listen address, empty to disable")
+	flag.StringVar(&dnsRemote, "dns-remote", "8.8.8.8:53", "specify the resolver queried through the tunnel")
+	flag.StringVar(&dnsLocal, "dns-local", "", "specify the resolver queried directly for local rules")
+	flag.StringVar(&dnsRules, "dns-rules", "", "specify dns split rules, e.g. lan:local,example.com:remote")
+	flag.StringVar(&fakeIPRange, "fakeip", "", "specify the fake ip range for dns, e.g. "+fakeip.DefaultRange+", empty to disable")
+	flag.StringVar(&fakeIPFile, "fakeip-file", "fakeip.json", "specify the file to persist fake ip mapping")
+	flag.StringVar(&allowCIDRs, "allow", "", "specify comma separated source cidrs allowed to connect, empty to allow all")
+	flag.StringVar(&denyCIDRs, "deny", "", "specify comma separated source cidrs denied to connect")
+	flag.IntVar(&maxConns, "maxconn", 0, "specify max concurrent local connections, 0 for unlimited")
+	flag.Float64Var(&connRate, "conn-rate", 0, "specify new connections per second per source ip, 0 for unlimited")
+	flag.IntVar(&handshakeTimeout, "handshake-timeout", 10, "specify seconds a local connection has to send its request, 0 to disable")
+	flag.IntVar(&idleTimeout, "idle-timeout", 0, "specify seconds a request without data is closed after, 0 to disable")
+	flag.IntVar(&lingerTimeout, "linger-timeout", 0, "specify seconds a request half closed by either side is closed after without data, 0 to disable")
+	flag.IntVar(&chunkSize, "chunk", 4096, "specify max bytes read from a local connection per tunnel frame, 512 to 262144")
+	flag.BoolVar(&adaptiveChunk, "chunk-adaptive", false, "grow chunk size from 4096 up to -chunk for bulk transfers, keep it small for interactive ones, -chunk must be over 4096")
+	flag.IntVar(&quotaReport, "quota-report", 20, "specify packets received per quota report, must be less than the server send window")
+	flag.IntVar(&wsReadBuffer, "ws-rbuf", 0, "specify websocket read buffer size, 0 for default")
+	flag.IntVar(&wsWriteBuffer, "ws-wbuf", 0, "specify websocket write buffer size, 0 for default")
+	flag.IntVar(&maxFrame, "max-frame", 1<<20, "specify max tunnel message size in both directions, the server may lower it, at most 1MB for tcp/tls")
+	flag.IntVar(&pingInterval, "ping-interval", 30, "specify seconds between tunnel pings")
+	flag.IntVar(&pingTimeout, "ping-timeout", 10, "specify seconds a tunnel is dead after when nothing is received past the ping interval")
+	flag.IntVar(&keepAlive, "keepalive", 30, "specify tcp keepalive seconds of local connections, 0 for system default, -1 to disable")
+	flag.StringVar(&authBackend, "auth", "", "specify the auth backend: htpasswd:/path, cmd:/path or http(s)://url, overrides config file, users in config file are used if empty")
+	flag.IntVar(&authMaxFailures, "auth-max-fail", 5, "specify failed authentications allowed per source ip within -auth-fail-window, 0 to disable")
+	flag.IntVar(&authFailWindow, "auth-fail-window", 300, "specify seconds a source ip is blocked after too many failed authentications")
+	flag.StringVar(&accessLog, "accesslog", "", "specify the access log file, empty to disable")
+	flag.IntVar(&accessLogSize, "accesslog-size", 100, "specify the access log rotate size in MB, 0 to disable")
+	flag.IntVar(&accessLogHours, "accesslog-hours", 24, "specify the access log rotate interval in hours, 0 to disable")
+	flag.IntVar(&accessLogBackups, "accesslog-backups", 7, "specify the rotated access log files to keep, 0 to keep all")
+	flag.StringVar(&adminAddr, "admin", "", "specify the admin api listen address, loopback or unix:/path, empty to disable")
 }
 
 // getVersion get version
@@ -61,29 +155,297 @@ func main() {
 	}
 
 	log.Printf("uuid:%s, url:%s", uuid, url)
+
+	urls := strings.Split(url, ",")
+	for i := range urls {
+		urls[i] = strings.TrimSpace(urls[i])
+	}
 	log.Println("try to start  linproxy-c server, version:", getVersion())
 
-	// start http server
-	go server.CreateSocks5erver(listenAddr, url, uuid, tunnelCap, reqCap)
+	if accessLog != "" {
+		server.SetAccessLog(&rotate.Writer{
+			Path:       accessLog,
+			MaxSize:    int64(accessLogSize) * 1024 * 1024,
+			Interval:   time.Duration(accessLogHours) * time.Hour,
+			MaxBackups: accessLogBackups,
+		})
+	}
+
+	if metricsAddr != "" {
+		go func() {
+			log.Println("metrics server stopped:", metrics.ListenAndServe(metricsAddr))
+		}()
+	}
+
+	cfg := &config.Config{}
+	if configFile != "" {
+		var err error
+		cfg, err = config.Load(configFile)
+		if err != nil {
+			fmt.Println("load config file failed:", err)
+			os.Exit(1)
+		}
+	}
+
+	rewriter, err := cfg.Rewrite.Build()
+	if err != nil {
+		fmt.Println("build address rewriter failed:", err)
+		os.Exit(1)
+	}
+
+	if authBackend != "" {
+		cfg.Auth.Backend = authBackend
+	}
+
+	credentials, err := cfg.Auth.Build()
+	if err != nil {
+		fmt.Println("build auth backend failed:", err)
+		os.Exit(1)
+	}
+
+	var limiter *socks5.AuthLimiter
+	if credentials != nil && authMaxFailures > 0 {
+		limiter = socks5.NewAuthLimiter(authMaxFailures, time.Duration(authFailWindow)*time.Second)
+	}
+
+	if allowCIDRs != "" {
+		cfg.Guard.Allow = strings.Split(allowCIDRs, ",")
+	}
+	if denyCIDRs != "" {
+		cfg.Guard.Deny = strings.Split(denyCIDRs, ",")
+	}
+	if maxConns > 0 {
+		cfg.Guard.MaxConns = maxConns
+	}
+	if connRate > 0 {
+		cfg.Guard.RatePerIP = connRate
+	}
+
+	g, err := cfg.Guard.Build()
+	if err != nil {
+		fmt.Println("build listener guard failed:", err)
+		os.Exit(1)
+	}
+
+	pm, err := cfg.Policy.Build()
+	if err != nil {
+		fmt.Println("build user policy failed:", err)
+		os.Exit(1)
+	}
+
+	var pool *fakeip.Pool
+	if fakeIPRange != "" {
+		pool, err = fakeip.New(fakeIPRange, fakeIPFile)
+		if err != nil {
+			fmt.Println("create fake ip pool failed:", err)
+			os.Exit(1)
+		}
+	}
+
+	handshake := time.Duration(handshakeTimeout) * time.Second
+	listeners := parseListenAddrs(listenAddr)
+	for i := range listeners {
+		if credentials == nil && len(cfg.Guard.Allow) == 0 && !server.IsLoopback(listeners[i].Addr) {
+			log.Warnf("listen at %s without auth or -allow, anyone can reach the tunnel", listeners[i].Addr)
+		}
+
+		listeners[i].Credentials = credentials
+		listeners[i].AuthLimiter = limiter
+		listeners[i].Guard = g
+		listeners[i].HandshakeTimeout = handshake
+	}
+
+	for _, l := range cfg.Listeners {
+		lc, err := buildListener(l, handshake)
+		if err != nil {
+			fmt.Println("build listener failed:", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, lc)
+	}
+
+	client, err := server.NewClient(server.Config{
+		URL:       urls[0],
+		Endpoints: urls[1:],
+		UUID:      uuid,
+		TunnelCap: tunnelCap,
+		TunnelMax: tunnelMax,
+		ReqCap:    reqCap,
+		Grace:     time.Duration(grace) * time.Second,
+		FakeIP:    pool,
+		Rewriter:  rewriter,
+		Policy:    pm,
+
+		TunnelScaleRequests: tunScale,
+		TunnelCooldown:      time.Duration(tunCool) * time.Second,
+
+		IdleTimeout:   time.Duration(idleTimeout) * time.Second,
+		LingerTimeout: time.Duration(lingerTimeout) * time.Second,
+		KeepAlive:     time.Duration(keepAlive) * time.Second,
+
+		ChunkSize:         chunkSize,
+		AdaptiveChunk:     adaptiveChunk,
+		QuotaReport:       quotaReport,
+		WSReadBufferSize:  wsReadBuffer,
+		WSWriteBufferSize: wsWriteBuffer,
+		MaxFrameSize:      maxFrame,
+		PingInterval:      time.Duration(pingInterval) * time.Second,
+		PingTimeout:       time.Duration(pingTimeout) * time.Second,
+
+		ReqInit:      reqInit,
+		ReqWait:      time.Duration(reqWait) * time.Second,
+		ReqWaitQueue: reqQueue,
+
+		Accounts: cfg.Accounts,
+		Routes:   cfg.Routes,
+
+		Listeners: listeners,
+	})
+	if err != nil {
+		fmt.Println("create client failed:", err)
+		os.Exit(1)
+	}
+
+	err = client.Start(context.Background())
+	if err != nil {
+		fmt.Println("start client failed:", err)
+		os.Exit(1)
+	}
 	log.Println("start linproxy-c server ok!")
 
+	var ds *dnsproxy.Server
+	if dnsAddr != "" {
+		ds, err = startDNS(client, pool)
+		if err != nil {
+			fmt.Println("start dns server failed:", err)
+			os.Exit(1)
+		}
+	}
+
+	if adminAddr != "" {
+		go func() {
+			log.Println("admin server stopped:", client.ServeAdmin(adminAddr))
+		}()
+	}
+
 	if daemon == "yes" {
-		waitForSignal()
+		waitForSignal(client.Done())
 	} else {
-		waitInput()
+		waitInput(client.Done())
+	}
+
+	log.Println("shutting down, grace period:", grace)
+	if ds != nil {
+		ds.Close()
+	}
+
+	err = client.Close()
+	if err != nil {
+		log.Println("client stopped with error:", err)
+		os.Exit(1)
 	}
-	return
 }
 
-func waitInput() {
-	var cmd string
-	for {
-		_, err := fmt.Scanf("%s\n", &cmd)
-		if err != nil {
-			//log.Println("Scanf err:", err)
+func startDNS(client *server.Client, pool *fakeip.Pool) (*dnsproxy.Server, error) {
+	rules, err := dnsproxy.ParseRules(dnsRules)
+	if err != nil {
+		return nil, err
+	}
+
+	ds, err := dnsproxy.New(dnsproxy.Config{
+		ListenAddr:     dnsAddr,
+		RemoteResolver: dnsRemote,
+		RemoteDial:     client.DialContext,
+		LocalResolver:  dnsLocal,
+		Rules:          rules,
+		FakeIP:         pool,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ds, ds.Start(context.Background())
+}
+
+// parseListenAddrs parse -l, [protocol://]addr,...
+func parseListenAddrs(s string) []server.ListenerConfig {
+	var lcs []server.ListenerConfig
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
 			continue
 		}
 
+		lc := server.ListenerConfig{Protocol: server.ProtocolSOCKS5, Addr: item}
+		if i := strings.Index(item, "://"); i >= 0 {
+			lc.Protocol, lc.Addr = item[:i], item[i+3:]
+		}
+		lcs = append(lcs, lc)
+	}
+
+	return lcs
+}
+
+// buildListener build listener in config file
+func buildListener(l config.Listener, handshake time.Duration) (server.ListenerConfig, error) {
+	lc := server.ListenerConfig{
+		Addr:             l.Addr,
+		Protocol:         l.Protocol,
+		HandshakeTimeout: handshake,
+		Account:          l.Account,
+		Routes:           l.Routes,
+	}
+
+	if l.HandshakeTimeout > 0 {
+		lc.HandshakeTimeout = time.Duration(l.HandshakeTimeout) * time.Second
+	}
+
+	if l.Auth != nil {
+		credentials, err := l.Auth.Build()
+		if err != nil {
+			return lc, err
+		}
+
+		if credentials != nil {
+			lc.Credentials = credentials
+			if authMaxFailures > 0 {
+				lc.AuthLimiter = socks5.NewAuthLimiter(authMaxFailures, time.Duration(authFailWindow)*time.Second)
+			}
+		}
+	}
+
+	g, err := l.Guard.Build()
+	if err != nil {
+		return lc, err
+	}
+	lc.Guard = g
+
+	return lc, nil
+}
+
+func waitInput(done <-chan struct{}) {
+	input := make(chan string)
+	go func() {
+		var cmd string
+		for {
+			_, err := fmt.Scanf("%s\n", &cmd)
+			if err != nil {
+				//log.Println("Scanf err:", err)
+				continue
+			}
+
+			input <- cmd
+		}
+	}()
+
+	for {
+		var cmd string
+		select {
+		case cmd = <-input:
+		case <-done:
+			return
+		}
+
 		switch cmd {
 		case "exit", "quit":
 			log.Println("exit by user")
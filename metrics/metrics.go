@@ -0,0 +1,200 @@
+// Package metrics minimal counters and gauges with labels, exposed
+// in prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+var (
+	// Default default registry
+	Default = NewRegistry()
+)
+
+// Registry hold metric families
+type Registry struct {
+	lock     sync.Mutex
+	families []*family
+}
+
+// NewRegistry create registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// family metrics with same name, different label values
+type family struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+
+	lock   sync.Mutex
+	series map[string]*Value
+}
+
+// Value float64 value, can be used concurrently
+type Value struct {
+	bits uint64
+}
+
+// Add add delta
+func (v *Value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+// Inc add 1
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+// Dec sub 1
+func (v *Value) Dec() {
+	v.Add(-1)
+}
+
+// Set set value, should only be used on gauge
+func (v *Value) Set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+// Get get value
+func (v *Value) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Vec metric family with labels
+type Vec struct {
+	f *family
+}
+
+// NewCounterVec register a counter family
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *Vec {
+	return r.register(name, help, typeCounter, labelNames)
+}
+
+// NewGaugeVec register a gauge family
+func (r *Registry) NewGaugeVec(name string, help string, labelNames ...string) *Vec {
+	return r.register(name, help, typeGauge, labelNames)
+}
+
+func (r *Registry) register(name string, help string, typ string, labelNames []string) *Vec {
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		series:     make(map[string]*Value),
+	}
+
+	r.lock.Lock()
+	r.families = append(r.families, f)
+	r.lock.Unlock()
+
+	return &Vec{f: f}
+}
+
+// With get value of label values, created if not exist
+func (v *Vec) With(labelValues ...string) *Value {
+	f := v.f
+	if len(labelValues) != len(f.labelNames) {
+		log.Panicf("metrics %s: expect %d label values, got %d",
+			f.name, len(f.labelNames), len(labelValues))
+	}
+
+	key := f.labelString(labelValues)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	val, ok := f.series[key]
+	if !ok {
+		val = &Value{}
+		f.series[key] = val
+	}
+
+	return val
+}
+
+// Delete remove series of label values
+func (v *Vec) Delete(labelValues ...string) {
+	f := v.f
+	key := f.labelString(labelValues)
+
+	f.lock.Lock()
+	delete(f.series, key)
+	f.lock.Unlock()
+}
+
+func (f *family) labelString(labelValues []string) string {
+	if len(labelValues) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labelValues))
+	for i, lv := range labelValues {
+		pairs[i] = fmt.Sprintf("%s=%q", f.labelNames[i], lv)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteText write all metrics in prometheus text format
+func (r *Registry) WriteText(w io.Writer) {
+	r.lock.Lock()
+	families := make([]*family, len(r.families))
+	copy(families, r.families)
+	r.lock.Unlock()
+
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+
+		f.lock.Lock()
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s %v\n", f.name, k, f.series[k].Get())
+		}
+		f.lock.Unlock()
+	}
+}
+
+// ServeHTTP implement http.Handler
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
+
+// ListenAndServe serve default registry at /metrics
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+
+	log.Printf("metrics server listen at:%s", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	up := r.NewGaugeVec("test_up", "Things up.", "account")
+	failed := r.NewCounterVec("test_failed_total", "Things failed.", "account", "reason")
+
+	up.With("b").Set(2)
+	up.With("a").Inc()
+	up.With("a").Dec()
+	up.With("a").Add(3)
+	failed.With("a", `quote"d`).Inc()
+	failed.With("a", "timeout").Add(2.5)
+	failed.With("gone", "x").Inc()
+	failed.Delete("gone", "x")
+
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+
+	want := `# HELP test_up Things up.
+# TYPE test_up gauge
+test_up{account="a"} 3
+test_up{account="b"} 2
+# HELP test_failed_total Things failed.
+# TYPE test_failed_total counter
+test_failed_total{account="a",reason="quote\"d"} 1
+test_failed_total{account="a",reason="timeout"} 2.5
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if v := up.With("a").Get(); v != 3 {
+		t.Fatalf("get %v, want 3", v)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test.").With().Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("content type %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), "\ntest_total 1\n") {
+		t.Fatalf("body %s", w.Body.String())
+	}
+}
+
+func TestWithLabelCount(t *testing.T) {
+	v := NewRegistry().NewGaugeVec("test", "Test.", "a", "b")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("wrong label count accepted")
+		}
+	}()
+	v.With("only one")
+}
@@ -0,0 +1,64 @@
+package mockserver
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// echoAddr in-memory address
+type echoAddr string
+
+func (a echoAddr) Network() string { return "mem" }
+func (a echoAddr) String() string  { return string(a) }
+
+// echoConn in-memory echo target, everything written is read back,
+// CloseWrite is supported so half-close can be tested
+type echoConn struct {
+	addr string
+
+	upReader   *io.PipeReader
+	upWriter   *io.PipeWriter
+	downReader *io.PipeReader
+	downWriter *io.PipeWriter
+}
+
+// EchoDial in-memory echo dialer, can be used as Config.Dial
+func EchoDial(network, addr string) (net.Conn, error) {
+	c := &echoConn{addr: addr}
+	c.upReader, c.upWriter = io.Pipe()
+	c.downReader, c.downWriter = io.Pipe()
+
+	go func() {
+		_, err := io.Copy(c.downWriter, c.upReader)
+		c.downWriter.CloseWithError(err)
+	}()
+
+	return c, nil
+}
+
+func (c *echoConn) Read(b []byte) (int, error) {
+	return c.downReader.Read(b)
+}
+
+func (c *echoConn) Write(b []byte) (int, error) {
+	return c.upWriter.Write(b)
+}
+
+// CloseWrite half close
+func (c *echoConn) CloseWrite() error {
+	return c.upWriter.Close()
+}
+
+func (c *echoConn) Close() error {
+	c.upWriter.Close()
+	c.upReader.Close()
+	c.downReader.Close()
+	return nil
+}
+
+func (c *echoConn) LocalAddr() net.Addr                { return echoAddr("echo") }
+func (c *echoConn) RemoteAddr() net.Addr               { return echoAddr(c.addr) }
+func (c *echoConn) SetDeadline(t time.Time) error      { return nil }
+func (c *echoConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *echoConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,366 @@
+package mockserver_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"lproxyc/mockserver"
+	"lproxyc/server"
+)
+
+const testUUID = "mock-test"
+
+// waitSessions wait until the mock has n websockets
+func waitSessions(t *testing.T, ms *mockserver.Server, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ms.Sessions() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("sessions:%d, want:%d", ms.Sessions(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startClient start a client on a random port, caller closes it
+func startClient(t *testing.T, ms *mockserver.Server, tunCap int) *server.Client {
+	t.Helper()
+
+	c, err := server.NewClient(server.Config{
+		ListenAddr: "127.0.0.1:0",
+		URL:        ms.URL(),
+		UUID:       testUUID,
+		TunnelCap:  tunCap,
+		ReqCap:     64,
+		Grace:      100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	waitSessions(t, ms, tunCap)
+
+	return c
+}
+
+// socksConnect socks5 no-auth handshake and connect, host can be
+// an ipv4 address or a domain
+func socksConnect(t *testing.T, proxy string, host string, port int) net.Conn {
+	t.Helper()
+
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(c, method); err != nil || method[1] != 0 {
+		t.Fatalf("method:%v, err:%v", method, err)
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req = append(req, 1)
+		req = append(req, ip...)
+	} else {
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// reply with ipv4 bind address
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(c, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("reply:%v, err:%v", reply, err)
+	}
+
+	c.SetDeadline(time.Time{})
+
+	return c
+}
+
+// testData payload over many chunks, position encoded so reordered
+// or lost chunks are detected
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := 0; i+4 <= size; i += 4 {
+		binary.BigEndian.PutUint32(data[i:], uint32(i))
+	}
+
+	return data
+}
+
+// echo write data, read it back and compare
+func echo(t *testing.T, c net.Conn, data []byte) {
+	t.Helper()
+
+	go c.Write(data)
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo data mismatch")
+	}
+}
+
+func TestEcho(t *testing.T) {
+	ms := mockserver.New(mockserver.Config{UUID: testUUID, Dial: mockserver.EchoDial})
+	defer ms.Close()
+
+	cl := startClient(t, ms, 2)
+	defer cl.Close()
+
+	for i := 0; i < 4; i++ {
+		c := socksConnect(t, cl.Addr().String(), "echo.test", 80)
+		echo(t, c, testData(256*1024))
+		c.Close()
+	}
+
+	if n := ms.Created(); n != 4 {
+		t.Fatalf("created:%d, want:4", n)
+	}
+
+	if ms.QuotaReports() == 0 {
+		t.Fatal("no quota reported")
+	}
+}
+
+func TestRealTarget(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	ms := mockserver.New(mockserver.Config{UUID: testUUID})
+	defer ms.Close()
+
+	cl := startClient(t, ms, 1)
+	defer cl.Close()
+
+	ta := target.Addr().(*net.TCPAddr)
+	c := socksConnect(t, cl.Addr().String(), ta.IP.String(), ta.Port)
+	defer c.Close()
+
+	echo(t, c, testData(64*1024))
+}
+
+func TestHalfClose(t *testing.T) {
+	ms := mockserver.New(mockserver.Config{UUID: testUUID, Dial: mockserver.EchoDial})
+	defer ms.Close()
+
+	cl := startClient(t, ms, 1)
+	defer cl.Close()
+
+	c := socksConnect(t, cl.Addr().String(), "echo.test", 80)
+	defer c.Close()
+
+	data := testData(32 * 1024)
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+
+	// everything is echoed back after our side finished, then EOF
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestReorder(t *testing.T) {
+	ms := mockserver.New(mockserver.Config{
+		UUID:   testUUID,
+		Dial:   mockserver.EchoDial,
+		Faults: mockserver.Faults{ReorderWindow: 8},
+		Seed:   1,
+	})
+	defer ms.Close()
+
+	cl := startClient(t, ms, 1)
+	defer cl.Close()
+
+	c := socksConnect(t, cl.Addr().String(), "echo.test", 80)
+	defer c.Close()
+
+	echo(t, c, testData(512*1024))
+}
+
+func TestDelay(t *testing.T) {
+	ms := mockserver.New(mockserver.Config{
+		UUID:   testUUID,
+		Dial:   mockserver.EchoDial,
+		Faults: mockserver.Faults{Delay: time.Millisecond},
+	})
+	defer ms.Close()
+
+	cl := startClient(t, ms, 1)
+	defer cl.Close()
+
+	c := socksConnect(t, cl.Addr().String(), "echo.test", 80)
+	defer c.Close()
+
+	start := time.Now()
+	echo(t, c, testData(64*1024))
+
+	// 16 frames at least, each delayed
+	if d := time.Since(start); d < 16*time.Millisecond {
+		t.Fatalf("echo took %v, delay not applied", d)
+	}
+}
+
+func TestDrop(t *testing.T) {
+	ms := mockserver.New(mockserver.Config{
+		UUID:   testUUID,
+		Dial:   mockserver.EchoDial,
+		Faults: mockserver.Faults{DropRate: 0.2},
+		Seed:   1,
+	})
+	defer ms.Close()
+
+	cl := startClient(t, ms, 1)
+	defer cl.Close()
+
+	c := socksConnect(t, cl.Addr().String(), "echo.test", 80)
+	defer c.Close()
+
+	data := testData(256 * 1024)
+	go c.Write(data)
+
+	// data after a lost frame is held, never delivered out of order,
+	// what arrives is an exact prefix
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	got, _ := ioutil.ReadAll(c)
+	if len(got) >= len(data) {
+		t.Fatalf("got all %d bytes with drops", len(got))
+	}
+
+	if !bytes.Equal(got, data[:len(got)]) {
+		t.Fatal("received data is not a prefix of sent data")
+	}
+}
+
+func TestAbruptClose(t *testing.T) {
+	ms := mockserver.New(mockserver.Config{UUID: testUUID, Dial: mockserver.EchoDial})
+	defer ms.Close()
+
+	cl := startClient(t, ms, 2)
+	defer cl.Close()
+
+	c := socksConnect(t, cl.Addr().String(), "echo.test", 80)
+	defer c.Close()
+	echo(t, c, testData(4096))
+
+	ms.SetFaults(mockserver.Faults{CloseAfter: 4})
+	go c.Write(testData(256 * 1024))
+
+	// the request dies with its tunnel, our write is still in flight
+	// then, and closing a socket with unread data sends a reset
+	// (RFC 1122 4.2.2.13), so it ends with EOF or a reset depending
+	// on how much was read, anything else is a failure
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, c); err != nil && !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("request not closed with tunnel:", err)
+	}
+
+	ms.SetFaults(mockserver.Faults{})
+	deadline := time.Now().Add(time.Second)
+	for ms.Sessions() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ms.Sessions(); n != 1 {
+		t.Fatalf("sessions:%d, want:1", n)
+	}
+
+	// new requests go to the tunnel left
+	c2 := socksConnect(t, cl.Addr().String(), "echo.test", 80)
+	defer c2.Close()
+	echo(t, c2, testData(64*1024))
+}
+
+// TestAddress raw ip bytes that read as text are dialed as ip
+func TestAddress(t *testing.T) {
+	var lock sync.Mutex
+	var dialed []string
+	ms := mockserver.New(mockserver.Config{
+		UUID: testUUID,
+		Dial: func(network, addr string) (net.Conn, error) {
+			lock.Lock()
+			dialed = append(dialed, addr)
+			lock.Unlock()
+			return mockserver.EchoDial(network, addr)
+		},
+	})
+	defer ms.Close()
+
+	cl := startClient(t, ms, 1)
+	defer cl.Close()
+
+	hosts := []struct {
+		host string
+		want string
+	}{
+		{"100.101.102.103", "100.101.102.103:80"},
+		{"a.io", "a.io:80"},
+		{"echo.test", "echo.test:80"},
+	}
+
+	for _, h := range hosts {
+		c := socksConnect(t, cl.Addr().String(), h.host, 80)
+		echo(t, c, []byte("hello"))
+		c.Close()
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for i, h := range hosts {
+		if i >= len(dialed) || dialed[i] != h.want {
+			t.Fatalf("dialed %v, want %s at %d", dialed, h.want, i)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package mockserver in-process lproxy server for integration testing,
+// it implements the server side of the tunnel protocol over a httptest
+// websocket server, and can inject faults like reordering, drops, delays
+// and abrupt close
+package mockserver
+
+import (
+	"lproxyc/codec"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Faults fault injection settings
+type Faults struct {
+	// ReorderWindow shuffle data frames of a request in windows of this size,
+	// 0 or 1 disable reordering
+	ReorderWindow int
+	// DropRate probability [0,1] to drop a data frame
+	DropRate float64
+	// Delay sleep before each frame is sent
+	Delay time.Duration
+	// CloseAfter abruptly close the websocket after this many frames
+	// has been sent, 0 disable
+	CloseAfter int
+	// AcceptDelay wait before accepting a websocket, a slow endpoint
+	AcceptDelay time.Duration
+}
+
+// Config mock server config
+type Config struct {
+	// UUID if not empty, websocket with other uuid is rejected
+	UUID string
+	// Dial used to connect to request target, default is net.Dial,
+	// use EchoDial for in-memory echo targets
+	Dial func(network, addr string) (net.Conn, error)
+	// Faults initial faults
+	Faults Faults
+	// Seed random seed for faults
+	Seed int64
+	// MaxFrame if set, max frame size sent to client in the handshake,
+	// the smaller of it and the client one is used
+	MaxFrame int
+}
+
+// Server mock lproxy server
+type Server struct {
+	httpServer *httptest.Server
+	upgrader   websocket.Upgrader
+	dial       func(network, addr string) (net.Conn, error)
+	uuid       string
+	maxFrame   int
+
+	lock     sync.Mutex
+	faults   Faults
+	rand     *rand.Rand
+	sessions map[*session]struct{}
+
+	created int
+	quota   int
+}
+
+// New create and start a mock server
+func New(cfg Config) *Server {
+	s := &Server{
+		dial:     cfg.Dial,
+		uuid:     cfg.UUID,
+		maxFrame: cfg.MaxFrame,
+		faults:   cfg.Faults,
+		rand:     rand.New(rand.NewSource(cfg.Seed)),
+		sessions: make(map[*session]struct{}),
+	}
+
+	if s.dial == nil {
+		s.dial = net.Dial
+	}
+
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// URL websocket url to use as account url
+func (s *Server) URL() string {
+	return "ws" + strings.TrimPrefix(s.httpServer.URL, "http") + "/"
+}
+
+// Close close all websockets and stop the server
+func (s *Server) Close() {
+	s.DropAll()
+	s.httpServer.Close()
+}
+
+// SetFaults change faults, take effect immediately
+func (s *Server) SetFaults(f Faults) {
+	s.lock.Lock()
+	s.faults = f
+	s.lock.Unlock()
+}
+
+// DropAll abruptly close all websockets
+func (s *Server) DropAll() {
+	s.lock.Lock()
+	ss := make([]*session, 0, len(s.sessions))
+	for ses := range s.sessions {
+		ss = append(ss, ses)
+	}
+	s.lock.Unlock()
+
+	for _, ses := range ss {
+		ses.conn.Close()
+	}
+}
+
+// Sessions current websocket count
+func (s *Server) Sessions() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.sessions)
+}
+
+// Created total requests created
+func (s *Server) Created() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.created
+}
+
+// QuotaReports total quota reports received
+func (s *Server) QuotaReports() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.quota
+}
+
+func (s *Server) getFaults() Faults {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.faults
+}
+
+func (s *Server) shouldDrop(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.rand.Float64() < rate
+}
+
+func (s *Server) shuffle(frames [][]byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.rand.Shuffle(len(frames), func(i, j int) {
+		frames[i], frames[j] = frames[j], frames[i]
+	})
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.uuid != "" && r.URL.Query().Get("uuid") != s.uuid {
+		http.Error(w, "invalid uuid", http.StatusForbidden)
+		return
+	}
+
+	if ver, err := strconv.Atoi(r.URL.Query().Get(codec.VersionParam)); err == nil && ver > codec.Version {
+		http.Error(w, "unsupport protocol version", http.StatusBadRequest)
+		return
+	}
+
+	if d := s.getFaults().AcceptDelay; d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			// client gave up
+			timer.Stop()
+			return
+		}
+	}
+
+	maxFrame := codec.DefaultMaxFrame
+	if v, err := strconv.Atoi(r.URL.Query().Get(codec.MaxFrameParam)); err == nil && v > 0 {
+		maxFrame = v
+	}
+
+	var header http.Header
+	if s.maxFrame > 0 {
+		header = http.Header{codec.MaxFrameHeader: {strconv.Itoa(s.maxFrame)}}
+		if s.maxFrame < maxFrame {
+			maxFrame = s.maxFrame
+		}
+	}
+
+	c, err := s.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		return
+	}
+	c.SetReadLimit(int64(maxFrame))
+
+	ses := newSession(s, c, maxFrame)
+
+	s.lock.Lock()
+	s.sessions[ses] = struct{}{}
+	s.lock.Unlock()
+
+	ses.serve()
+
+	s.lock.Lock()
+	delete(s.sessions, ses)
+	s.lock.Unlock()
+}
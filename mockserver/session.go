@@ -0,0 +1,381 @@
+package mockserver
+
+import (
+	"bytes"
+	"io"
+	"lproxyc/codec"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	reorderFlushDelay = 10 * time.Millisecond
+)
+
+// session server side of one websocket tunnel
+type session struct {
+	owner *Server
+	conn  *websocket.Conn
+	// maxFrame negotiated max frame size
+	maxFrame int
+
+	writeLock sync.Mutex
+	sent      int
+
+	lock sync.Mutex
+	reqs map[uint32]*mreq
+}
+
+// mreq server side request
+type mreq struct {
+	idx  uint16
+	tag  uint16
+	conn net.Conn
+
+	// data from client, closed when client finished
+	up   chan []byte
+	quit chan struct{}
+
+	// frames hold for reordering
+	pendingLock  sync.Mutex
+	pending      [][]byte
+	pendingTimer *time.Timer
+
+	lastSeqNo      uint32
+	serverFinished bool
+	clientFinished bool
+	closed         bool
+}
+
+func reqKey(idx uint16, tag uint16) uint32 {
+	return uint32(idx)<<16 | uint32(tag)
+}
+
+func newSession(o *Server, c *websocket.Conn, maxFrame int) *session {
+	return &session{
+		owner:    o,
+		conn:     c,
+		maxFrame: maxFrame,
+		reqs:     make(map[uint32]*mreq),
+	}
+}
+
+func (ses *session) serve() {
+	for {
+		_, message, err := ses.conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		m, err := codec.DecodeClientMessage(message)
+		if err != nil {
+			break
+		}
+
+		h := m.GetHeader()
+		switch msg := m.(type) {
+		case *codec.ReqCreated:
+			ses.handleCreated(msg)
+		case *codec.ClientData:
+			if r := ses.getReq(h.Idx, h.Tag); r != nil && !r.clientFinished {
+				select {
+				case r.up <- msg.Data:
+				case <-r.quit:
+				}
+			}
+		case *codec.ClientEnd:
+			if h.Cmd == codec.CmdReqClientFinished {
+				if r := ses.getReq(h.Idx, h.Tag); r != nil && !r.clientFinished {
+					ses.lock.Lock()
+					r.clientFinished = true
+					ses.lock.Unlock()
+					close(r.up)
+				}
+			} else if r := ses.removeReq(h.Idx, h.Tag); r != nil {
+				ses.closeReq(r)
+			}
+		case *codec.ClientQuota:
+			ses.owner.lock.Lock()
+			ses.owner.quota++
+			ses.owner.lock.Unlock()
+		}
+	}
+
+	ses.conn.Close()
+
+	ses.lock.Lock()
+	reqs := ses.reqs
+	ses.reqs = make(map[uint32]*mreq)
+	ses.lock.Unlock()
+
+	for _, r := range reqs {
+		ses.closeReq(r)
+	}
+}
+
+// closeReq stop request, close target conn
+func (ses *session) closeReq(r *mreq) {
+	ses.lock.Lock()
+	defer ses.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	r.closed = true
+	close(r.quit)
+	if r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+func (ses *session) getReq(idx uint16, tag uint16) *mreq {
+	ses.lock.Lock()
+	defer ses.lock.Unlock()
+
+	return ses.reqs[reqKey(idx, tag)]
+}
+
+func (ses *session) removeReq(idx uint16, tag uint16) *mreq {
+	ses.lock.Lock()
+	defer ses.lock.Unlock()
+
+	k := reqKey(idx, tag)
+	r := ses.reqs[k]
+	delete(ses.reqs, k)
+
+	return r
+}
+
+// parseAddress address bytes is domain or raw ip, AddressTypeDefault
+// carries no hint which, see isHostname
+func parseAddress(m *codec.ReqCreated) string {
+	var host string
+	if (len(m.Address) == net.IPv4len || len(m.Address) == net.IPv6len) && !isHostname(m.Address) {
+		host = net.IP(m.Address).String()
+	} else {
+		host = string(m.Address)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(m.Port)))
+}
+
+// isHostname 4 or 16 bytes are a domain only if they are a dotted
+// name whose last label is letters, like "a.io", raw ip bytes like
+// 100.101.102.103 ("defg") read as a name but have no such label,
+// the few ips spelling such a name, 97.46.105.111 is "a.io", are
+// dialed as the name
+func isHostname(b []byte) bool {
+	dot := bytes.LastIndexByte(b, '.')
+	if dot <= 0 || dot == len(b)-1 {
+		return false
+	}
+
+	for i, c := range b {
+		letter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if i > dot && !letter {
+			return false
+		}
+		if !letter && (c < '0' || c > '9') && c != '-' && c != '.' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ses *session) handleCreated(m *codec.ReqCreated) {
+	ses.owner.lock.Lock()
+	ses.owner.created++
+	ses.owner.lock.Unlock()
+
+	r := &mreq{
+		idx:  m.Idx,
+		tag:  m.Tag,
+		up:   make(chan []byte, 256),
+		quit: make(chan struct{}),
+	}
+
+	ses.lock.Lock()
+	ses.reqs[reqKey(r.idx, r.tag)] = r
+	ses.lock.Unlock()
+
+	go ses.run(r, parseAddress(m))
+}
+
+// run dial to target, then write client data to target
+func (ses *session) run(r *mreq, address string) {
+	c, err := ses.owner.dial("tcp", address)
+	if err != nil {
+		if ses.removeReq(r.idx, r.tag) != nil {
+			ses.closeReq(r)
+			ses.sendCmd(codec.CmdReqServerClosed, r.idx, r.tag, 0)
+		}
+		return
+	}
+
+	ses.lock.Lock()
+	if r.closed {
+		ses.lock.Unlock()
+		c.Close()
+		return
+	}
+	r.conn = c
+	ses.lock.Unlock()
+
+	go ses.proxy(r)
+
+	for {
+		select {
+		case data, ok := <-r.up:
+			if !ok {
+				if cw, ok := c.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+
+				ses.tryClose(r)
+				return
+			}
+
+			if _, err := c.Write(data); err != nil {
+				return
+			}
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// proxy read target, send data frames with faults applied
+func (ses *session) proxy(r *mreq) {
+	var seq uint32
+	size := 4096
+	if max := ses.maxFrame - codec.HeaderSize - 4; max < size {
+		size = max
+	}
+	buf := make([]byte, size)
+	for {
+		n, err := r.conn.Read(buf)
+		if n > 0 {
+			frame := codec.NewServerData(r.idx, r.tag, seq, buf[:n]).Encode()
+			seq++
+
+			ses.sendData(r, frame)
+		}
+
+		if err != nil {
+			ses.flush(r)
+
+			if ses.getReq(r.idx, r.tag) == nil {
+				// closed by client
+				return
+			}
+
+			if err == io.EOF {
+				ses.sendCmd(codec.CmdReqServerFinished, r.idx, r.tag, seq)
+
+				ses.lock.Lock()
+				r.lastSeqNo = seq
+				r.serverFinished = true
+				ses.lock.Unlock()
+				ses.tryClose(r)
+			} else {
+				ses.removeReq(r.idx, r.tag)
+				ses.closeReq(r)
+				ses.sendCmd(codec.CmdReqServerClosed, r.idx, r.tag, seq)
+			}
+
+			return
+		}
+	}
+}
+
+// tryClose both side finished, close request
+func (ses *session) tryClose(r *mreq) {
+	ses.lock.Lock()
+	done := r.serverFinished && r.clientFinished
+	ses.lock.Unlock()
+
+	if !done {
+		return
+	}
+
+	if ses.removeReq(r.idx, r.tag) == nil {
+		return
+	}
+
+	ses.closeReq(r)
+	ses.sendCmd(codec.CmdReqServerClosed, r.idx, r.tag, r.lastSeqNo)
+}
+
+func (ses *session) sendData(r *mreq, frame []byte) {
+	f := ses.owner.getFaults()
+	if ses.owner.shouldDrop(f.DropRate) {
+		return
+	}
+
+	if f.ReorderWindow < 2 {
+		ses.write(frame)
+		return
+	}
+
+	r.pendingLock.Lock()
+	r.pending = append(r.pending, frame)
+	full := len(r.pending) >= f.ReorderWindow
+	if !full && r.pendingTimer == nil {
+		// target may stay quiet, don't hold a partial window forever
+		r.pendingTimer = time.AfterFunc(reorderFlushDelay, func() {
+			ses.flush(r)
+		})
+	}
+	r.pendingLock.Unlock()
+
+	if full {
+		ses.flush(r)
+	}
+}
+
+func (ses *session) flush(r *mreq) {
+	r.pendingLock.Lock()
+	frames := r.pending
+	r.pending = nil
+	if r.pendingTimer != nil {
+		r.pendingTimer.Stop()
+		r.pendingTimer = nil
+	}
+	r.pendingLock.Unlock()
+
+	if len(frames) == 0 {
+		return
+	}
+
+	ses.owner.shuffle(frames)
+	for _, frame := range frames {
+		ses.write(frame)
+	}
+}
+
+func (ses *session) sendCmd(cmd byte, idx uint16, tag uint16, lastSeqNo uint32) {
+	ses.write(codec.NewServerEnd(cmd, idx, tag, lastSeqNo).Encode())
+}
+
+func (ses *session) write(msg []byte) {
+	f := ses.owner.getFaults()
+	if f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+
+	ses.writeLock.Lock()
+	defer ses.writeLock.Unlock()
+
+	ses.conn.WriteMessage(websocket.BinaryMessage, msg)
+	ses.sent++
+
+	if f.CloseAfter > 0 && ses.sent >= f.CloseAfter {
+		ses.conn.Close()
+	}
+}
@@ -0,0 +1,48 @@
+package policy
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter token bucket, bytes are taken without blocking, the caller
+// waits the returned delay, so the bucket can go negative
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter rate bytes per second, burst one second of rate
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Take take n bytes, return the delay until the bucket is
+// non-negative again
+func (l *Limiter) Take(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
@@ -0,0 +1,71 @@
+package policy
+
+import (
+	"fmt"
+	"lproxyc/guard"
+	"lproxyc/socks5"
+	"net"
+	"strings"
+)
+
+// destList destination rules: "*", ip, cidr, or domain which
+// also matches its subdomains
+type destList struct {
+	all     bool
+	nets    []*net.IPNet
+	domains []string
+}
+
+func parseDestList(rules []string) (*destList, error) {
+	l := &destList{}
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		switch {
+		case rule == "":
+			continue
+		case rule == "*":
+			l.all = true
+		case strings.Contains(rule, "/") || net.ParseIP(rule) != nil:
+			n, err := guard.ParseCIDR(rule)
+			if err != nil {
+				return nil, fmt.Errorf("invalid destination rule %s: %v", rule, err)
+			}
+			l.nets = append(l.nets, n)
+		default:
+			l.domains = append(l.domains, strings.TrimSuffix(rule, "."))
+		}
+	}
+
+	return l, nil
+}
+
+func (l *destList) empty() bool {
+	return !l.all && len(l.nets) == 0 && len(l.domains) == 0
+}
+
+// match domain rules match FQDN, ip rules match IP, a fake ip
+// destination has both
+func (l *destList) match(dest *socks5.AddrSpec) bool {
+	if l.all {
+		return true
+	}
+
+	if dest.IP != nil {
+		for _, n := range l.nets {
+			if n.Contains(dest.IP) {
+				return true
+			}
+		}
+	}
+
+	if dest.FQDN != "" {
+		name := strings.TrimSuffix(strings.ToLower(dest.FQDN), ".")
+		for _, d := range l.domains {
+			if name == d || strings.HasSuffix(name, "."+d) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
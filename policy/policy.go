@@ -0,0 +1,405 @@
+// Package policy per-user limits: concurrent requests, bandwidth,
+// monthly byte quota and allowed destinations
+package policy
+
+import (
+	"context"
+	"fmt"
+	"lproxyc/metrics"
+	"lproxyc/socks5"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	saveInterval = 30 * time.Second
+
+	// maxUsers users tracked, idle users not in Config.Users are
+	// evicted with their usage when more are seen
+	maxUsers = 4096
+)
+
+var (
+	metricUserBytesUp = metrics.Default.NewCounterVec("lproxyc_user_bytes_up_total",
+		"Bytes sent to tunnel per user.", "user")
+	metricUserBytesDown = metrics.Default.NewCounterVec("lproxyc_user_bytes_down_total",
+		"Bytes received from tunnel per user.", "user")
+	metricUserRequests = metrics.Default.NewGaugeVec("lproxyc_user_requests_active",
+		"Requests in progress per user.", "user")
+)
+
+// Policy limits of one user, zero means unlimited
+type Policy struct {
+	// MaxRequests concurrent requests, share of request slots
+	MaxRequests int `json:"max_requests"`
+	// UpRateKB upload KB per second
+	UpRateKB int64 `json:"up_rate_kb"`
+	// DownRateKB download KB per second
+	DownRateKB int64 `json:"down_rate_kb"`
+	// MonthlyQuotaMB upload plus download MB per calendar month
+	MonthlyQuotaMB int64 `json:"monthly_quota_mb"`
+	// Allow if not empty, only these destinations are allowed
+	Allow []string `json:"allow"`
+	// Deny destinations denied, checked before Allow
+	Deny []string `json:"deny"`
+}
+
+// Config policy settings in config file
+type Config struct {
+	// UsageFile file to persist monthly usage
+	UsageFile string `json:"usage_file"`
+	// Default policy of users not listed, also of auth-less requests
+	Default *Policy `json:"default"`
+	// Users policy by socks5 username
+	Users map[string]*Policy `json:"users"`
+}
+
+// Build build manager, nil if no policy configured
+func (c *Config) Build() (*Manager, error) {
+	if c.Default == nil && len(c.Users) == 0 {
+		return nil, nil
+	}
+
+	return New(c)
+}
+
+// compiled parsed policy
+type compiled struct {
+	*Policy
+	allow *destList
+	deny  *destList
+}
+
+func compile(p *Policy) (*compiled, error) {
+	if p == nil {
+		p = &Policy{}
+	}
+
+	allow, err := parseDestList(p.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := parseDestList(p.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compiled{Policy: p, allow: allow, deny: deny}, nil
+}
+
+// Manager track users and enforce their policies
+type Manager struct {
+	path     string
+	def      *compiled
+	policies map[string]*compiled
+
+	lock  sync.Mutex
+	month string
+	users map[string]*User
+}
+
+// User state of one user
+type User struct {
+	name   string
+	policy *compiled
+
+	up   *Limiter
+	down *Limiter
+
+	lock   sync.Mutex
+	active int
+
+	// usage of current month
+	bytesUp   int64
+	bytesDown int64
+
+	metricUp     *metrics.Value
+	metricDown   *metrics.Value
+	metricActive *metrics.Value
+}
+
+// Usage usage of one user
+type Usage struct {
+	User           string `json:"user"`
+	Month          string `json:"month"`
+	Active         int    `json:"active"`
+	MaxRequests    int    `json:"max_requests"`
+	BytesUp        int64  `json:"bytes_up"`
+	BytesDown      int64  `json:"bytes_down"`
+	MonthlyQuotaMB int64  `json:"monthly_quota_mb"`
+}
+
+// New new manager, load usage file if exist
+func New(cfg *Config) (*Manager, error) {
+	def, err := compile(cfg.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		path:     cfg.UsageFile,
+		def:      def,
+		policies: make(map[string]*compiled, len(cfg.Users)),
+		month:    currentMonth(),
+		users:    make(map[string]*User),
+	}
+
+	for name, p := range cfg.Users {
+		c, err := compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", name, err)
+		}
+		m.policies[name] = c
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func currentMonth() string {
+	return time.Now().Format("2006-01")
+}
+
+// user get user state, create if not exist
+func (m *Manager) user(name string) *User {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	u, ok := m.users[name]
+	if ok {
+		return u
+	}
+
+	p, ok := m.policies[name]
+	if !ok {
+		p = m.def
+	}
+
+	u = &User{
+		name:         name,
+		policy:       p,
+		metricUp:     metricUserBytesUp.With(name),
+		metricDown:   metricUserBytesDown.With(name),
+		metricActive: metricUserRequests.With(name),
+	}
+
+	if p.UpRateKB > 0 {
+		u.up = NewLimiter(p.UpRateKB * 1024)
+	}
+
+	if p.DownRateKB > 0 {
+		u.down = NewLimiter(p.DownRateKB * 1024)
+	}
+
+	if len(m.users) >= maxUsers {
+		m.evict()
+	}
+	m.users[name] = u
+
+	return u
+}
+
+// evict drop idle users not configured, lock held
+func (m *Manager) evict() {
+	for name, u := range m.users {
+		if _, ok := m.policies[name]; ok {
+			continue
+		}
+
+		u.lock.Lock()
+		idle := u.active == 0
+		u.lock.Unlock()
+
+		if idle {
+			delete(m.users, name)
+			metricUserBytesUp.Delete(name)
+			metricUserBytesDown.Delete(name)
+			metricUserRequests.Delete(name)
+		}
+	}
+
+	log.Printf("policy users over %d, evicted idle ones, %d left", maxUsers, len(m.users))
+}
+
+// Check return error if user can't create a request to dest
+func (m *Manager) Check(name string, dest *socks5.AddrSpec) error {
+	return m.user(name).check(dest)
+}
+
+// Allow implement socks5.RuleSet
+func (m *Manager) Allow(ctx context.Context, req *socks5.SocksRequest) (context.Context, bool) {
+	if err := m.Check(req.Username(), req.DestAddr); err != nil {
+		log.Printf("policy reject user %q: %v", req.Username(), err)
+		return ctx, false
+	}
+
+	return ctx, true
+}
+
+// Acquire count a new request of user, call Release on User
+// when the request finished
+func (m *Manager) Acquire(name string, dest *socks5.AddrSpec) (*User, error) {
+	u := m.user(name)
+	if err := u.check(dest); err != nil {
+		return nil, err
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if max := u.policy.MaxRequests; max > 0 && u.active >= max {
+		return nil, fmt.Errorf("too many requests, max %d", max)
+	}
+
+	u.active++
+	u.metricActive.Inc()
+
+	return u, nil
+}
+
+func (u *User) check(dest *socks5.AddrSpec) error {
+	p := u.policy
+	if p.deny.match(dest) {
+		return fmt.Errorf("destination %s denied", dest)
+	}
+
+	if !p.allow.empty() && !p.allow.match(dest) {
+		return fmt.Errorf("destination %s not allowed", dest)
+	}
+
+	if u.Exceeded() {
+		return fmt.Errorf("monthly quota exceeded")
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if max := p.MaxRequests; max > 0 && u.active >= max {
+		return fmt.Errorf("too many requests, max %d", max)
+	}
+
+	return nil
+}
+
+// Release request of user finished
+func (u *User) Release() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.active--
+	u.metricActive.Dec()
+}
+
+// Exceeded monthly quota used up
+func (u *User) Exceeded() bool {
+	quota := u.policy.MonthlyQuotaMB * 1024 * 1024
+	if quota <= 0 {
+		return false
+	}
+
+	return atomic.LoadInt64(&u.bytesUp)+atomic.LoadInt64(&u.bytesDown) >= quota
+}
+
+// AddUp count upload bytes, return how long to wait before
+// sending more
+func (u *User) AddUp(n int) time.Duration {
+	atomic.AddInt64(&u.bytesUp, int64(n))
+	u.metricUp.Add(float64(n))
+
+	if u.up == nil {
+		return 0
+	}
+
+	return u.up.Take(n)
+}
+
+// AddDown count download bytes
+func (u *User) AddDown(n int) {
+	atomic.AddInt64(&u.bytesDown, int64(n))
+	u.metricDown.Add(float64(n))
+
+	if u.down != nil {
+		u.down.Take(n)
+	}
+}
+
+// DownDelay how long to hold the next quota report, server
+// doesn't send more than the reported quota, so holding reports
+// limits download rate without blocking the tunnel
+func (u *User) DownDelay() time.Duration {
+	if u.down == nil {
+		return 0
+	}
+
+	return u.down.Take(0)
+}
+
+// Usage usage of all users seen
+func (m *Manager) Usage() []Usage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	usages := make([]Usage, 0, len(m.users))
+	for name, u := range m.users {
+		u.lock.Lock()
+		active := u.active
+		u.lock.Unlock()
+
+		usages = append(usages, Usage{
+			User:           name,
+			Month:          m.month,
+			Active:         active,
+			MaxRequests:    u.policy.MaxRequests,
+			BytesUp:        atomic.LoadInt64(&u.bytesUp),
+			BytesDown:      atomic.LoadInt64(&u.bytesDown),
+			MonthlyQuotaMB: u.policy.MonthlyQuotaMB,
+		})
+	}
+
+	return usages
+}
+
+// Run save usage periodically, reset usage when a new month
+// begins, return when ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.rollover()
+		if err := m.Save(); err != nil {
+			log.Println("save usage failed:", err)
+		}
+	}
+}
+
+func (m *Manager) rollover() {
+	month := currentMonth()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if month == m.month {
+		return
+	}
+
+	log.Printf("new month %s, reset usage", month)
+	m.month = month
+	for _, u := range m.users {
+		atomic.StoreInt64(&u.bytesUp, 0)
+		atomic.StoreInt64(&u.bytesDown, 0)
+	}
+}
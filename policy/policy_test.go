@@ -0,0 +1,265 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lproxyc/socks5"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T, cfg *Config) *Manager {
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestMaxRequests(t *testing.T) {
+	m := newTestManager(t, &Config{
+		Users: map[string]*Policy{"alice": {MaxRequests: 2}},
+	})
+
+	dest := &socks5.AddrSpec{FQDN: "example.com", Port: 80}
+
+	var users []*User
+	for i := 0; i < 2; i++ {
+		u, err := m.Acquire("alice", dest)
+		if err != nil {
+			t.Fatalf("acquire %d: %v", i, err)
+		}
+		users = append(users, u)
+	}
+
+	if _, err := m.Acquire("alice", dest); err == nil {
+		t.Fatal("acquire over max should fail")
+	}
+	if err := m.Check("alice", dest); err == nil {
+		t.Fatal("check over max should fail")
+	}
+
+	// other users have the unlimited default
+	for i := 0; i < 5; i++ {
+		if _, err := m.Acquire("bob", dest); err != nil {
+			t.Fatalf("bob acquire %d: %v", i, err)
+		}
+	}
+
+	users[0].Release()
+	if _, err := m.Acquire("alice", dest); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(1000)
+
+	if d := l.Take(1000); d != 0 {
+		t.Fatalf("burst take delay %v, want 0", d)
+	}
+
+	d := l.Take(500)
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("take over burst delay %v, want about 500ms", d)
+	}
+
+	// bucket is negative, nothing taken still waits
+	if d := l.Take(0); d <= 0 {
+		t.Fatalf("take 0 on negative bucket delay %v, want > 0", d)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if d := l.Take(0); d != 0 {
+		t.Fatalf("take 0 after refill delay %v, want 0", d)
+	}
+}
+
+func TestMonthlyQuota(t *testing.T) {
+	m := newTestManager(t, &Config{
+		Default: &Policy{MonthlyQuotaMB: 1},
+	})
+
+	dest := &socks5.AddrSpec{FQDN: "example.com", Port: 80}
+
+	u, err := m.Acquire("alice", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.AddUp(512 * 1024)
+	u.AddDown(512*1024 - 1)
+	if u.Exceeded() {
+		t.Fatal("quota exceeded before used up")
+	}
+
+	u.AddDown(1)
+	if !u.Exceeded() {
+		t.Fatal("quota not exceeded after used up")
+	}
+	if _, err := m.Acquire("alice", dest); err == nil {
+		t.Fatal("acquire over quota should fail")
+	}
+
+	// same month keeps usage
+	m.rollover()
+	if !u.Exceeded() {
+		t.Fatal("rollover in same month reset usage")
+	}
+
+	m.lock.Lock()
+	m.month = "2000-01"
+	m.lock.Unlock()
+
+	m.rollover()
+	if u.Exceeded() {
+		t.Fatal("quota still exceeded after new month")
+	}
+	if m.month != currentMonth() {
+		t.Fatalf("month %s after rollover, want %s", m.month, currentMonth())
+	}
+	if _, err := m.Acquire("alice", dest); err != nil {
+		t.Fatalf("acquire after new month: %v", err)
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "usage.json")
+	cfg := &Config{UsageFile: path, Default: &Policy{}}
+
+	m := newTestManager(t, cfg)
+	m.user("alice").AddUp(100)
+	m.user("alice").AddDown(200)
+	m.user("bob").AddDown(300)
+
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("tmp file left after save: %v", err)
+	}
+
+	m = newTestManager(t, cfg)
+	usages := make(map[string]Usage)
+	for _, u := range m.Usage() {
+		usages[u.User] = u
+	}
+
+	if u := usages["alice"]; u.BytesUp != 100 || u.BytesDown != 200 {
+		t.Fatalf("alice loaded %+v", u)
+	}
+	if u := usages["bob"]; u.BytesUp != 0 || u.BytesDown != 300 {
+		t.Fatalf("bob loaded %+v", u)
+	}
+
+	// usage of past month is dropped
+	data, err := json.Marshal(&usageFile{
+		Month: "2000-01",
+		Users: map[string]*userUsage{"alice": {Up: 1, Down: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m = newTestManager(t, cfg)
+	if usages := m.Usage(); len(usages) != 0 {
+		t.Fatalf("past month usage loaded: %+v", usages)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(cfg); err == nil {
+		t.Fatal("corrupt usage file should fail")
+	}
+}
+
+func TestAllowDeny(t *testing.T) {
+	m := newTestManager(t, &Config{
+		Default: &Policy{
+			Allow: []string{"example.com", "10.0.0.0/8", "192.168.1.1"},
+			Deny:  []string{"bad.example.com", "10.0.0.5"},
+		},
+		Users: map[string]*Policy{
+			"root": {Allow: []string{"*"}, Deny: []string{"Blocked.ORG."}},
+		},
+	})
+
+	tests := []struct {
+		user string
+		dest *socks5.AddrSpec
+		ok   bool
+	}{
+		{"", &socks5.AddrSpec{FQDN: "example.com"}, true},
+		{"", &socks5.AddrSpec{FQDN: "WWW.Example.com."}, true},
+		{"", &socks5.AddrSpec{FQDN: "notexample.com"}, false},
+		{"", &socks5.AddrSpec{FQDN: "bad.example.com"}, false},
+		{"", &socks5.AddrSpec{FQDN: "x.bad.example.com"}, false},
+		{"", &socks5.AddrSpec{IP: net.ParseIP("10.1.2.3")}, true},
+		{"", &socks5.AddrSpec{IP: net.ParseIP("10.0.0.5")}, false},
+		{"", &socks5.AddrSpec{IP: net.ParseIP("192.168.1.1")}, true},
+		{"", &socks5.AddrSpec{IP: net.ParseIP("192.168.1.2")}, false},
+		// fake ip destination has both, deny on either wins
+		{"", &socks5.AddrSpec{FQDN: "example.com", IP: net.ParseIP("10.0.0.5")}, false},
+		{"", &socks5.AddrSpec{FQDN: "other.com", IP: net.ParseIP("10.1.2.3")}, true},
+		{"root", &socks5.AddrSpec{FQDN: "other.com"}, true},
+		{"root", &socks5.AddrSpec{FQDN: "a.blocked.org"}, false},
+	}
+
+	for _, tt := range tests {
+		err := m.Check(tt.user, tt.dest)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("user %q dest %s: allowed %v, want %v (%v)", tt.user, tt.dest, ok, tt.ok, err)
+		}
+	}
+
+	if _, err := New(&Config{Default: &Policy{Deny: []string{"10.0.0.0/33"}}}); err == nil {
+		t.Fatal("invalid cidr should fail")
+	}
+}
+
+func TestUserEviction(t *testing.T) {
+	m := newTestManager(t, &Config{
+		Default: &Policy{},
+		Users:   map[string]*Policy{"alice": {}},
+	})
+
+	dest := &socks5.AddrSpec{FQDN: "example.com", Port: 80}
+
+	alice := m.user("alice")
+	busy, err := m.Acquire("busy", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxUsers*2; i++ {
+		if err := m.Check(fmt.Sprintf("user%d", i), dest); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.lock.Lock()
+	n := len(m.users)
+	kept := m.users["alice"] == alice && m.users["busy"] == busy
+	m.lock.Unlock()
+
+	if n > maxUsers {
+		t.Fatalf("%d users tracked, want <= %d", n, maxUsers)
+	}
+	if !kept {
+		t.Fatal("configured or active user evicted")
+	}
+}
@@ -0,0 +1,84 @@
+package policy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// usageFile usage file format
+type usageFile struct {
+	Month string                `json:"month"`
+	Users map[string]*userUsage `json:"users"`
+}
+
+type userUsage struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// load load usage of current month, usage of past month is dropped
+func (m *Manager) load() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	uf := usageFile{}
+	if err := json.Unmarshal(data, &uf); err != nil {
+		return err
+	}
+
+	if uf.Month != m.month {
+		return nil
+	}
+
+	for name, uu := range uf.Users {
+		u := m.user(name)
+		u.bytesUp = uu.Up
+		u.bytesDown = uu.Down
+	}
+
+	return nil
+}
+
+// Save write usage file
+func (m *Manager) Save() error {
+	if m.path == "" {
+		return nil
+	}
+
+	m.lock.Lock()
+	uf := usageFile{
+		Month: m.month,
+		Users: make(map[string]*userUsage, len(m.users)),
+	}
+
+	for name, u := range m.users {
+		uf.Users[name] = &userUsage{
+			Up:   atomic.LoadInt64(&u.bytesUp),
+			Down: atomic.LoadInt64(&u.bytesDown),
+		}
+	}
+	m.lock.Unlock()
+
+	data, err := json.Marshal(&uf)
+	if err != nil {
+		return err
+	}
+
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, m.path)
+}
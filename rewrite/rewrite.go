@@ -0,0 +1,185 @@
+// Package rewrite built-in socks5 address rewriters
+package rewrite
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"lproxyc/socks5"
+	"net"
+	"os"
+	"strings"
+)
+
+// Chain apply rewriters in order, each sees the previous result
+type Chain []socks5.AddressRewriter
+
+// Rewrite implement socks5.AddressRewriter
+func (c Chain) Rewrite(ctx context.Context, req *socks5.SocksRequest) (context.Context, *socks5.AddrSpec) {
+	orig := req.DestAddr
+	for _, r := range c {
+		var dest *socks5.AddrSpec
+		ctx, dest = r.Rewrite(ctx, req)
+		if dest != nil {
+			req.DestAddr = dest
+		}
+	}
+
+	dest := req.DestAddr
+	req.DestAddr = orig
+
+	return ctx, dest
+}
+
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Hosts static host mapping, hosts-file style, a name is mapped
+// to an ip or another name
+type Hosts map[string]string
+
+// LoadHostsFile read hosts file format: ip name1 name2 ...
+func LoadHostsFile(path string, h Hosts) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return ParseHosts(f, h)
+}
+
+// ParseHosts parse hosts file format into h
+func ParseHosts(r io.Reader, h Hosts) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			h[normalize(name)] = fields[0]
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Rewrite implement socks5.AddressRewriter
+func (h Hosts) Rewrite(ctx context.Context, req *socks5.SocksRequest) (context.Context, *socks5.AddrSpec) {
+	dest := req.DestAddr
+	if dest.FQDN == "" {
+		return ctx, nil
+	}
+
+	target, ok := h[normalize(dest.FQDN)]
+	if !ok {
+		return ctx, nil
+	}
+
+	if ip := net.ParseIP(target); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return ctx, &socks5.AddrSpec{IP: ip, Port: dest.Port}
+	}
+
+	return ctx, &socks5.AddrSpec{FQDN: target, Port: dest.Port}
+}
+
+// Ports port remapping
+type Ports map[int]int
+
+// Rewrite implement socks5.AddressRewriter
+func (p Ports) Rewrite(ctx context.Context, req *socks5.SocksRequest) (context.Context, *socks5.AddrSpec) {
+	dest := req.DestAddr
+	port, ok := p[dest.Port]
+	if !ok {
+		return ctx, nil
+	}
+
+	return ctx, &socks5.AddrSpec{FQDN: dest.FQDN, IP: dest.IP, Port: port}
+}
+
+// Aliases domain aliasing, "old.com" -> "new.com" rewrites old.com
+// and its subdomains, a.old.com becomes a.new.com
+type Aliases map[string]string
+
+// Rewrite implement socks5.AddressRewriter
+func (a Aliases) Rewrite(ctx context.Context, req *socks5.SocksRequest) (context.Context, *socks5.AddrSpec) {
+	dest := req.DestAddr
+	if dest.FQDN == "" {
+		return ctx, nil
+	}
+
+	name := normalize(dest.FQDN)
+	// longest suffix wins
+	best := ""
+	for from := range a {
+		if (name == from || strings.HasSuffix(name, "."+from)) && len(from) > len(best) {
+			best = from
+		}
+	}
+
+	if best == "" {
+		return ctx, nil
+	}
+
+	fqdn := strings.TrimSuffix(name, best) + a[best]
+
+	return ctx, &socks5.AddrSpec{FQDN: fqdn, Port: dest.Port}
+}
+
+// Config rewriter settings in config file, rewriters are applied
+// in order: aliases, hosts, ports
+type Config struct {
+	Hosts     map[string]string `json:"hosts"`
+	HostsFile string            `json:"hosts_file"`
+	Ports     map[int]int       `json:"ports"`
+	Aliases   map[string]string `json:"aliases"`
+}
+
+// Build build rewriter chain, nil if nothing configured
+func (c *Config) Build() (socks5.AddressRewriter, error) {
+	var chain Chain
+
+	if len(c.Aliases) > 0 {
+		aliases := make(Aliases, len(c.Aliases))
+		for from, to := range c.Aliases {
+			aliases[normalize(from)] = normalize(to)
+		}
+		chain = append(chain, aliases)
+	}
+
+	hosts := make(Hosts)
+	if c.HostsFile != "" {
+		if err := LoadHostsFile(c.HostsFile, hosts); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, target := range c.Hosts {
+		hosts[normalize(name)] = target
+	}
+
+	if len(hosts) > 0 {
+		chain = append(chain, hosts)
+	}
+
+	if len(c.Ports) > 0 {
+		chain = append(chain, Ports(c.Ports))
+	}
+
+	if len(chain) == 0 {
+		return nil, nil
+	}
+
+	return chain, nil
+}
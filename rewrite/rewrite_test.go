@@ -0,0 +1,220 @@
+package rewrite
+
+import (
+	"context"
+	"io/ioutil"
+	"lproxyc/socks5"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type ctxKey struct{}
+
+// tagRewriter record it ran in ctx, rewrite nothing
+type tagRewriter string
+
+func (t tagRewriter) Rewrite(ctx context.Context, req *socks5.SocksRequest) (context.Context, *socks5.AddrSpec) {
+	seen, _ := ctx.Value(ctxKey{}).(string)
+	return context.WithValue(ctx, ctxKey{}, seen+string(t)), nil
+}
+
+func rewriteDest(t *testing.T, r socks5.AddressRewriter, dest *socks5.AddrSpec) *socks5.AddrSpec {
+	t.Helper()
+
+	req := &socks5.SocksRequest{DestAddr: dest}
+	_, got := r.Rewrite(context.Background(), req)
+	if req.DestAddr != dest {
+		t.Fatal("request destination changed by Rewrite")
+	}
+
+	return got
+}
+
+func TestHosts(t *testing.T) {
+	h := make(Hosts)
+	err := ParseHosts(strings.NewReader(`
+# comment
+10.0.0.1 a.example.com  A2.example.com. # trailing
+::1      six.example.com
+other.example.com cname.example.com
+broken
+`), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fqdn string
+		want string
+	}{
+		{"a.example.com", "10.0.0.1:80"},
+		{"a2.EXAMPLE.com.", "10.0.0.1:80"},
+		{"six.example.com", "[::1]:80"},
+		{"cname.example.com", "other.example.com:80"},
+		{"sub.a.example.com", ""},
+		{"broken", ""},
+	}
+
+	for _, tt := range tests {
+		got := rewriteDest(t, h, &socks5.AddrSpec{FQDN: tt.fqdn, Port: 80})
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("%s rewritten to %s", tt.fqdn, got.Address())
+			}
+			continue
+		}
+
+		if got == nil || got.Address() != tt.want {
+			t.Errorf("%s rewritten to %v, want %s", tt.fqdn, got, tt.want)
+		}
+	}
+
+	if got := rewriteDest(t, h, &socks5.AddrSpec{FQDN: "a.example.com"}); len(got.IP) != net.IPv4len {
+		t.Fatalf("ipv4 target is %d bytes", len(got.IP))
+	}
+
+	// ip destinations have no name to map
+	if got := rewriteDest(t, h, &socks5.AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 80}); got != nil {
+		t.Fatalf("ip rewritten to %s", got.Address())
+	}
+}
+
+func TestPorts(t *testing.T) {
+	p := Ports{80: 8080}
+
+	got := rewriteDest(t, p, &socks5.AddrSpec{FQDN: "example.com", IP: net.ParseIP("10.0.0.1"), Port: 80})
+	if got == nil || got.Port != 8080 || got.FQDN != "example.com" || !got.IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("rewritten to %+v", got)
+	}
+
+	if got := rewriteDest(t, p, &socks5.AddrSpec{FQDN: "example.com", Port: 443}); got != nil {
+		t.Fatalf("unmapped port rewritten to %+v", got)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	a := Aliases{
+		"old.com":     "new.com",
+		"api.old.com": "api.other.net",
+	}
+
+	tests := []struct {
+		fqdn string
+		want string
+	}{
+		{"old.com", "new.com"},
+		{"WWW.Old.com.", "www.new.com"},
+		// longest suffix wins
+		{"api.old.com", "api.other.net"},
+		{"v1.api.old.com", "v1.api.other.net"},
+		{"bold.com", ""},
+		{"old.com.evil", ""},
+	}
+
+	for _, tt := range tests {
+		got := rewriteDest(t, a, &socks5.AddrSpec{FQDN: tt.fqdn, Port: 443})
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("%s aliased to %s", tt.fqdn, got.FQDN)
+			}
+			continue
+		}
+
+		if got == nil || got.FQDN != tt.want || got.Port != 443 {
+			t.Errorf("%s aliased to %+v, want %s", tt.fqdn, got, tt.want)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	c := Chain{
+		tagRewriter("a"),
+		Aliases{"old.com": "new.com"},
+		tagRewriter("b"),
+		Hosts{"www.new.com": "10.0.0.1", "www.old.com": "10.0.0.2"},
+		// dest is an ip now, name rewriters pass it through
+		Aliases{"new.com": "newer.com"},
+		Hosts{"www.new.com": "10.0.0.3"},
+		Ports{443: 8443},
+	}
+
+	dest := &socks5.AddrSpec{FQDN: "www.old.com", Port: 443}
+	req := &socks5.SocksRequest{DestAddr: dest}
+	ctx, got := c.Rewrite(context.Background(), req)
+
+	// each sees the previous result, a nil result keeps it
+	if got == nil || got.Address() != "10.0.0.1:8443" {
+		t.Fatalf("chain rewrote to %v, want 10.0.0.1:8443", got)
+	}
+	if seen := ctx.Value(ctxKey{}); seen != "ab" {
+		t.Fatalf("ctx threaded through %v, want ab", seen)
+	}
+	if req.DestAddr != dest {
+		t.Fatal("request destination not restored")
+	}
+
+	// nothing matched, original destination
+	req = &socks5.SocksRequest{DestAddr: &socks5.AddrSpec{FQDN: "example.com", Port: 80}}
+	if _, got := c.Rewrite(context.Background(), req); got.Address() != "example.com:80" {
+		t.Fatalf("unmatched rewrote to %s", got.Address())
+	}
+}
+
+func TestBuild(t *testing.T) {
+	r, err := (&Config{}).Build()
+	if err != nil || r != nil {
+		t.Fatalf("empty config built %v, %v", r, err)
+	}
+
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := (&Config{HostsFile: filepath.Join(dir, "missing")}).Build(); err == nil {
+		t.Fatal("missing hosts file accepted")
+	}
+
+	// a directory can be opened but not read
+	if _, err := (&Config{HostsFile: dir}).Build(); err == nil {
+		t.Fatal("unreadable hosts file accepted")
+	}
+
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("10.0.0.1 file.example.com inline.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = (&Config{
+		HostsFile: path,
+		// inline hosts override the file
+		Hosts:   map[string]string{"Inline.Example.com": "10.0.0.2"},
+		Aliases: map[string]string{"Alias.COM.": "Example.com"},
+		Ports:   map[int]int{80: 8080},
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fqdn string
+		want string
+	}{
+		{"file.example.com", "10.0.0.1:8080"},
+		{"inline.example.com", "10.0.0.2:8080"},
+		// aliases run before hosts
+		{"inline.alias.com", "10.0.0.2:8080"},
+		{"other.com", "other.com:8080"},
+	}
+
+	for _, tt := range tests {
+		got := rewriteDest(t, r, &socks5.AddrSpec{FQDN: tt.fqdn, Port: 80})
+		if got == nil || got.Address() != tt.want {
+			t.Errorf("%s built rewriter gave %v, want %s", tt.fqdn, got, tt.want)
+		}
+	}
+}
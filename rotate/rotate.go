@@ -0,0 +1,192 @@
+// Package rotate file writer rotated by size and time
+package rotate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// backupTimeFormat fixed width, backups sort by name
+	backupTimeFormat = "20060102-150405.000000000"
+
+	// createdSuffix side file keeping creation time of the file,
+	// modify time moves with every write
+	createdSuffix = ".created"
+)
+
+// Writer write to file, rotate when file size exceeds MaxSize or
+// file is older than Interval, the rotated file is renamed with
+// a timestamp suffix, and at most MaxBackups rotated files are kept
+type Writer struct {
+	// Path file path
+	Path string
+	// MaxSize max file size in bytes, 0 disable size rotation
+	MaxSize int64
+	// Interval max file age, 0 disable time rotation
+	Interval time.Duration
+	// MaxBackups max rotated files kept, 0 keep all
+	MaxBackups int
+
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	openTime time.Time
+}
+
+// Write implement io.Writer
+func (w *Writer) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+
+	return n, err
+}
+
+// Close close file
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
+
+func (w *Writer) shouldRotate(n int64) bool {
+	if w.size == 0 {
+		return false
+	}
+
+	if w.MaxSize > 0 && w.size+n > w.MaxSize {
+		return true
+	}
+
+	if w.Interval > 0 && time.Since(w.openTime) >= w.Interval {
+		return true
+	}
+
+	return false
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = info.Size()
+	w.openTime = w.created(w.size == 0)
+
+	return nil
+}
+
+// created creation time of the file, an existing file continues with
+// its stored time, a new file stores now
+func (w *Writer) created(fresh bool) time.Time {
+	path := w.Path + createdSuffix
+	if !fresh {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+			if err == nil {
+				return t
+			}
+		}
+	}
+
+	now := time.Now()
+	ioutil.WriteFile(path, []byte(now.Format(time.RFC3339Nano)), 0644)
+
+	return now
+}
+
+func (w *Writer) rotate() error {
+	w.file.Close()
+	w.file = nil
+
+	// never overwrite a backup, even with a coarse clock
+	t := time.Now()
+	backup := fmt.Sprintf("%s.%s", w.Path, t.Format(backupTimeFormat))
+	for {
+		if _, err := os.Lstat(backup); os.IsNotExist(err) {
+			break
+		}
+
+		t = t.Add(time.Nanosecond)
+		backup = fmt.Sprintf("%s.%s", w.Path, t.Format(backupTimeFormat))
+	}
+
+	if err := os.Rename(w.Path, backup); err != nil {
+		return err
+	}
+
+	w.removeOldBackups()
+
+	return w.open()
+}
+
+func (w *Writer) removeOldBackups() {
+	if w.MaxBackups <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(w.Path + ".*")
+	if err != nil {
+		return
+	}
+
+	backups := matches[:0]
+	for _, m := range matches {
+		suffix := strings.TrimPrefix(m, w.Path+".")
+		if isBackupTime(suffix) {
+			backups = append(backups, m)
+		}
+	}
+
+	if len(backups) <= w.MaxBackups {
+		return
+	}
+
+	// timestamp suffix sorts by time
+	sort.Strings(backups)
+	for _, b := range backups[:len(backups)-w.MaxBackups] {
+		os.Remove(b)
+	}
+}
+
+func isBackupTime(suffix string) bool {
+	_, err := time.Parse(backupTimeFormat, suffix)
+	return err == nil
+}
@@ -0,0 +1,128 @@
+package rotate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "access.log"), func() { os.RemoveAll(dir) }
+}
+
+// backups rotated files, oldest first
+func backups(t *testing.T, path string) []string {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bs []string
+	for _, m := range matches {
+		if isBackupTime(strings.TrimPrefix(m, path+".")) {
+			bs = append(bs, m)
+		}
+	}
+	sort.Strings(bs)
+
+	return bs
+}
+
+func TestRotateBySizeKeepsAll(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	// every write rotates, all within the same second
+	w := &Writer{Path: path, MaxSize: 4}
+	defer w.Close()
+
+	lines := []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"}
+	for _, l := range lines {
+		if _, err := w.Write([]byte(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bs := backups(t, path)
+	if len(bs) != len(lines)-1 {
+		t.Fatalf("backups:%v, want %d", bs, len(lines)-1)
+	}
+
+	for i, b := range bs {
+		data, err := ioutil.ReadFile(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != lines[i] {
+			t.Fatalf("backup %s:%q, want %q", b, data, lines[i])
+		}
+	}
+}
+
+func TestMaxBackups(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	w := &Writer{Path: path, MaxSize: 4, MaxBackups: 2}
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bs := backups(t, path)
+	if len(bs) != 2 {
+		t.Fatalf("backups:%v, want 2", bs)
+	}
+}
+
+func TestRotateByCreationTime(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	interval := 300 * time.Millisecond
+
+	w := &Writer{Path: path, Interval: interval}
+	w.Write([]byte("first"))
+	time.Sleep(interval / 2)
+	// modify time moves, creation time doesn't
+	w.Write([]byte("second"))
+	w.Close()
+
+	if len(backups(t, path)) != 0 {
+		t.Fatal("rotated before interval")
+	}
+
+	time.Sleep(interval/2 + 50*time.Millisecond)
+
+	// reopened file is older than interval since created
+	w = &Writer{Path: path, Interval: interval}
+	defer w.Close()
+	w.Write([]byte("third"))
+
+	bs := backups(t, path)
+	if len(bs) != 1 {
+		t.Fatalf("backups:%v, want 1", bs)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "third" {
+		t.Fatalf("current:%q, want %q", data, "third")
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// accessLogger one record per finished request, nil if disabled
+	accessLogger *logrus.Logger
+)
+
+// SetAccessLog enable access log, records are written to w in json
+func SetAccessLog(w io.Writer) {
+	l := logrus.New()
+	l.Out = w
+	l.Formatter = &logrus.JSONFormatter{}
+	l.Level = logrus.InfoLevel
+
+	accessLogger = l
+}
+
+// accessFields access log record of r, nil if disabled, lock held
+func (r *Request) accessFields(reason string) logrus.Fields {
+	if accessLogger == nil || r.sreq == nil {
+		return nil
+	}
+
+	fields := logrus.Fields{
+		"client":     r.sreq.Conn.RemoteAddr().String(),
+		"dest":       r.sreq.DestAddr.Address(),
+		"account":    r.owner.metrics.label,
+		"bytes_up":   atomic.LoadUint64(&r.bytesUp),
+		"bytes_down": atomic.LoadUint64(&r.bytesDown),
+		"duration":   time.Since(r.startTime).Seconds(),
+		"reason":     reason,
+	}
+
+	if r.sreq.DestAddr.FQDN != "" {
+		fields["dest_fqdn"] = r.sreq.DestAddr.FQDN
+	}
+
+	if r.sreq.DestAddr.IP != nil {
+		fields["dest_ip"] = r.sreq.DestAddr.IP.String()
+	}
+
+	if r.tunnel != nil {
+		fields["tunnel"] = r.tunnel.id
+	}
+
+	if user := r.sreq.Username(); user != "" {
+		fields["user"] = user
+	}
+
+	return fields
+}
+
+// logAccess write record of a freed request, outside of the lock
+func logAccess(fields logrus.Fields) {
+	if accessLogger == nil || fields == nil {
+		return
+	}
+
+	accessLogger.WithFields(fields).Info("request finished")
+}
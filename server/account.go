@@ -1,49 +1,156 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"lproxyc/fakeip"
+	"lproxyc/policy"
 	"lproxyc/socks5"
+	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
 // Account account
 type Account struct {
-	uuid    string
-	url     string
+	name string
+	uuid string
+	url  string
+
+	// lock guards tunnels, nextTunnelIdx, closed, reqMap and state
+	// flags of tunnels, and binding of request slots to tunnels, the
+	// reqq shares it
+	lock    sync.Mutex
 	tunnels []*Tunnel
 
+	// endpoints server urls raced on dial, url is the first
+	endpoints []*endpoint
+
 	reqq *Reqq
 
 	nextTunnelIdx int
+
+	metrics *accountMetrics
+
+	// closed shutting down, tunnels are not rebuilt
+	closed bool
+
+	fakeIP *fakeip.Pool
+
+	policy *policy.Manager
+
+	// idleTimeout close requests without data for it, 0 to disable
+	idleTimeout time.Duration
+	// lingerTimeout close half closed requests without data for it,
+	// 0 to disable
+	lingerTimeout time.Duration
+
+	// chunkSize max bytes read per data frame, adaptiveChunk grows
+	// up to it for bulk transfers
+	chunkSize     int
+	adaptiveChunk bool
+	// quotaReport packets received per quota report
+	quotaReport int
+
+	transport transportOptions
+
+	// pingInterval ping every interval, a tunnel without inbound
+	// frames for pingInterval+pingTimeout is dead, writes time out
+	// after pingTimeout
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+
+	// scale tunnel count, slots of tunnels are max long, running
+	// and retiring are guarded by slotLock
+	scale        tunnelScale
+	slotLock     sync.Mutex
+	running      []bool
+	retiring     []bool
+	surplusSince time.Time
+
+	runCtx context.Context
+	runWG  *sync.WaitGroup
 }
 
-func newAccount(reqCap int, uuid string, url string, tunnelCount int) *Account {
+func newAccount(name string, reqInit int, reqCap int, uuid string, urls []string,
+	tunnelMin int, tunnelMax int) *Account {
+	if tunnelMax < tunnelMin {
+		tunnelMax = tunnelMin
+	}
+
 	a := &Account{
-		uuid:    uuid,
-		url:     url,
-		tunnels: make([]*Tunnel, tunnelCount),
+		name:     name,
+		uuid:     uuid,
+		url:      urls[0],
+		tunnels:  make([]*Tunnel, tunnelMax),
+		running:  make([]bool, tunnelMax),
+		retiring: make([]bool, tunnelMax),
+		metrics:  newAccountMetrics(name),
+
+		endpoints: newEndpoints(urls),
+
+		chunkSize:   defaultChunkSize,
+		quotaReport: defaultQuotaReport,
+
+		pingInterval: defaultPingInterval,
+		pingTimeout:  defaultPingTimeout,
+
+		scale: tunnelScale{
+			min:      tunnelMin,
+			max:      tunnelMax,
+			requests: defaultScaleRequests,
+			backlog:  defaultScaleBacklog,
+			cooldown: defaultScaleCooldown,
+		},
 	}
 
-	reqq := newReqq(reqCap, a)
+	reqq := newReqq(reqInit, reqCap, a)
 	a.reqq = reqq
 
 	return a
 }
 
+// deadTimeout time without inbound frames a tunnel is dead after
+func (a *Account) deadTimeout() time.Duration {
+	return a.pingInterval + a.pingTimeout
+}
+
 func (a *Account) keepalive() {
-	for _, t := range a.tunnels {
+	for _, t := range a.activeTunnels() {
 		t.keepalive()
 	}
 }
 
+// activeTunnels snapshot of connected tunnels
+func (a *Account) activeTunnels() []*Tunnel {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ts := make([]*Tunnel, 0, len(a.tunnels))
+	for _, t := range a.tunnels {
+		if t != nil {
+			ts = append(ts, t)
+		}
+	}
+
+	return ts
+}
+
+// isClosed account is shutting down
+func (a *Account) isClosed() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.closed
+}
+
+// getTunnel next tunnel taking new requests round robin, lock held
 func (a *Account) getTunnel() *Tunnel {
 	idx := a.nextTunnelIdx
 	for i := idx; i < len(a.tunnels); i++ {
 		t := a.tunnels[i]
-		if t == nil || t.conn == nil {
+		if t == nil || t.conn == nil || t.draining || t.broken {
 			continue
 		}
 
@@ -53,7 +160,7 @@ func (a *Account) getTunnel() *Tunnel {
 
 	for i := 0; i < idx; i++ {
 		t := a.tunnels[i]
-		if t == nil || t.conn == nil {
+		if t == nil || t.conn == nil || t.draining || t.broken {
 			continue
 		}
 
@@ -66,72 +173,280 @@ func (a *Account) getTunnel() *Tunnel {
 
 // HandleRequest proc socks5 request
 func (a *Account) HandleRequest(req *socks5.SocksRequest) error {
-	// alloc request
-	t := a.getTunnel()
-	if t == nil {
-		log.Println("HandleRequest failed, getTunnel nil")
-		err := fmt.Errorf("no tunnel")
+	run, err := a.Allocate(req)
+	if err != nil {
 		return err
 	}
 
-	r, err := a.reqq.alloc(req, t)
+	run()
 
+	return nil
+}
+
+// Allocate implement socks5.Allocator
+func (a *Account) Allocate(req *socks5.SocksRequest) (func(), error) {
+	return a.allocRequest(req.Context(), req)
+}
+
+// allocRequest alloc request on next tunnel, wait for a free slot
+// if all used, return the function proxying it, errors are
+// *socks5.ReplyError
+func (a *Account) allocRequest(ctx context.Context, req *socks5.SocksRequest) (func(), error) {
+	if _, ok := req.Conn.(localConn); !ok {
+		return nil, &socks5.ReplyError{
+			Code: socks5.ReplyServerFailure,
+			Err:  fmt.Errorf("unsupport conn type %T", req.Conn),
+		}
+	}
+
+	if err := a.rewriteFakeIP(req); err != nil {
+		log.Println("HandleRequest failed:", err)
+		a.metrics.reqFailed(failFakeIP)
+		return nil, &socks5.ReplyError{Code: socks5.ReplyHostUnreachable, Err: err}
+	}
+
+	// requests from DialContext have no AuthContext, not limited
+	var user *policy.User
+	if a.policy != nil && req.AuthContext != nil {
+		u, err := a.policy.Acquire(req.Username(), req.DestAddr)
+		if err != nil {
+			log.Printf("HandleRequest failed, user %q: %v", req.Username(), err)
+			a.metrics.reqFailed(failPolicy)
+			return nil, &socks5.ReplyError{Code: socks5.ReplyRuleFailure, Err: err}
+		}
+		user = u
+	}
+
+	idx, err := a.reqq.reserve(ctx)
 	if err != nil {
 		log.Println("HandleRequest failed, req alloc failed:", err)
+		if err == errReqqTimeout {
+			a.metrics.reqFailed(failReqqWait)
+		} else {
+			a.metrics.reqFailed(failReqqAlloc)
+		}
+		if user != nil {
+			user.Release()
+		}
 
-		return err
+		return nil, &socks5.ReplyError{Code: socks5.ReplyServerFailure, Err: err}
 	}
 
-	r.proxy()
+	r, tag := a.reqq.bind(idx, req, user)
+	if r == nil {
+		log.Println("HandleRequest failed, getTunnel nil")
+		a.metrics.reqFailed(failNoTunnel)
+		a.reqq.unreserve(idx)
+		if user != nil {
+			user.Release()
+		}
+		err := fmt.Errorf("no tunnel")
+		return nil, &socks5.ReplyError{Code: socks5.ReplyNetworkUnreachable, Err: err}
+	}
+
+	a.metrics.reqCreated.Inc()
+
+	return func() { r.proxy(tag) }, nil
+}
+
+// rewriteFakeIP replace fake ip destination with the mapped domain
+func (a *Account) rewriteFakeIP(req *socks5.SocksRequest) error {
+	dest := req.DestAddr
+	if a.fakeIP == nil || dest.FQDN != "" || !a.fakeIP.Contains(dest.IP) {
+		return nil
+	}
+
+	name, ok := a.fakeIP.Reverse(dest.IP)
+	if !ok {
+		return fmt.Errorf("unknown fake ip %s", dest.IP)
+	}
+
+	req.DestAddr = &socks5.AddrSpec{FQDN: name, IP: dest.IP, Port: dest.Port}
 
 	return nil
 }
 
-func (a *Account) buildTunnels() {
-	for i := 0; i < len(a.tunnels); i++ {
-		go tunnelRunner(a, i)
+// fakeIPRewriter rewrite fake ip destinations in the socks5 pipeline,
+// so that rules see the domain
+type fakeIPRewriter struct {
+	a *Account
+}
+
+// Rewrite implement socks5.AddressRewriter
+func (f fakeIPRewriter) Rewrite(ctx context.Context, req *socks5.SocksRequest) (context.Context, *socks5.AddrSpec) {
+	if err := f.a.rewriteFakeIP(req); err != nil {
+		// leave it, allocRequest fails it
+		return ctx, nil
 	}
 
-	go tunnelKeepalive(a)
+	return ctx, req.DestAddr
 }
 
-func tunnelRunner(a *Account, idx int) {
-	url := fmt.Sprintf("%s?uuid=%s", a.url, a.uuid)
+func (a *Account) buildTunnels(ctx context.Context, wg *sync.WaitGroup) {
+	a.runCtx = ctx
+	a.runWG = wg
 
-	for {
-		log.Println("websocket dail to:", url)
-		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	a.slotLock.Lock()
+	for i := 0; i < a.scale.min; i++ {
+		a.startRunner(i)
+	}
+	a.slotLock.Unlock()
+
+	if a.scale.max > a.scale.min {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tunnelScaler(ctx, a)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tunnelKeepalive(ctx, a)
+	}()
+
+	if a.idleTimeout > 0 || a.lingerTimeout > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			requestReaper(ctx, a)
+		}()
+	}
+}
+
+// sleepContext return false if ctx is done before d elapsed
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func tunnelRunner(ctx context.Context, a *Account, idx int) {
+	defer a.runnerExit(idx)
+
+	for !a.isClosed() && ctx.Err() == nil && !a.retired(idx) {
+		c, ep, err := a.dialEndpoints(ctx)
 		if err != nil {
-			log.Printf("websocket dial failed:%v, re-build later", err)
-			time.Sleep(10 * time.Second)
+			log.Printf("tunnel dial failed:%v, re-build later", err)
+			a.metrics.reconnects.Inc()
+			sleepContext(ctx, 10*time.Second)
 			continue
 		}
 
 		tunnel := newTunnel(idx, c, a)
+		tunnel.endpoint = ep
+
+		a.lock.Lock()
+		if a.closed || ctx.Err() != nil {
+			// shutdown while dialing
+			a.lock.Unlock()
+			c.Close()
+			break
+		}
 		a.tunnels[idx] = tunnel
+		a.lock.Unlock()
+
+		a.metrics.tunnelsUp.Inc()
+		a.metrics.tunnelsDown.Dec()
 
-		{
-			defer func() {
-				c.Close()
-				a.tunnels[idx] = nil
-			}()
+		tunnel.serve()
+		c.Close()
 
-			tunnel.serve()
+		a.lock.Lock()
+		a.tunnels[idx] = nil
+		a.lock.Unlock()
+
+		a.metrics.tunnelsUp.Dec()
+		a.metrics.tunnelsDown.Inc()
+
+		if a.isClosed() || ctx.Err() != nil || a.retired(idx) {
+			break
+		}
+
+		a.metrics.reconnects.Inc()
+		if tunnel.reconnecting() {
+			log.Println("tunnel reconnect by request")
+			continue
 		}
 
 		log.Println("tunnel break, re-build later")
-		time.Sleep(15 * time.Second)
+		sleepContext(ctx, 15*time.Second)
 	}
+
+	log.Printf("tunnel %d closed", idx)
 }
 
-func tunnelKeepalive(a *Account) {
-	for {
-		time.Sleep(time.Second * 30)
+// tunnelKeepalive ping tunnels until ctx is done, also while closing,
+// so tunnels of requests finishing within grace are not found dead
+func tunnelKeepalive(ctx context.Context, a *Account) {
+	for sleepContext(ctx, a.pingInterval) {
+		closing := a.isClosed()
+		for _, t := range a.activeTunnels() {
+			if !closing && t.drained() {
+				log.Printf("tunnel %d drained, reconnect", t.id)
+				t.reconnect()
+				continue
+			}
+
+			t.keepalive()
+		}
+	}
+}
+
+// requestReaper close requests idle or half closed too long, server
+// is told by client closed
+func requestReaper(ctx context.Context, a *Account) {
+	for sleepContext(ctx, time.Second) {
+		now := time.Now()
+		for _, r := range a.reqq.requests() {
+			reason := r.expired(now, a.idleTimeout, a.lingerTimeout)
+			if reason == "" {
+				continue
+			}
 
-		for _, t := range a.tunnels {
-			if t != nil {
-				t.keepalive()
+			t, tag, ok := a.reqq.bound(r)
+			if !ok {
+				continue
 			}
+
+			log.Printf("request %d:%d %s, close", r.idx, tag, reason)
+			t.terminateRequest(r.idx, tag, reason)
 		}
 	}
 }
+
+// shutdown stop rebuilding tunnels, let requests finish within grace,
+// then close remaining requests and tunnels
+func (a *Account) shutdown(grace time.Duration) {
+	a.lock.Lock()
+	a.closed = true
+	for _, t := range a.tunnels {
+		if t != nil {
+			t.draining = true
+		}
+	}
+	a.lock.Unlock()
+
+	deadline := time.Now().Add(grace)
+	for !a.reqq.isFulled() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, r := range a.reqq.requests() {
+		if t, tag, ok := a.reqq.bound(r); ok {
+			log.Printf("shutdown, close request %d:%d", r.idx, tag)
+			t.terminateRequest(r.idx, tag, closeShutdown)
+		}
+	}
+
+	for _, t := range a.activeTunnels() {
+		t.shutdown()
+	}
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"lproxyc/policy"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tunnelInfo admin api tunnel state
+type tunnelInfo struct {
+	ID       int     `json:"id"`
+	State    string  `json:"state"`
+	RTTMs    float64 `json:"rtt_ms"`
+	Requests int     `json:"requests"`
+	WaitPing int     `json:"waitping"`
+}
+
+// endpointInfo admin api endpoint health
+type endpointInfo struct {
+	URL       string  `json:"url"`
+	LatencyMs float64 `json:"latency_ms"`
+	Failures  int     `json:"failures"`
+}
+
+// accountInfo admin api account state
+type accountInfo struct {
+	Name      string         `json:"name"`
+	Account   string         `json:"account"`
+	URL       string         `json:"url"`
+	Endpoints []endpointInfo `json:"endpoints"`
+	Tunnels   []tunnelInfo   `json:"tunnels"`
+	SlotsUsed int            `json:"slots_used"`
+	SlotsFree int            `json:"slots_free"`
+}
+
+// requestInfo admin api request state
+type requestInfo struct {
+	Account           string  `json:"account"`
+	Idx               uint16  `json:"idx"`
+	Tag               uint16  `json:"tag"`
+	Tunnel            int     `json:"tunnel"`
+	Client            string  `json:"client"`
+	Dest              string  `json:"dest"`
+	BytesUp           uint64  `json:"bytes_up"`
+	BytesDown         uint64  `json:"bytes_down"`
+	AgeSec            float64 `json:"age_sec"`
+	ExpectedSeq       uint32  `json:"expected_seq"`
+	LastSeqNo         uint32  `json:"last_seq"`
+	Queued            int     `json:"queued"`
+	PendingClosed     bool    `json:"pending_closed"`
+	PendingHalfClosed bool    `json:"pending_half_closed"`
+}
+
+// state owner.lock held
+func (t *Tunnel) state() string {
+	switch {
+	case t.conn == nil:
+		return "down"
+	case t.draining:
+		return "draining"
+	default:
+		return "up"
+	}
+}
+
+func (a *Account) info() accountInfo {
+	used, free := a.reqq.counts()
+	ai := accountInfo{
+		Name:      a.name,
+		Account:   a.metrics.label,
+		URL:       a.url,
+		SlotsFree: free,
+		SlotsUsed: used,
+	}
+
+	for _, ep := range a.endpoints {
+		ai.Endpoints = append(ai.Endpoints, ep.info())
+	}
+
+	a.lock.Lock()
+	for i, t := range a.tunnels {
+		if t == nil {
+			ai.Tunnels = append(ai.Tunnels, tunnelInfo{ID: i, State: "down"})
+			continue
+		}
+
+		rtt, waitping := t.pingStats()
+		ai.Tunnels = append(ai.Tunnels, tunnelInfo{
+			ID:       t.id,
+			State:    t.state(),
+			RTTMs:    float64(rtt) / float64(time.Millisecond),
+			Requests: len(t.reqMap),
+			WaitPing: waitping,
+		})
+	}
+	a.lock.Unlock()
+
+	// slotLock is taken before the account lock
+	for i := range ai.Tunnels {
+		if ai.Tunnels[i].State == "down" && !a.slotRunning(i) {
+			ai.Tunnels[i].State = "off"
+		}
+	}
+
+	return ai
+}
+
+// info state of request, false if it is free
+func (r *Request) info() (requestInfo, bool) {
+	r.owner.lock.Lock()
+	defer r.owner.lock.Unlock()
+
+	if !r.isUsed {
+		return requestInfo{}, false
+	}
+
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	ri := requestInfo{
+		Account:           r.owner.metrics.label,
+		Idx:               r.idx,
+		Tag:               r.tag,
+		BytesUp:           atomic.LoadUint64(&r.bytesUp),
+		BytesDown:         atomic.LoadUint64(&r.bytesDown),
+		AgeSec:            time.Since(r.startTime).Seconds(),
+		ExpectedSeq:       r.expectedSeq,
+		LastSeqNo:         r.lastSeqNo,
+		Queued:            r.queue.size(),
+		PendingClosed:     r.pendingClosed,
+		PendingHalfClosed: r.pendingHalfClosed,
+	}
+
+	if r.tunnel != nil {
+		ri.Tunnel = r.tunnel.id
+	}
+
+	if r.sreq != nil {
+		ri.Dest = r.sreq.DestAddr.Address()
+		ri.Client = r.sreq.Conn.RemoteAddr().String()
+	}
+
+	return ri, true
+}
+
+// findAccount find account by name, empty if only one account
+func (c *Client) findAccount(name string) *Account {
+	accounts := c.accounts
+	for _, a := range accounts {
+		if a.name == name || (name == "" && len(accounts) == 1) {
+			return a
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) findTunnel(req *http.Request) (*Tunnel, error) {
+	a := c.findAccount(req.FormValue("account"))
+	if a == nil {
+		return nil, fmt.Errorf("account not found")
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	id, err := strconv.Atoi(req.FormValue("id"))
+	if err != nil || id < 0 || id >= len(a.tunnels) || a.tunnels[id] == nil {
+		return nil, fmt.Errorf("tunnel not found")
+	}
+
+	return a.tunnels[id], nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func postOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		h(w, req)
+	}
+}
+
+func (c *Client) adminAccounts(w http.ResponseWriter, req *http.Request) {
+	infos := make([]accountInfo, 0)
+	for _, a := range c.accounts {
+		infos = append(infos, a.info())
+	}
+
+	writeJSON(w, infos)
+}
+
+func (c *Client) adminRequests(w http.ResponseWriter, req *http.Request) {
+	infos := make([]requestInfo, 0)
+	for _, a := range c.accounts {
+		for _, r := range a.reqq.requests() {
+			if ri, ok := r.info(); ok {
+				infos = append(infos, ri)
+			}
+		}
+	}
+
+	writeJSON(w, infos)
+}
+
+func (c *Client) adminKillRequest(w http.ResponseWriter, req *http.Request) {
+	a := c.findAccount(req.FormValue("account"))
+	if a == nil {
+		http.Error(w, "account not found", http.StatusNotFound)
+		return
+	}
+
+	idx, err1 := strconv.ParseUint(req.FormValue("idx"), 10, 16)
+	tag, err2 := strconv.ParseUint(req.FormValue("tag"), 10, 16)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "invalid idx or tag", http.StatusBadRequest)
+		return
+	}
+
+	r, err := a.reqq.get(uint16(idx), uint16(tag))
+	if err != nil {
+		http.Error(w, "request not found", http.StatusNotFound)
+		return
+	}
+
+	t, cur, ok := a.reqq.bound(r)
+	if !ok || cur != uint16(tag) {
+		http.Error(w, "request not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("admin kill request %d:%d", idx, tag)
+	t.terminateRequest(r.idx, cur, closeKilled)
+	writeJSON(w, "ok")
+}
+
+func (c *Client) adminReconnectTunnel(w http.ResponseWriter, req *http.Request) {
+	t, err := c.findTunnel(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("admin reconnect tunnel %d", t.id)
+	t.reconnect()
+	writeJSON(w, "ok")
+}
+
+func (c *Client) adminDrainTunnel(w http.ResponseWriter, req *http.Request) {
+	t, err := c.findTunnel(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("admin drain tunnel %d", t.id)
+	t.drain()
+	writeJSON(w, "ok")
+}
+
+func (c *Client) adminUsers(w http.ResponseWriter, req *http.Request) {
+	if c.cfg.Policy == nil {
+		writeJSON(w, []policy.Usage{})
+		return
+	}
+
+	writeJSON(w, c.cfg.Policy.Usage())
+}
+
+func (c *Client) adminLogLevel(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		level, err := log.ParseLevel(req.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.SetLevel(level)
+	}
+
+	writeJSON(w, log.GetLevel().String())
+}
+
+// adminHandler admin api routes
+func (c *Client) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/accounts", c.adminAccounts)
+	mux.HandleFunc("/requests", c.adminRequests)
+	mux.HandleFunc("/requests/kill", postOnly(c.adminKillRequest))
+	mux.HandleFunc("/tunnels/reconnect", postOnly(c.adminReconnectTunnel))
+	mux.HandleFunc("/tunnels/drain", postOnly(c.adminDrainTunnel))
+	mux.HandleFunc("/users", c.adminUsers)
+	mux.HandleFunc("/loglevel", c.adminLogLevel)
+
+	return mux
+}
+
+// ServeAdmin serve admin api until the client is closed, addr is
+// a loopback tcp address, or a unix socket path with "unix:" prefix,
+// the api controls the client, it is never exposed to the network
+func (c *Client) ServeAdmin(addr string) error {
+	if !IsLoopback(addr) {
+		return fmt.Errorf("admin address %s is not loopback or unix socket", addr)
+	}
+
+	network, addr := listenNetwork(addr)
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		l.Close()
+		return fmt.Errorf("client closed")
+	}
+	c.admins = append(c.admins, l)
+	c.lock.Unlock()
+
+	log.Printf("admin server listen at:%s", addr)
+	err = http.Serve(l, c.adminHandler())
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, al := range c.admins {
+		if al == l {
+			c.admins = append(c.admins[:i], c.admins[i+1:]...)
+			l.Close()
+			return err
+		}
+	}
+
+	// closed by Client.Close
+	return nil
+}
+
+// closeAdmins close admin listeners, lock must be held
+func (c *Client) closeAdmins() {
+	for _, l := range c.admins {
+		l.Close()
+	}
+	c.admins = nil
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"lproxyc/mockserver"
+	"lproxyc/policy"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// startTestClient client of a mock echo server on a random port
+func startTestClient(t testing.TB, cfg Config) (*Client, *mockserver.Server) {
+	t.Helper()
+
+	ms := mockserver.New(mockserver.Config{UUID: "test", Dial: mockserver.EchoDial})
+
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.URL = ms.URL()
+	cfg.UUID = "test"
+	if cfg.TunnelCap == 0 {
+		cfg.TunnelCap = 1
+	}
+	if cfg.ReqCap == 0 {
+		cfg.ReqCap = 64
+	}
+	if cfg.Grace == 0 {
+		cfg.Grace = 100 * time.Millisecond
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		ms.Close()
+		t.Fatal(err)
+	}
+
+	if err := c.Start(context.Background()); err != nil {
+		ms.Close()
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ms.Sessions() < cfg.TunnelCap {
+		if time.Now().After(deadline) {
+			t.Fatalf("sessions:%d, want:%d", ms.Sessions(), cfg.TunnelCap)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return c, ms
+}
+
+func TestServeAdminLoopbackOnly(t *testing.T) {
+	c, ms := startTestClient(t, Config{})
+	defer ms.Close()
+	defer c.Close()
+
+	for _, addr := range []string{"0.0.0.0:0", ":0", "[::]:0", "example.com:0"} {
+		if err := c.ServeAdmin(addr); err == nil {
+			t.Fatalf("admin served at %s", addr)
+		}
+	}
+}
+
+func TestServeAdminUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "admin.sock")
+
+	// socket file left by a killed process
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	c, ms := startTestClient(t, Config{})
+	defer ms.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- c.ServeAdmin("unix:" + path)
+	}()
+
+	var conn net.Conn
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+
+		select {
+		case err := <-served:
+			t.Fatal("admin stopped:", err)
+		default:
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.Close()
+
+	// stopped with the client
+	c.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("admin not stopped by Close")
+	}
+
+	if err := c.ServeAdmin("unix:" + path); err == nil {
+		t.Fatal("admin served after Close")
+	}
+}
+
+// adminDo call admin api, decode json response into v if not nil
+func adminDo(t *testing.T, c *Client, method string, target string, form url.Values, v interface{}) int {
+	t.Helper()
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req := httptest.NewRequest(method, target, body)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	w := httptest.NewRecorder()
+	c.adminHandler().ServeHTTP(w, req)
+
+	if w.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+
+	return w.Code
+}
+
+// socksDial socks5 no-auth connect to host:80 through addr
+func socksDial(t *testing.T, addr string, host string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	handshake := []byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}
+	handshake = append(handshake, host...)
+	handshake = append(handshake, 0, 80)
+	if _, err := conn.Write(handshake); err != nil {
+		t.Fatal(err)
+	}
+
+	// method reply, connect reply with ipv4 bind address
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0 || reply[3] != 0 {
+		t.Fatalf("socks5 reply %v", reply)
+	}
+
+	return conn
+}
+
+// openEcho open a request to the echo server, data echoed
+func openEcho(t *testing.T, c *Client) net.Conn {
+	t.Helper()
+
+	conn, err := c.Dial("tcp", "echo.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestAdminAccountsRequests(t *testing.T) {
+	c, ms := startTestClient(t, Config{})
+	defer ms.Close()
+	defer c.Close()
+
+	conn := openEcho(t, c)
+	defer conn.Close()
+
+	var accounts []accountInfo
+	if code := adminDo(t, c, "GET", "/accounts", nil, &accounts); code != http.StatusOK {
+		t.Fatalf("accounts status %d", code)
+	}
+	if len(accounts) != 1 {
+		t.Fatalf("%d accounts, want 1", len(accounts))
+	}
+	a := accounts[0]
+	if len(a.Tunnels) != 1 || a.Tunnels[0].State != "up" || a.Tunnels[0].Requests != 1 {
+		t.Fatalf("tunnels %+v, want one up with 1 request", a.Tunnels)
+	}
+	if a.SlotsUsed != 1 {
+		t.Fatalf("slots used %d, want 1", a.SlotsUsed)
+	}
+
+	var requests []requestInfo
+	adminDo(t, c, "GET", "/requests", nil, &requests)
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	if r := requests[0]; r.Dest != "echo.test:80" || r.BytesUp != 4 || r.BytesDown != 4 {
+		t.Fatalf("request %+v", r)
+	}
+}
+
+func TestAdminKillRequest(t *testing.T) {
+	c, ms := startTestClient(t, Config{})
+	defer ms.Close()
+	defer c.Close()
+
+	conn := openEcho(t, c)
+	defer conn.Close()
+
+	var requests []requestInfo
+	adminDo(t, c, "GET", "/requests", nil, &requests)
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	r := requests[0]
+
+	form := url.Values{
+		"idx": {strconv.Itoa(int(r.Idx))},
+		"tag": {strconv.Itoa(int(r.Tag))},
+	}
+
+	if code := adminDo(t, c, "GET", "/requests/kill", nil, nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("kill by GET status %d", code)
+	}
+
+	stale := url.Values{"idx": form["idx"], "tag": {strconv.Itoa(int(r.Tag) + 1)}}
+	if code := adminDo(t, c, "POST", "/requests/kill", stale, nil); code != http.StatusNotFound {
+		t.Fatalf("kill stale tag status %d", code)
+	}
+
+	if code := adminDo(t, c, "POST", "/requests/kill", url.Values{"idx": {"x"}}, nil); code != http.StatusBadRequest {
+		t.Fatalf("kill invalid idx status %d", code)
+	}
+
+	if code := adminDo(t, c, "POST", "/requests/kill", form, nil); code != http.StatusOK {
+		t.Fatalf("kill status %d", code)
+	}
+
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("killed request not closed")
+		}
+	}
+
+	waitUsed(t, c.account, 0)
+
+	if code := adminDo(t, c, "POST", "/requests/kill", form, nil); code != http.StatusNotFound {
+		t.Fatalf("kill twice status %d", code)
+	}
+}
+
+func TestAdminTunnels(t *testing.T) {
+	c, ms := startTestClient(t, Config{})
+	defer ms.Close()
+	defer c.Close()
+
+	id := url.Values{"id": {"0"}}
+
+	if code := adminDo(t, c, "POST", "/tunnels/drain", url.Values{"id": {"9"}}, nil); code != http.StatusNotFound {
+		t.Fatalf("drain unknown tunnel status %d", code)
+	}
+
+	if code := adminDo(t, c, "POST", "/tunnels/drain", id, nil); code != http.StatusOK {
+		t.Fatalf("drain status %d", code)
+	}
+
+	var accounts []accountInfo
+	adminDo(t, c, "GET", "/accounts", nil, &accounts)
+	if state := accounts[0].Tunnels[0].State; state != "draining" {
+		t.Fatalf("tunnel %s after drain, want draining", state)
+	}
+
+	a := c.account
+	a.lock.Lock()
+	old := a.tunnels[0]
+	a.lock.Unlock()
+
+	if code := adminDo(t, c, "POST", "/tunnels/reconnect", id, nil); code != http.StatusOK {
+		t.Fatalf("reconnect status %d", code)
+	}
+
+	// rebuilt as a new tunnel
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.lock.Lock()
+		t0 := a.tunnels[0]
+		rebuilt := t0 != nil && t0 != old && t0.conn != nil
+		a.lock.Unlock()
+
+		if rebuilt {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel not rebuilt after reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := dialEcho(c, []byte("after reconnect")); err != nil {
+		t.Fatal(err)
+	}
+
+	adminDo(t, c, "GET", "/accounts", nil, &accounts)
+	if state := accounts[0].Tunnels[0].State; state != "up" {
+		t.Fatalf("tunnel %s after reconnect, want up", state)
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	var users []policy.Usage
+	c, ms := startTestClient(t, Config{})
+	adminDo(t, c, "GET", "/users", nil, &users)
+	c.Close()
+	ms.Close()
+	if len(users) != 0 {
+		t.Fatalf("users without policy %+v", users)
+	}
+
+	m, err := policy.New(&policy.Config{Default: &policy.Policy{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, ms = startTestClient(t, Config{Policy: m})
+	defer ms.Close()
+	defer c.Close()
+
+	// requests of DialContext are not limited, go through socks5
+	conn := socksDial(t, c.Addr().String(), "echo.test")
+	defer conn.Close()
+
+	data := []byte("hello")
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	adminDo(t, c, "GET", "/users", nil, &users)
+	if len(users) != 1 || users[0].BytesUp != int64(len(data)) {
+		t.Fatalf("users %+v, want one with %d bytes up", users, len(data))
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	c, ms := startTestClient(t, Config{})
+	defer ms.Close()
+	defer c.Close()
+
+	defer log.SetLevel(log.GetLevel())
+
+	var level string
+	if code := adminDo(t, c, "POST", "/loglevel", url.Values{"level": {"warn"}}, &level); code != http.StatusOK {
+		t.Fatalf("set level status %d", code)
+	}
+	if level != "warning" || log.GetLevel() != log.WarnLevel {
+		t.Fatalf("level %s, want warning", level)
+	}
+
+	if code := adminDo(t, c, "POST", "/loglevel", url.Values{"level": {"loud"}}, nil); code != http.StatusBadRequest {
+		t.Fatalf("set invalid level status %d", code)
+	}
+
+	adminDo(t, c, "GET", "/loglevel", nil, &level)
+	if level != "warning" {
+		t.Fatalf("level %s after invalid set, want warning", level)
+	}
+}
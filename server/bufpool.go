@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// minPoolBufferSize size of the smallest buffer class, each next
+	// class is 4 times larger
+	minPoolBufferSize = 4*1024 + 64
+	poolClasses       = 5
+)
+
+// bufferPools data path buffers by size class, reused to lower gc
+// pressure, buffers larger than the last class are not pooled
+var bufferPools [poolClasses]sync.Pool
+
+func init() {
+	for i := range bufferPools {
+		size := minPoolBufferSize << (2 * uint(i))
+		bufferPools[i].New = func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}
+	}
+}
+
+// poolClass class of buffer size n, -1 if too large
+func poolClass(n int) int {
+	size := minPoolBufferSize
+	for i := 0; i < poolClasses; i++ {
+		if n <= size {
+			return i
+		}
+		size <<= 2
+	}
+
+	return -1
+}
+
+// getBuffer buffer of n bytes, from pool if it fits
+func getBuffer(n int) *[]byte {
+	c := poolClass(n)
+	if c < 0 {
+		b := make([]byte, n)
+		return &b
+	}
+
+	b := bufferPools[c].Get().(*[]byte)
+	*b = (*b)[:n]
+
+	return b
+}
+
+// putBuffer return buffer got by getBuffer, it must not be used after
+func putBuffer(b *[]byte) {
+	c := poolClass(cap(*b))
+	if c < 0 || cap(*b) != minPoolBufferSize<<(2*uint(c)) {
+		return
+	}
+
+	bufferPools[c].Put(b)
+}
+
+// readAll read r to EOF into buf[:0], buf is grown if too small,
+// so that it can be reused for the next message
+func readAll(r io.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+
+		if err != nil {
+			return buf, err
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+const (
+	// defaultChunkSize bytes read from local conn per data frame
+	defaultChunkSize = 4096
+	// minChunkSize smallest ChunkSize accepted in config
+	minChunkSize = 512
+	// adaptiveStartChunk adaptive chunks start here, interactive size
+	adaptiveStartChunk = 4096
+	// maxChunkSize largest chunk, frames must fit tunnel limits
+	maxChunkSize = 256 * 1024
+
+	// smallReadsToShrink small reads in a row before chunk halves
+	smallReadsToShrink = 4
+)
+
+// chunkSizer read chunk size of a request, fixed unless adaptive,
+// adaptive size doubles while reads fill the chunk (bulk transfer)
+// and halves back after a few small reads (interactive)
+type chunkSizer struct {
+	size int
+	min  int
+	max  int
+
+	adaptive   bool
+	smallReads int
+}
+
+func newChunkSizer(max int, adaptive bool) *chunkSizer {
+	cs := &chunkSizer{size: max, min: max, max: max, adaptive: adaptive}
+	if adaptive && max > adaptiveStartChunk {
+		cs.size = adaptiveStartChunk
+		cs.min = adaptiveStartChunk
+	}
+
+	return cs
+}
+
+// update account a read of n bytes, true if size changed
+func (cs *chunkSizer) update(n int) bool {
+	if !cs.adaptive {
+		return false
+	}
+
+	if n >= cs.size {
+		cs.smallReads = 0
+		if cs.size < cs.max {
+			cs.size *= 2
+			if cs.size > cs.max {
+				cs.size = cs.max
+			}
+			return true
+		}
+		return false
+	}
+
+	if n > cs.size/4 {
+		cs.smallReads = 0
+		return false
+	}
+
+	cs.smallReads++
+	if cs.smallReads < smallReadsToShrink || cs.size <= cs.min {
+		return false
+	}
+
+	cs.smallReads = 0
+	cs.size /= 2
+	if cs.size < cs.min {
+		cs.size = cs.min
+	}
+
+	return true
+}
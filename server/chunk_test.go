@@ -0,0 +1,92 @@
+package server
+
+import "testing"
+
+func TestChunkSizerGrow(t *testing.T) {
+	cs := newChunkSizer(20000, true)
+	if cs.size != adaptiveStartChunk {
+		t.Fatalf("start size %d, want %d", cs.size, adaptiveStartChunk)
+	}
+
+	// full reads double up to max, which is not a power of two
+	for _, want := range []int{8192, 16384, 20000} {
+		if !cs.update(cs.size) || cs.size != want {
+			t.Fatalf("size %d after full read, want %d", cs.size, want)
+		}
+	}
+
+	if cs.update(cs.size) || cs.size != 20000 {
+		t.Fatalf("size %d grew over max", cs.size)
+	}
+}
+
+func TestChunkSizerShrink(t *testing.T) {
+	cs := newChunkSizer(16384, true)
+	cs.update(cs.size)
+	cs.update(cs.size)
+	if cs.size != 16384 {
+		t.Fatalf("size %d, want 16384", cs.size)
+	}
+
+	// small reads in a row halve it
+	for i := 1; i < smallReadsToShrink; i++ {
+		if cs.update(10) {
+			t.Fatalf("shrunk after %d small reads", i)
+		}
+	}
+	if !cs.update(10) || cs.size != 8192 {
+		t.Fatalf("size %d after %d small reads, want 8192", cs.size, smallReadsToShrink)
+	}
+
+	// a medium read breaks the run
+	for i := 1; i < smallReadsToShrink; i++ {
+		cs.update(10)
+	}
+	if cs.update(cs.size/2) || cs.size != 8192 {
+		t.Fatalf("size %d after medium read, want 8192", cs.size)
+	}
+	for i := 1; i < smallReadsToShrink; i++ {
+		if cs.update(10) {
+			t.Fatal("small read count not reset by medium read")
+		}
+	}
+
+	// never below the start size
+	for i := 0; i < smallReadsToShrink*4; i++ {
+		cs.update(10)
+	}
+	if cs.size != adaptiveStartChunk {
+		t.Fatalf("size %d, want floor %d", cs.size, adaptiveStartChunk)
+	}
+}
+
+func TestChunkSizerFixed(t *testing.T) {
+	cs := newChunkSizer(65536, false)
+	for _, n := range []int{65536, 65536, 10, 10, 10, 10, 10} {
+		if cs.update(n) || cs.size != 65536 {
+			t.Fatalf("fixed size changed to %d", cs.size)
+		}
+	}
+}
+
+func TestAdaptiveChunkSize(t *testing.T) {
+	for _, size := range []int{0, minChunkSize, adaptiveStartChunk, adaptiveStartChunk * 2} {
+		c, err := NewClient(Config{
+			ListenAddr:    "127.0.0.1:0",
+			URL:           "ws://127.0.0.1:1",
+			UUID:          "test",
+			TunnelCap:     1,
+			ReqCap:        8,
+			ChunkSize:     size,
+			AdaptiveChunk: true,
+		})
+
+		ok := size > adaptiveStartChunk
+		if (err == nil) != ok {
+			t.Fatalf("adaptive chunk with chunk size %d: %v", size, err)
+		}
+		if c != nil {
+			c.Close()
+		}
+	}
+}
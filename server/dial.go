@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"lproxyc/socks5"
+	"net"
+	"strconv"
+)
+
+// DialContext connect to address through the tunnel, the returned conn
+// is backed by the tunnel data path, no local socks port is involved,
+// can be used as net/http.Transport.DialContext
+func (c *Client) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupport network:%s", network)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dest, err := parseAddrSpec(address)
+	if err != nil {
+		return nil, err
+	}
+
+	local, remote := newPipe(pipeAddr("dial"), pipeAddr(address))
+	sreq := &socks5.SocksRequest{
+		Version:  5,
+		Command:  socks5.ConnectCommand,
+		DestAddr: dest,
+		Conn:     remote,
+	}
+
+	run, err := c.account.allocRequest(ctx, sreq)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	go run()
+
+	return local, nil
+}
+
+// Dial connect to address through the tunnel
+func (c *Client) Dial(network string, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// parseAddrSpec parse host:port, host can be domain or ip
+func parseAddrSpec(address string) (*socks5.AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port:%s", portStr)
+	}
+
+	dest := &socks5.AddrSpec{Port: int(port)}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		dest.IP = ip
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("invalid host:%s", host)
+		}
+		dest.FQDN = host
+	}
+
+	return dest, nil
+}
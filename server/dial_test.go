@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"lproxyc/mockserver"
+)
+
+// TestConcurrentDial DialContext is safe for concurrent use, run
+// with -race
+func TestConcurrentDial(t *testing.T) {
+	c, ms := startTestClient(t, Config{TunnelCap: 4, ReqCap: 256})
+	defer ms.Close()
+	defer c.Close()
+
+	const dials = 200
+
+	var wg sync.WaitGroup
+	errs := make(chan error, dials)
+	for i := 0; i < dials; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- dialEcho(c, []byte(fmt.Sprintf("hello %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// all freed once both sides closed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		used, _ := c.account.reqq.counts()
+		if used == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("requests used:%d, want 0", used)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dialEcho dial echo target through the tunnel, send data, half
+// close and read everything back
+func dialEcho(c *Client, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := c.DialContext(ctx, "tcp", "echo.test:80")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+
+	if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		return err
+	}
+
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("got %q, want %q", got, data)
+	}
+
+	return nil
+}
+
+// TestCloseGraceKeepalive tunnels are pinged while requests finish
+// within grace, not found dead
+func TestCloseGraceKeepalive(t *testing.T) {
+	c, ms := startTestClient(t, Config{
+		PingInterval: 50 * time.Millisecond,
+		PingTimeout:  50 * time.Millisecond,
+		Grace:        time.Second,
+	})
+	defer ms.Close()
+
+	conn, err := c.DialContext(context.Background(), "tcp", "echo.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+
+	// several dead timeouts into grace
+	time.Sleep(500 * time.Millisecond)
+
+	data := []byte("still alive")
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("request closed within grace:", err)
+	}
+
+	<-closed
+}
+
+// TestCloseBeforeStart closed client never starts and Done is closed
+func TestCloseBeforeStart(t *testing.T) {
+	ms := mockserver.New(mockserver.Config{UUID: "test", Dial: mockserver.EchoDial})
+	defer ms.Close()
+
+	c, err := NewClient(Config{ListenAddr: "127.0.0.1:0", URL: ms.URL(), UUID: "test", TunnelCap: 1, ReqCap: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done not closed by Close before Start")
+	}
+
+	if err := c.Start(context.Background()); err == nil {
+		t.Fatal("client started after Close")
+	}
+	if c.Addr() != nil {
+		t.Fatal("client listening after Close")
+	}
+
+	// closing again doesn't block or panic
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCreateSocks5erver deprecated entry, stopped by its ctx
+func TestCreateSocks5erver(t *testing.T) {
+	ms := mockserver.New(mockserver.Config{UUID: "test", Dial: mockserver.EchoDial})
+	defer ms.Close()
+
+	// it takes an address, pick a free port for it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		createSocks5erver(ctx, addr, ms.URL(), "test", 2, 16)
+	}()
+	waitSessions(t, ms.Sessions, 2)
+
+	conn := socksDial(t, addr, "echo.test")
+	data := []byte("hello")
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not stopped when ctx done")
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"lproxyc/codec"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// endpointStagger delay before the next endpoint joins the race,
+	// the connection attempt delay of RFC 8305
+	endpointStagger = 250 * time.Millisecond
+	// unknownLatency latency assumed for endpoints never connected
+	unknownLatency = 500 * time.Millisecond
+	// failurePenalty score added per consecutive failure
+	failurePenalty = 5 * time.Second
+)
+
+// endpoint server url of an account, its health is remembered across
+// dials, so reconnects try good endpoints first
+type endpoint struct {
+	url string
+
+	lock sync.Mutex
+	// latency moving average of successful dial time
+	latency time.Duration
+	// failures consecutive failed dials or dead tunnels
+	failures int
+}
+
+func newEndpoints(urls []string) []*endpoint {
+	eps := make([]*endpoint, len(urls))
+	for i, u := range urls {
+		eps[i] = &endpoint{url: u}
+	}
+
+	return eps
+}
+
+func (e *endpoint) succeeded(d time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.latency == 0 {
+		e.latency = d
+	} else {
+		e.latency = (e.latency*3 + d) / 4
+	}
+	e.failures = 0
+}
+
+func (e *endpoint) failed() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.failures++
+}
+
+func (e *endpoint) info() endpointInfo {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return endpointInfo{
+		URL:       e.url,
+		LatencyMs: float64(e.latency) / float64(time.Millisecond),
+		Failures:  e.failures,
+	}
+}
+
+// score lower is better
+func (e *endpoint) score() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	latency := e.latency
+	if latency == 0 {
+		latency = unknownLatency
+	}
+
+	return latency + time.Duration(e.failures)*failurePenalty
+}
+
+// sortedEndpoints endpoints best first, config order breaks ties
+func (a *Account) sortedEndpoints() []*endpoint {
+	eps := append([]*endpoint(nil), a.endpoints...)
+	scores := make(map[*endpoint]time.Duration, len(eps))
+	for _, ep := range eps {
+		scores[ep] = ep.score()
+	}
+
+	sort.SliceStable(eps, func(i, j int) bool {
+		return scores[eps[i]] < scores[eps[j]]
+	})
+
+	return eps
+}
+
+// endpointURL tunnel url of ep
+func (a *Account) endpointURL(ep *endpoint) string {
+	return fmt.Sprintf("%s?uuid=%s&%s=%d&%s=%d", ep.url, a.uuid,
+		codec.VersionParam, codec.Version, codec.MaxFrameParam, a.transport.maxFrame())
+}
+
+// dialResult result of one endpoint dial
+type dialResult struct {
+	conn Transport
+	ep   *endpoint
+	err  error
+}
+
+// dialEndpoint dial ep, record its health unless ctx is canceled
+func (a *Account) dialEndpoint(ctx context.Context, ep *endpoint, results chan<- dialResult) {
+	url := a.endpointURL(ep)
+	log.Println("tunnel dail to:", url)
+
+	start := time.Now()
+	c, err := dialTransport(ctx, url, a.transport)
+	if err == nil {
+		ep.succeeded(time.Since(start))
+	} else if ctx.Err() == nil {
+		log.Printf("tunnel dial %s failed:%v", ep.url, err)
+		ep.failed()
+	}
+
+	results <- dialResult{conn: c, ep: ep, err: err}
+}
+
+// dialEndpoints race endpoints best first, the next one starts after
+// endpointStagger or at once when one fails, the first connected is
+// kept and the others are canceled
+func (a *Account) dialEndpoints(ctx context.Context) (Transport, *endpoint, error) {
+	eps := a.sortedEndpoints()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(eps))
+	next, pending := 0, 0
+	var stagger <-chan time.Time
+	startNext := func() {
+		go a.dialEndpoint(ctx, eps[next], results)
+		next++
+		pending++
+		if next < len(eps) {
+			stagger = time.After(endpointStagger)
+		} else {
+			stagger = nil
+		}
+	}
+
+	startNext()
+	var lastErr error
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// losers connected before canceled are closed
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if late := <-results; late.err == nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+
+				return r.conn, r.ep, nil
+			}
+
+			lastErr = r.err
+			if next < len(eps) {
+				startNext()
+			} else if pending == 0 {
+				return nil, nil, lastErr
+			}
+		case <-stagger:
+			startNext()
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"lproxyc/mockserver"
+)
+
+func TestEndpointScore(t *testing.T) {
+	ep := &endpoint{url: "ws://a"}
+	if s := ep.score(); s != unknownLatency {
+		t.Fatalf("new endpoint score %v, want %v", s, unknownLatency)
+	}
+
+	ep.succeeded(100 * time.Millisecond)
+	ep.succeeded(200 * time.Millisecond)
+	if s := ep.score(); s != 125*time.Millisecond {
+		t.Fatalf("score %v, want moving average 125ms", s)
+	}
+
+	// each failure in a row adds a penalty
+	ep.failed()
+	ep.failed()
+	if s := ep.score(); s != 125*time.Millisecond+2*failurePenalty {
+		t.Fatalf("score %v after 2 failures", s)
+	}
+
+	// one success recovers
+	ep.succeeded(125 * time.Millisecond)
+	if s := ep.score(); s != 125*time.Millisecond {
+		t.Fatalf("score %v after recovery, want 125ms", s)
+	}
+	if info := ep.info(); info.Failures != 0 || info.LatencyMs != 125 {
+		t.Fatalf("info %+v", info)
+	}
+}
+
+func TestSortedEndpoints(t *testing.T) {
+	a := newAccount("ep-test", 1, 1, "test", []string{"ws://a", "ws://b", "ws://c", "ws://d"}, 1, 1)
+	urls := func() []string {
+		var us []string
+		for _, ep := range a.sortedEndpoints() {
+			us = append(us, ep.url)
+		}
+		return us
+	}
+
+	// unknown all alike, config order
+	if got := urls(); got[0] != "ws://a" || got[3] != "ws://d" {
+		t.Fatalf("order %v, want config order", got)
+	}
+
+	a.endpoints[0].failed()
+	a.endpoints[2].succeeded(900 * time.Millisecond)
+	a.endpoints[3].succeeded(10 * time.Millisecond)
+
+	want := []string{"ws://d", "ws://b", "ws://c", "ws://a"}
+	got := urls()
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("order %v, want %v", got, want)
+		}
+	}
+
+	// the failed one comes back first once it is the fastest again
+	a.endpoints[0].succeeded(time.Millisecond)
+	if got := urls(); got[0] != "ws://a" {
+		t.Fatalf("order %v after recovery, want ws://a first", got)
+	}
+}
+
+func dialTest(t *testing.T, a *Account) (*endpoint, time.Duration) {
+	t.Helper()
+
+	start := time.Now()
+	c, ep, err := a.dialEndpoints(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	return ep, time.Since(start)
+}
+
+// TestDialEndpointsStagger a slow best endpoint gets a head start of
+// endpointStagger, then the next one races it and wins
+func TestDialEndpointsStagger(t *testing.T) {
+	slow := mockserver.New(mockserver.Config{
+		UUID:   "test",
+		Dial:   mockserver.EchoDial,
+		Faults: mockserver.Faults{AcceptDelay: 5 * time.Second},
+	})
+	defer slow.Close()
+	fast := mockserver.New(mockserver.Config{UUID: "test", Dial: mockserver.EchoDial})
+	defer fast.Close()
+
+	a := newAccount("ep-test", 1, 1, "test", []string{slow.URL(), fast.URL()}, 1, 1)
+
+	ep, d := dialTest(t, a)
+	if ep != a.endpoints[1] {
+		t.Fatalf("won by %s, want the fast one", ep.url)
+	}
+	if d < endpointStagger || d > 2*time.Second {
+		t.Fatalf("dialed in %v, want just over %v", d, endpointStagger)
+	}
+
+	// the loser is canceled, not counted as failed
+	if info := a.endpoints[0].info(); info.Failures != 0 {
+		t.Fatalf("canceled endpoint %+v", info)
+	}
+
+	// its handshake is aborted, the slow server isn't left waiting
+	start := time.Now()
+	slow.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("slow server closed in %v, loser handshake not aborted", d)
+	}
+
+	// the winner is tried first next time, and wins before the
+	// slow one joins
+	if eps := a.sortedEndpoints(); eps[0] != a.endpoints[1] {
+		t.Fatalf("%s sorted first, want the fast one", eps[0].url)
+	}
+	ep, d = dialTest(t, a)
+	if ep != a.endpoints[1] || d >= endpointStagger {
+		t.Fatalf("won by %s in %v, want the fast one within %v", ep.url, d, endpointStagger)
+	}
+}
+
+// TestDialEndpointsFailover a failed endpoint starts the next one at
+// once, and is penalized until it connects again
+func TestDialEndpointsFailover(t *testing.T) {
+	down := mockserver.New(mockserver.Config{UUID: "test", Dial: mockserver.EchoDial})
+	downURL := down.URL()
+	down.Close()
+
+	up := mockserver.New(mockserver.Config{UUID: "test", Dial: mockserver.EchoDial})
+	defer up.Close()
+
+	a := newAccount("ep-test", 1, 1, "test", []string{downURL, up.URL()}, 1, 1)
+
+	ep, d := dialTest(t, a)
+	if ep != a.endpoints[1] {
+		t.Fatalf("won by %s, want the one up", ep.url)
+	}
+	if d >= endpointStagger {
+		t.Fatalf("dialed in %v, next endpoint not started at once", d)
+	}
+
+	if info := a.endpoints[0].info(); info.Failures != 1 {
+		t.Fatalf("failed endpoint %+v, want 1 failure", info)
+	}
+	if eps := a.sortedEndpoints(); eps[0] != a.endpoints[1] {
+		t.Fatalf("%s sorted first, want the one up", eps[0].url)
+	}
+
+	// all down, last error returned
+	up.Close()
+	if _, _, err := a.dialEndpoints(context.Background()); err == nil {
+		t.Fatal("dialed with all endpoints down")
+	}
+	if info := a.endpoints[1].info(); info.Failures != 1 {
+		t.Fatalf("endpoint %+v, want 1 failure", info)
+	}
+}
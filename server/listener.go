@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"lproxyc/guard"
+	"lproxyc/httpproxy"
+	"lproxyc/socks5"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listener protocols
+const (
+	ProtocolSOCKS5      = "socks5"
+	ProtocolHTTP        = "http"
+	ProtocolMixed       = "mixed"
+	ProtocolTransparent = "transparent"
+)
+
+// ListenerConfig local listener
+type ListenerConfig struct {
+	// Addr tcp address, or unix socket path with "unix:" prefix
+	Addr string
+	// Protocol socks5, http, mixed (socks5 and http on one port),
+	// or transparent (iptables redirected tcp), socks5 if empty
+	Protocol string
+	// Credentials if set, socks5 or http proxy auth is required
+	Credentials socks5.CredentialStore
+	// AuthLimiter if set, limits failed authentications per source ip
+	AuthLimiter *socks5.AuthLimiter
+	// Guard if set, filters and limits accepted connections
+	Guard *guard.Guard
+	// HandshakeTimeout if set, connections must send their request
+	// within it
+	HandshakeTimeout time.Duration
+	// Account send all requests to this account, empty to choose
+	// by Routes
+	Account string
+	// Routes routes of this listener, empty to use Config.Routes
+	Routes []Route
+}
+
+// connServer protocol front end
+type connServer interface {
+	ServeConn(conn net.Conn) error
+}
+
+// listener accept loop of one ListenerConfig
+type listener struct {
+	cfg ListenerConfig
+	srv connServer
+
+	// keepAlive Config.KeepAlive
+	keepAlive time.Duration
+
+	l net.Listener
+	// closed set by close, accessed atomically
+	closed int32
+}
+
+func (c *Client) newListener(lc ListenerConfig, byName map[string]*Account,
+	rewriter socks5.AddressRewriter, rules socks5.RuleSet) (*listener, error) {
+	var handler socks5.RequestHandler
+	if lc.Account != "" {
+		a, ok := byName[lc.Account]
+		if !ok {
+			return nil, fmt.Errorf("listener %s: unknown account %q", lc.Addr, lc.Account)
+		}
+		handler = &router{def: a}
+	} else {
+		routes := lc.Routes
+		if len(routes) == 0 {
+			routes = c.cfg.Routes
+		}
+
+		rt, err := newRouter(c.account, byName, routes)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", lc.Addr, err)
+		}
+		handler = rt
+	}
+
+	newSocks := func() (*socks5.Server, error) {
+		return socks5.New(&socks5.Config{
+			Credentials:      lc.Credentials,
+			AuthLimiter:      lc.AuthLimiter,
+			Rewriter:         rewriter,
+			Rules:            rules,
+			HandshakeTimeout: lc.HandshakeTimeout,
+			ReqHandler:       handler,
+		})
+	}
+
+	newHTTP := func() *httpproxy.Server {
+		return httpproxy.New(&httpproxy.Config{
+			Credentials:      lc.Credentials,
+			AuthLimiter:      lc.AuthLimiter,
+			Rewriter:         rewriter,
+			Rules:            rules,
+			HandshakeTimeout: lc.HandshakeTimeout,
+			ReqHandler:       handler,
+		})
+	}
+
+	ln := &listener{cfg: lc, keepAlive: c.cfg.KeepAlive}
+	switch lc.Protocol {
+	case "", ProtocolSOCKS5:
+		s, err := newSocks()
+		if err != nil {
+			return nil, err
+		}
+		ln.srv = s
+	case ProtocolHTTP:
+		ln.srv = newHTTP()
+	case ProtocolMixed:
+		s, err := newSocks()
+		if err != nil {
+			return nil, err
+		}
+		ln.srv = &mixedServer{socks: s, http: newHTTP(), timeout: lc.HandshakeTimeout}
+	case ProtocolTransparent:
+		ln.srv = &transparentServer{rewriter: rewriter, rules: rules, handler: handler}
+	default:
+		return nil, fmt.Errorf("listener %s: unknown protocol %q", lc.Addr, lc.Protocol)
+	}
+
+	return ln, nil
+}
+
+// listenNetwork network and address of a listen address, a unix
+// socket path has "unix:" prefix, its stale socket file of last
+// run is removed
+func listenNetwork(addr string) (string, string) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return "tcp", addr
+	}
+
+	addr = strings.TrimPrefix(addr, "unix:")
+	if st, err := os.Stat(addr); err == nil && st.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr)
+	}
+
+	return "unix", addr
+}
+
+// IsLoopback listen address only reachable from local host, a unix
+// socket or a loopback ip
+func IsLoopback(addr string) bool {
+	if strings.HasPrefix(addr, "unix:") {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (ln *listener) listen() error {
+	network, addr := listenNetwork(ln.cfg.Addr)
+
+	// keepalive is set on accepted tcp conns
+	lc := net.ListenConfig{KeepAlive: ln.keepAlive}
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return err
+	}
+
+	if ln.cfg.Guard != nil {
+		l = ln.cfg.Guard.Listener(l)
+	}
+
+	ln.l = l
+
+	return nil
+}
+
+// serve accept until closed, return nil if closed by close
+func (ln *listener) serve() error {
+	protocol := ln.cfg.Protocol
+	if protocol == "" {
+		protocol = ProtocolSOCKS5
+	}
+	log.Printf("%s server listen at:%s", protocol, ln.l.Addr())
+
+	for {
+		conn, err := ln.l.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&ln.closed) != 0 {
+				return nil
+			}
+			return err
+		}
+
+		go func() {
+			if err := ln.srv.ServeConn(conn); err != nil {
+				log.Printf("%s ServeConn failed: %v", protocol, err)
+			}
+		}()
+	}
+}
+
+func (ln *listener) close() {
+	atomic.StoreInt32(&ln.closed, 1)
+	if ln.l != nil {
+		ln.l.Close()
+	}
+}
+
+// unwrapConn the innermost conn of wrappers
+func unwrapConn(c net.Conn) net.Conn {
+	for {
+		u, ok := c.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return c
+		}
+		c = u.Unwrap()
+	}
+}
+
+// mixedServer socks5 and http on one port, by the first byte
+type mixedServer struct {
+	socks   *socks5.Server
+	http    *httpproxy.Server
+	timeout time.Duration
+}
+
+// ServeConn implement connServer
+func (m *mixedServer) ServeConn(conn net.Conn) error {
+	if m.timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(m.timeout))
+	}
+
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("peek failed: %v", err)
+	}
+
+	pc := socks5.NewBufConn(conn, br)
+	if b[0] == 5 {
+		return m.socks.ServeConn(pc)
+	}
+
+	return m.http.ServeConn(pc)
+}
+
+// transparentServer tcp redirected by iptables, destination is the
+// original destination of the conn
+type transparentServer struct {
+	rewriter socks5.AddressRewriter
+	rules    socks5.RuleSet
+	handler  socks5.RequestHandler
+}
+
+// ServeConn implement connServer
+func (ts *transparentServer) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	dst, err := originalDst(conn)
+	if err != nil {
+		return err
+	}
+
+	if laddr, ok := unwrapConn(conn).LocalAddr().(*net.TCPAddr); ok &&
+		laddr.IP.Equal(dst.IP) && laddr.Port == dst.Port {
+		// not redirected, connected to us directly
+		return fmt.Errorf("connection from %s is not redirected", conn.RemoteAddr())
+	}
+
+	dest := &socks5.AddrSpec{IP: dst.IP, Port: dst.Port}
+	if ip4 := dst.IP.To4(); ip4 != nil {
+		dest.IP = ip4
+	}
+
+	sreq := &socks5.SocksRequest{
+		Version:     5,
+		Command:     socks5.ConnectCommand,
+		AuthContext: &socks5.AuthContext{},
+		DestAddr:    dest,
+		Conn:        conn,
+	}
+
+	if !socks5.Prepare(sreq, ts.rewriter, ts.rules) {
+		return fmt.Errorf("request to %v blocked by rules", sreq.DestAddr)
+	}
+
+	return ts.handler.HandleRequest(sreq)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"lproxyc/metrics"
+	"strconv"
+)
+
+var (
+	metricTunnelsUp = metrics.Default.NewGaugeVec("lproxyc_tunnels_up",
+		"Tunnels connected.", "account")
+	metricTunnelsDown = metrics.Default.NewGaugeVec("lproxyc_tunnels_down",
+		"Tunnels not connected.", "account")
+	metricReconnects = metrics.Default.NewCounterVec("lproxyc_tunnel_reconnects_total",
+		"Tunnel re-dials after break or dial failure.", "account")
+	metricPingRTT = metrics.Default.NewGaugeVec("lproxyc_tunnel_ping_rtt_seconds",
+		"Last ping round trip time.", "account", "tunnel")
+	metricSlotsUsed = metrics.Default.NewGaugeVec("lproxyc_reqq_slots_used",
+		"Request slots in use.", "account")
+	metricSlotsFree = metrics.Default.NewGaugeVec("lproxyc_reqq_slots_free",
+		"Request slots free.", "account")
+	metricReqCreated = metrics.Default.NewCounterVec("lproxyc_requests_created_total",
+		"Requests created.", "account")
+	metricReqFailed = metrics.Default.NewCounterVec("lproxyc_requests_failed_total",
+		"Requests failed to create.", "account", "reason")
+	metricReqClosed = metrics.Default.NewCounterVec("lproxyc_requests_closed_total",
+		"Requests closed.", "account", "reason")
+	metricBytesUp = metrics.Default.NewCounterVec("lproxyc_bytes_up_total",
+		"Bytes sent from local connections to tunnel.", "account")
+	metricBytesDown = metrics.Default.NewCounterVec("lproxyc_bytes_down_total",
+		"Bytes written from tunnel to local connections.", "account")
+	metricReorderDepth = metrics.Default.NewGaugeVec("lproxyc_reorder_buffer_depth",
+		"Packets held in reorder buffers.", "account")
+	metricReqWaiting = metrics.Default.NewGaugeVec("lproxyc_reqq_waiting",
+		"Requests waiting for a free slot.", "account")
+	metricProtocolErrors = metrics.Default.NewCounterVec("lproxyc_tunnel_protocol_errors_total",
+		"Tunnels closed for invalid or oversized server messages.", "account")
+	metricFailovers = metrics.Default.NewCounterVec("lproxyc_requests_failover_total",
+		"Requests created again on another tunnel after their tunnel broke.", "account")
+	metricQuotaReports = metrics.Default.NewCounterVec("lproxyc_quota_reports_total",
+		"Quota reports sent.", "account")
+)
+
+// request close reasons
+const (
+	closeServerClosed = "server_closed"
+	closeClientClosed = "client_closed"
+	closeTunnelBroken = "tunnel_broken"
+	closeInvalid      = "invalid"
+	closeKilled       = "killed"
+	closeShutdown     = "shutdown"
+	closeIdle         = "idle_timeout"
+	closeLinger       = "linger_timeout"
+)
+
+// request failed reasons
+const (
+	failNoTunnel  = "no_tunnel"
+	failReqqAlloc = "reqq_alloc"
+	failReqqWait  = "reqq_wait"
+	failFakeIP    = "fake_ip"
+	failPolicy    = "policy"
+)
+
+// accountMetrics account metric values, resolved once to avoid
+// label lookups on data path
+type accountMetrics struct {
+	label string
+
+	tunnelsUp    *metrics.Value
+	tunnelsDown  *metrics.Value
+	reconnects   *metrics.Value
+	slotsUsed    *metrics.Value
+	slotsFree    *metrics.Value
+	reqCreated   *metrics.Value
+	bytesUp      *metrics.Value
+	bytesDown    *metrics.Value
+	reorderDepth *metrics.Value
+	quotaReports *metrics.Value
+	reqWaiting   *metrics.Value
+
+	protocolErrors *metrics.Value
+	failovers      *metrics.Value
+}
+
+// newAccountMetrics metrics labeled by account name, names are unique
+// and don't expose the uuid
+func newAccountMetrics(name string) *accountMetrics {
+	return &accountMetrics{
+		label:        name,
+		tunnelsUp:    metricTunnelsUp.With(name),
+		tunnelsDown:  metricTunnelsDown.With(name),
+		reconnects:   metricReconnects.With(name),
+		slotsUsed:    metricSlotsUsed.With(name),
+		slotsFree:    metricSlotsFree.With(name),
+		reqCreated:   metricReqCreated.With(name),
+		bytesUp:      metricBytesUp.With(name),
+		bytesDown:    metricBytesDown.With(name),
+		reorderDepth: metricReorderDepth.With(name),
+		quotaReports: metricQuotaReports.With(name),
+		reqWaiting:   metricReqWaiting.With(name),
+
+		protocolErrors: metricProtocolErrors.With(name),
+		failovers:      metricFailovers.With(name),
+	}
+}
+
+func (m *accountMetrics) reqFailed(reason string) {
+	metricReqFailed.With(m.label, reason).Inc()
+}
+
+func (m *accountMetrics) reqClosed(reason string) {
+	metricReqClosed.With(m.label, reason).Inc()
+}
+
+func (m *accountMetrics) pingRTT(tunnel int, seconds float64) {
+	metricPingRTT.With(m.label, strconv.Itoa(tunnel)).Set(seconds)
+}
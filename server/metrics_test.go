@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"lproxyc/metrics"
+)
+
+// scrape value of a series in the prometheus text output, 0 if the
+// series is not there
+func scrape(t *testing.T, series string) float64 {
+	t.Helper()
+
+	var buf bytes.Buffer
+	metrics.Default.WriteText(&buf)
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if !strings.HasPrefix(line, series+" ") {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+		if err != nil {
+			t.Fatalf("series %s: %v", line, err)
+		}
+		return v
+	}
+
+	return 0
+}
+
+// waitScrape wait until series has value want
+func waitScrape(t *testing.T, series string, want float64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for scrape(t, series) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %v, want %v", series, scrape(t, series), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetricsScrape(t *testing.T) {
+	// registry is global, other tests may use the same account label
+	c, ms := startTestClient(t, Config{TunnelCap: 2})
+	defer c.Close()
+
+	label := fmt.Sprintf("{account=%q}", c.account.metrics.label)
+	up := "lproxyc_tunnels_up" + label
+	down := "lproxyc_tunnels_down" + label
+	reconnects := "lproxyc_tunnel_reconnects_total" + label
+	created := "lproxyc_requests_created_total" + label
+	noTunnel := fmt.Sprintf("lproxyc_requests_failed_total{account=%q,reason=%q}",
+		c.account.metrics.label, failNoTunnel)
+
+	upBefore, downBefore := scrape(t, up), scrape(t, down)
+	reconnectsBefore := scrape(t, reconnects)
+	createdBefore := scrape(t, created)
+	failedBefore := scrape(t, noTunnel)
+
+	if err := dialEcho(c, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if v := scrape(t, created); v != createdBefore+1 {
+		t.Fatalf("%s is %v, want %v", created, v, createdBefore+1)
+	}
+
+	// server gone, tunnels go down and can't be dialed again
+	ms.Close()
+	waitScrape(t, up, upBefore-2)
+	waitScrape(t, down, downBefore+2)
+	if v := scrape(t, reconnects); v <= reconnectsBefore {
+		t.Fatalf("%s is %v, want over %v", reconnects, v, reconnectsBefore)
+	}
+
+	if err := dialEcho(c, []byte("hello")); err == nil {
+		t.Fatal("dialed with no tunnel")
+	}
+	if v := scrape(t, noTunnel); v != failedBefore+1 {
+		t.Fatalf("%s is %v, want %v", noTunnel, v, failedBefore+1)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// soOriginalDst netfilter SO_ORIGINAL_DST, same value for ipv6
+	soOriginalDst = 80
+)
+
+// originalDst destination before iptables REDIRECT or TPROXY
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := unwrapConn(c).(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("transparent proxy needs tcp conn, got %T", c)
+	}
+
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		laddr, _ := tc.LocalAddr().(*net.TCPAddr)
+		if laddr != nil && laddr.IP.To4() == nil {
+			// sockaddr_in6 fits in IPv6MTUInfo
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+
+			addr = &net.TCPAddr{
+				IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+				Port: int(ntohs(info.Addr.Port)),
+			}
+			return
+		}
+
+		// sockaddr_in fits in IPv6Mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+			Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return addr, serr
+}
+
+// ntohs port field of sockaddr is network order
+func ntohs(v uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&v))
+	return binary.BigEndian.Uint16(b[:])
+}
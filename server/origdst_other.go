@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// originalDst only linux netfilter is supported
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("transparent proxy is only supported on linux")
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pipeBufferSize = 64 * 1024
+)
+
+// pipeAddr in-process address
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// timeoutError deadline exceeded
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// pipeBuffer one direction of a pipe, bounded buffer,
+// with deadlines and half-close
+type pipeBuffer struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+
+	// eof writer finished, reader get io.EOF after buffer drained
+	eof bool
+	// closed reader closed, writes fail
+	closed bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newPipeBuffer() *pipeBuffer {
+	b := &pipeBuffer{}
+	b.cond = sync.NewCond(&b.lock)
+
+	return b
+}
+
+func (b *pipeBuffer) read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for {
+		if b.closed {
+			return 0, io.ErrClosedPipe
+		}
+
+		if len(b.buf) > 0 {
+			n := copy(p, b.buf)
+			b.buf = b.buf[n:]
+			b.cond.Broadcast()
+			return n, nil
+		}
+
+		if b.eof {
+			return 0, io.EOF
+		}
+
+		if !b.readDeadline.IsZero() && !time.Now().Before(b.readDeadline) {
+			return 0, timeoutError{}
+		}
+
+		b.cond.Wait()
+	}
+}
+
+func (b *pipeBuffer) write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	wrote := 0
+	for wrote < len(p) {
+		if b.closed || b.eof {
+			return wrote, io.ErrClosedPipe
+		}
+
+		if !b.writeDeadline.IsZero() && !time.Now().Before(b.writeDeadline) {
+			return wrote, timeoutError{}
+		}
+
+		space := pipeBufferSize - len(b.buf)
+		if space <= 0 {
+			b.cond.Wait()
+			continue
+		}
+
+		n := len(p) - wrote
+		if n > space {
+			n = space
+		}
+
+		b.buf = append(b.buf, p[wrote:wrote+n]...)
+		wrote += n
+		b.cond.Broadcast()
+	}
+
+	return wrote, nil
+}
+
+func (b *pipeBuffer) closeWrite() {
+	b.lock.Lock()
+	b.eof = true
+	b.cond.Broadcast()
+	b.lock.Unlock()
+}
+
+func (b *pipeBuffer) closeRead() {
+	b.lock.Lock()
+	b.closed = true
+	b.buf = nil
+	b.cond.Broadcast()
+	b.lock.Unlock()
+}
+
+// setDeadline wake up waiters when deadline reached
+func (b *pipeBuffer) setDeadline(d *time.Time, t time.Time) {
+	b.lock.Lock()
+	*d = t
+	b.cond.Broadcast()
+	b.lock.Unlock()
+
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), func() {
+			b.lock.Lock()
+			b.cond.Broadcast()
+			b.lock.Unlock()
+		})
+	}
+}
+
+// pipeConn in-process full duplex conn with half-close
+type pipeConn struct {
+	r *pipeBuffer
+	w *pipeBuffer
+
+	local  net.Addr
+	remote net.Addr
+}
+
+// newPipe create a connected pair of conns
+func newPipe(a net.Addr, b net.Addr) (*pipeConn, *pipeConn) {
+	ab := newPipeBuffer()
+	ba := newPipeBuffer()
+
+	return &pipeConn{r: ba, w: ab, local: a, remote: b},
+		&pipeConn{r: ab, w: ba, local: b, remote: a}
+}
+
+func (p *pipeConn) Read(b []byte) (int, error) {
+	return p.r.read(b)
+}
+
+func (p *pipeConn) Write(b []byte) (int, error) {
+	return p.w.write(b)
+}
+
+// CloseWrite half close, peer get io.EOF
+func (p *pipeConn) CloseWrite() error {
+	p.w.closeWrite()
+	return nil
+}
+
+func (p *pipeConn) Close() error {
+	p.w.closeWrite()
+	p.r.closeRead()
+	return nil
+}
+
+func (p *pipeConn) LocalAddr() net.Addr  { return p.local }
+func (p *pipeConn) RemoteAddr() net.Addr { return p.remote }
+
+func (p *pipeConn) SetDeadline(t time.Time) error {
+	p.r.setDeadline(&p.r.readDeadline, t)
+	p.w.setDeadline(&p.w.writeDeadline, t)
+	return nil
+}
+
+func (p *pipeConn) SetReadDeadline(t time.Time) error {
+	p.r.setDeadline(&p.r.readDeadline, t)
+	return nil
+}
+
+func (p *pipeConn) SetWriteDeadline(t time.Time) error {
+	p.w.setDeadline(&p.w.writeDeadline, t)
+	return nil
+}
@@ -1,124 +1,360 @@
 package server
 
 import (
+	"container/heap"
+	"context"
 	"fmt"
-	"log"
+	"lproxyc/policy"
 	"lproxyc/socks5"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxReqCap idx is uint16
+	maxReqCap = 65535
+	// defaultReqInit slots allocated at start
+	defaultReqInit = 64
+)
+
+var (
+	errReqqQueueFull = fmt.Errorf("request queue is full")
+	errReqqTimeout   = fmt.Errorf("wait request slot timeout")
 )
 
-// Reqq request queue
+// slotHeap free slot idx, lowest first, so that slots at the
+// tail become free and can be trimmed
+type slotHeap []uint16
+
+func (h slotHeap) Len() int            { return len(h) }
+func (h slotHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h slotHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *slotHeap) Push(x interface{}) { *h = append(*h, x.(uint16)) }
+func (h *slotHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// Reqq request queue, grows on demand up to maxCap, shrinks back
+// to initCap when mostly idle, allocs wait in a bounded queue when
+// all slots are used
 type Reqq struct {
 	owner *Account
+
+	// lock the owner's lock, requests are bound to tunnels under it
+	lock  *sync.Mutex
 	array []*Request
+	idle  slotHeap
+
+	initCap int
+	maxCap  int
 
-	freeSlots []uint16
-	freeHead  int
-	freeTail  int
-	freeCount int
+	// tags of trimmed slots, a regrown slot continues its tag, so
+	// late frames of the old request don't match the new one
+	retiredTags map[uint16]uint16
+
+	waitTimeout time.Duration
+	maxWaiters  int
+	waiters     []chan struct{}
 }
 
-func newReqq(cap int, o *Account) *Reqq {
-	reqq := &Reqq{owner: o}
+func newReqq(initCap int, maxCap int, o *Account) *Reqq {
+	if maxCap > maxReqCap {
+		maxCap = maxReqCap
+	}
 
-	reqq.array = make([]*Request, cap)
-	reqq.freeSlots = make([]uint16, cap)
-	reqq.freeTail = cap
-	reqq.freeHead = 0
-	reqq.freeCount = cap
+	if initCap < 1 || initCap > maxCap {
+		initCap = maxCap
+	}
 
-	for i := 0; i < cap; i++ {
-		reqq.array[i] = newRequest(o, uint16(i))
-		reqq.freeSlots[i] = uint16(i)
+	reqq := &Reqq{
+		owner:       o,
+		lock:        &o.lock,
+		initCap:     initCap,
+		maxCap:      maxCap,
+		retiredTags: make(map[uint16]uint16),
 	}
 
+	reqq.grow(initCap)
+	reqq.updateMetrics()
+
 	return reqq
 }
 
-func (q *Reqq) isEmpty() bool {
-	return q.freeCount == 0
+// grow add slots up to n, lock held
+func (q *Reqq) grow(n int) {
+	for i := len(q.array); i < n; i++ {
+		idx := uint16(i)
+		r := newRequest(q.owner, idx)
+		if tag, ok := q.retiredTags[idx]; ok {
+			r.tag = tag
+			delete(q.retiredTags, idx)
+		}
+
+		r.slotFree = true
+		q.array = append(q.array, r)
+		heap.Push(&q.idle, idx)
+	}
+}
+
+// shrink trim free slots at the tail when less than a quarter
+// is used, lock held
+func (q *Reqq) shrink() {
+	size := len(q.array)
+	used := size - len(q.idle)
+	if size <= q.initCap || used > size/4 {
+		return
+	}
+
+	target := size / 2
+	if target < q.initCap {
+		target = q.initCap
+	}
+
+	n := size
+	for n > target && q.array[n-1].slotFree {
+		n--
+	}
+
+	if n == size {
+		return
+	}
+
+	for _, r := range q.array[n:] {
+		q.retiredTags[r.idx] = r.tag
+	}
+	q.array = q.array[:n]
+
+	free := q.idle[:0]
+	for _, idx := range q.idle {
+		if int(idx) < n {
+			free = append(free, idx)
+		}
+	}
+	q.idle = free
+	heap.Init(&q.idle)
+
+	log.Printf("reqq shrink %d -> %d", size, n)
 }
 
 func (q *Reqq) isFulled() bool {
-	return q.freeCount == len(q.freeSlots)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.idle) == len(q.array)
+}
+
+// counts used and free slots
+func (q *Reqq) counts() (int, int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.array) - len(q.idle), len(q.idle)
+}
+
+// requests snapshot of slots
+func (q *Reqq) requests() []*Request {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return append([]*Request(nil), q.array...)
 }
 
-func (q *Reqq) pop() uint16 {
-	if q.isEmpty() {
-		log.Panic("Reqq is empty, pop failed")
+// tryReserve take a free slot, grow if none, lock held
+func (q *Reqq) tryReserve() (uint16, bool) {
+	if len(q.idle) == 0 && len(q.array) < q.maxCap {
+		n := len(q.array) * 2
+		if n > q.maxCap {
+			n = q.maxCap
+		}
+		q.grow(n)
+		log.Printf("reqq grow to %d", n)
 	}
 
-	if q.freeHead >= len(q.freeSlots) {
-		q.freeHead = 0
+	if len(q.idle) == 0 {
+		return 0, false
 	}
 
-	idx := q.freeSlots[q.freeHead]
-	q.freeHead++
-	q.freeCount--
-	// log.Println("pop:", idx)
-	return idx
+	idx := heap.Pop(&q.idle).(uint16)
+	q.array[idx].slotFree = false
+
+	return idx, true
 }
 
-func (q *Reqq) push(v uint16) {
-	// log.Println("push:", v)
-	if q.isFulled() {
-		log.Panic("Reqq is fulled, push failed")
+// reserve take a free slot, wait in queue if all used, until a slot
+// is freed, waitTimeout passed or ctx done
+func (q *Reqq) reserve(ctx context.Context) (uint16, error) {
+	var timeout <-chan time.Time
+	for {
+		q.lock.Lock()
+		idx, ok := q.tryReserve()
+		if ok {
+			q.updateMetrics()
+			q.lock.Unlock()
+			return idx, nil
+		}
+
+		if q.waitTimeout <= 0 {
+			q.lock.Unlock()
+			return 0, errReqqQueueFull
+		}
+
+		if len(q.waiters) >= q.maxWaiters {
+			q.lock.Unlock()
+			return 0, errReqqQueueFull
+		}
+
+		if timeout == nil {
+			timer := time.NewTimer(q.waitTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		wake := make(chan struct{})
+		q.waiters = append(q.waiters, wake)
+		q.owner.metrics.reqWaiting.Inc()
+		q.lock.Unlock()
+
+		select {
+		case <-wake:
+			q.owner.metrics.reqWaiting.Dec()
+			continue
+		case <-timeout:
+			q.cancelWait(wake)
+			return 0, errReqqTimeout
+		case <-ctx.Done():
+			q.cancelWait(wake)
+			return 0, ctx.Err()
+		}
 	}
+}
 
-	if q.freeTail >= len(q.freeSlots) {
-		q.freeTail = 0
+// cancelWait remove waiter, pass the wake up on if it was woken
+func (q *Reqq) cancelWait(wake chan struct{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.owner.metrics.reqWaiting.Dec()
+	for i, w := range q.waiters {
+		if w == wake {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return
+		}
 	}
 
-	q.freeSlots[q.freeTail] = v
-	q.freeTail++
-	q.freeCount++
+	// already woken, another waiter can take the slot
+	q.wakeOne()
 }
 
-func (q *Reqq) alloc(sreq *socks5.SocksRequest, t *Tunnel) (*Request, error) {
-	if q.isEmpty() {
-		return nil, fmt.Errorf("queue is empty")
+// wakeOne wake the first waiter, lock held
+func (q *Reqq) wakeOne() {
+	if len(q.waiters) == 0 {
+		return
 	}
 
-	idx := q.pop()
-	req := q.array[idx]
-	if req.isUsed {
-		return nil, fmt.Errorf("slots idx point to in-used req")
+	close(q.waiters[0])
+	q.waiters = q.waiters[1:]
+}
+
+// unreserve return a reserved slot not bound to a request
+func (q *Reqq) unreserve(idx uint16) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.array[idx].slotFree = true
+	heap.Push(&q.idle, idx)
+	q.wakeOne()
+	q.updateMetrics()
+}
+
+// bind use reserved slot for sreq on the next tunnel, return the
+// request and its tag, nil if no tunnel takes new requests
+func (q *Reqq) bind(idx uint16, sreq *socks5.SocksRequest, user *policy.User) (*Request, uint16) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	t := q.owner.getTunnel()
+	if t == nil {
+		return nil, 0
 	}
 
+	req := q.array[idx]
 	t.reqMap[idx] = req
-	req.use(sreq, t)
+	req.use(sreq, t, user)
 
-	return req, nil
+	return req, req.tag
 }
 
-func (q *Reqq) free(idx uint16, tag uint16) error {
-	if idx >= uint16(len(q.array)) {
-		return fmt.Errorf("free, idx %d >= len %d", idx, uint16(len(q.array)))
+// bound tunnel and tag of request r, false if r is free
+func (q *Reqq) bound(r *Request) (*Tunnel, uint16, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !r.isUsed || r.tunnel == nil {
+		return nil, 0, false
+	}
+
+	return r.tunnel, r.tag, true
+}
+
+// free request idx:tag, return its access log record
+func (q *Reqq) free(idx uint16, tag uint16, reason string) (log.Fields, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if int(idx) >= len(q.array) {
+		return nil, fmt.Errorf("free, idx %d >= len %d", idx, len(q.array))
 	}
 
 	req := q.array[idx]
 	if !req.isUsed {
-		return fmt.Errorf("free, req %d:%d is in not used", idx, tag)
+		return nil, fmt.Errorf("free, req %d:%d is in not used", idx, tag)
 	}
 
 	if req.tag != tag {
-		return fmt.Errorf("free, req %d:%d is in not match tag %d", idx, tag, req.tag)
+		return nil, fmt.Errorf("free, req %d:%d is in not match tag %d", idx, tag, req.tag)
 	}
 
+	fields := req.accessFields(reason)
+
 	delete(req.tunnel.reqMap, idx)
-	q.push(idx)
 	req.unuse()
+	req.slotFree = true
+	heap.Push(&q.idle, idx)
+
+	if len(q.waiters) > 0 {
+		q.wakeOne()
+	} else {
+		q.shrink()
+	}
+	q.updateMetrics()
 
 	log.Printf("reqq free req %d:%d", idx, tag)
 
-	return nil
+	return fields, nil
+}
+
+// updateMetrics lock held
+func (q *Reqq) updateMetrics() {
+	m := q.owner.metrics
+	m.slotsFree.Set(float64(len(q.idle)))
+	m.slotsUsed.Set(float64(len(q.array) - len(q.idle)))
 }
 
 func (q *Reqq) get(idx uint16, tag uint16) (*Request, error) {
-	if idx >= uint16(len(q.array)) {
-		return nil, fmt.Errorf("get, idx %d >= len %d", idx, uint16(len(q.array)))
-	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
 
+	if int(idx) >= len(q.array) {
+		return nil, fmt.Errorf("get, idx %d >= len %d", idx, len(q.array))
+	}
 	req := q.array[idx]
+
 	if !req.isUsed {
 		return nil, fmt.Errorf("get, req %d:%d is not in used", idx, tag)
 	}
@@ -131,9 +367,9 @@ func (q *Reqq) get(idx uint16, tag uint16) (*Request, error) {
 }
 
 func (q *Reqq) cleanup() {
-	for _, r := range q.array {
-		if r.isUsed {
-			q.free(r.idx, r.tag)
+	for _, r := range q.requests() {
+		if _, tag, ok := q.bound(r); ok {
+			q.free(r.idx, tag, closeShutdown)
 		}
 	}
 }
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"lproxyc/codec"
+	"lproxyc/socks5"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestReqq reqq of an account with one tunnel, nothing is
+// written to the tunnel
+func newTestReqq(t *testing.T, initCap int, maxCap int) *Reqq {
+	a := newAccount("reqq-test", initCap, maxCap, "test", []string{"ws://127.0.0.1:1"}, 1, 1)
+
+	c, _ := net.Pipe()
+	a.tunnels[0] = newTunnel(0, newStreamTransport(c, codec.DefaultMaxFrame), a)
+
+	return a.reqq
+}
+
+// take reserve and bind a slot
+func take(t *testing.T, q *Reqq) (uint16, uint16) {
+	t.Helper()
+
+	idx, err := q.reserve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, _ := newPipe(pipeAddr("local"), pipeAddr("remote"))
+	sreq := &socks5.SocksRequest{
+		Conn:     local,
+		DestAddr: &socks5.AddrSpec{FQDN: "example.com", Port: 80},
+	}
+
+	r, tag := q.bind(idx, sreq, nil)
+	if r == nil {
+		t.Fatal("bind failed")
+	}
+
+	return idx, tag
+}
+
+func slots(q *Reqq) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.array)
+}
+
+func TestReqqGrowShrink(t *testing.T) {
+	q := newTestReqq(t, 4, 64)
+
+	type slot struct{ idx, tag uint16 }
+	var taken []slot
+	for i := 0; i < 20; i++ {
+		idx, tag := take(t, q)
+		taken = append(taken, slot{idx, tag})
+	}
+
+	// doubled on demand, 4 -> 8 -> 16 -> 32
+	if n := slots(q); n != 32 {
+		t.Fatalf("slots:%d, want 32", n)
+	}
+	if used, free := q.counts(); used != 20 || free != 12 {
+		t.Fatalf("used:%d free:%d, want 20 12", used, free)
+	}
+
+	// lowest idx first
+	if taken[0].idx != 0 || taken[19].idx != 19 {
+		t.Fatalf("idx %d..%d, want 0..19", taken[0].idx, taken[19].idx)
+	}
+
+	// tail freed first, halved while mostly idle, down to initCap
+	for i := len(taken) - 1; i >= 0; i-- {
+		if _, err := q.free(taken[i].idx, taken[i].tag, closeClientClosed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := slots(q); n != 4 {
+		t.Fatalf("slots:%d, want initCap 4", n)
+	}
+	if used, free := q.counts(); used != 0 || free != 4 {
+		t.Fatalf("used:%d free:%d, want 0 4", used, free)
+	}
+}
+
+func TestReqqShrinkKeepsUsed(t *testing.T) {
+	q := newTestReqq(t, 2, 64)
+
+	var tags []uint16
+	for i := 0; i < 8; i++ {
+		_, tag := take(t, q)
+		tags = append(tags, tag)
+	}
+
+	// the used slot at the tail keeps the array from shrinking
+	for i := 0; i < 7; i++ {
+		if _, err := q.free(uint16(i), tags[i], closeClientClosed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := slots(q); n != 8 {
+		t.Fatalf("slots:%d, want 8", n)
+	}
+
+	if _, err := q.get(7, tags[7]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReqqRetiredTags(t *testing.T) {
+	q := newTestReqq(t, 1, 4)
+
+	idx0, tag0 := take(t, q)
+	idx1, tag1 := take(t, q)
+	if idx1 != 1 {
+		t.Fatalf("idx:%d, want 1", idx1)
+	}
+
+	q.free(idx1, tag1, closeClientClosed)
+	q.free(idx0, tag0, closeClientClosed)
+	if n := slots(q); n != 1 {
+		t.Fatalf("slots:%d, want 1", n)
+	}
+
+	// regrown slot continues its tag, late frames of the old request
+	// don't match
+	take(t, q)
+	idx, tag := take(t, q)
+	if idx != 1 || tag == tag1 {
+		t.Fatalf("req %d:%d, want idx 1 and tag other than %d", idx, tag, tag1)
+	}
+
+	if _, err := q.get(1, tag1); err == nil {
+		t.Fatal("old tag matched regrown slot")
+	}
+	if _, err := q.get(1, tag); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waiters(q *Reqq) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.waiters)
+}
+
+func TestReqqWaitQueue(t *testing.T) {
+	q := newTestReqq(t, 1, 1)
+	q.waitTimeout = 5 * time.Second
+	q.maxWaiters = 1
+
+	idx, err := q.reserve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := q.reserve(context.Background())
+		got <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for waiters(q) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("reserve not waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// queue is bounded
+	if _, err := q.reserve(context.Background()); err != errReqqQueueFull {
+		t.Fatalf("reserve:%v, want %v", err, errReqqQueueFull)
+	}
+
+	// freed slot goes to the waiter
+	q.unreserve(idx)
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not woken")
+	}
+
+	if n := waiters(q); n != 0 {
+		t.Fatalf("waiters:%d, want 0", n)
+	}
+}
+
+func TestReqqWaitTimeout(t *testing.T) {
+	q := newTestReqq(t, 1, 1)
+	q.maxWaiters = 4
+
+	if _, err := q.reserve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// no wait
+	if _, err := q.reserve(context.Background()); err != errReqqQueueFull {
+		t.Fatalf("reserve:%v, want %v", err, errReqqQueueFull)
+	}
+
+	q.waitTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := q.reserve(context.Background()); err != errReqqTimeout {
+		t.Fatalf("reserve:%v, want %v", err, errReqqTimeout)
+	}
+	if d := time.Since(start); d < q.waitTimeout {
+		t.Fatalf("timed out after %v, want %v", d, q.waitTimeout)
+	}
+
+	// ctx done first
+	q.waitTimeout = 5 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := q.reserve(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("reserve:%v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if n := waiters(q); n != 0 {
+		t.Fatalf("waiters:%d, want 0", n)
+	}
+}
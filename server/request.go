@@ -1,10 +1,14 @@
 package server
 
 import (
+	"fmt"
 	"io"
+	"lproxyc/codec"
+	"lproxyc/policy"
 	"lproxyc/socks5"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,24 +18,56 @@ const (
 	defaultQuotaReport = 20
 )
 
+// localConn local side of a request, accepted tcp conn
+// or in-process pipe conn
+type localConn interface {
+	net.Conn
+	CloseWrite() error
+}
+
 // Request request
 type Request struct {
+	// unix nano and byte counts, accessed atomically, first for
+	// 64-bit alignment
+	lastActive   int64
+	halfClosedAt int64
+	bytesUp      uint64
+	bytesDown    uint64
+
+	// slotFree in reqq free heap, not reserved, owner.lock held
+	slotFree bool
+	idx      uint16
+	owner    *Account
+
+	// isUsed, tag, tunnel and the fields set by use bind the slot
+	// to a request, written holding both owner.lock and writeLock,
+	// read holding either
 	isUsed bool
-	idx    uint16
 	tag    uint16
-	owner  *Account
 	tunnel *Tunnel
 	sreq   *socks5.SocksRequest
 
+	// done closed when request is freed
+	done chan struct{}
+
+	startTime time.Time
+
+	// user policy, nil if not limited
+	user *policy.User
+
+	// writeLock guards conn and the receive state below, held while
+	// writing to conn
 	writeLock sync.Mutex
 	inSending bool
-	conn      *net.TCPConn
+	conn      localConn
 
 	expectedSeq       uint32
 	sendQuotaTick     int
 	lastSeqNo         uint32
 	pendingClosed     bool
 	pendingHalfClosed bool
+	// answered server sent frames of this request
+	answered bool
 
 	queue *RPacketQueue
 }
@@ -43,41 +79,146 @@ func newRequest(o *Account, idx uint16) *Request {
 	return r
 }
 
-func (r *Request) use(sreq *socks5.SocksRequest, t *Tunnel) {
+// use bind slot to sreq on tunnel t, owner.lock held
+func (r *Request) use(sreq *socks5.SocksRequest, t *Tunnel, user *policy.User) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
 	r.pendingClosed = false
 	r.pendingHalfClosed = false
+	r.answered = false
 	r.lastSeqNo = 0
 
 	r.sreq = sreq
-	r.conn = sreq.Conn.(*net.TCPConn)
+	r.conn = sreq.Conn.(localConn)
 
 	r.tunnel = t
 	r.expectedSeq = 0
 
+	r.startTime = time.Now()
+	atomic.StoreUint64(&r.bytesUp, 0)
+	atomic.StoreUint64(&r.bytesDown, 0)
+
+	atomic.StoreInt64(&r.lastActive, r.startTime.UnixNano())
+	atomic.StoreInt64(&r.halfClosedAt, 0)
+	r.done = make(chan struct{})
+	r.user = user
+
 	r.tag++
 	r.isUsed = true
 }
 
+// unuse release the slot, owner.lock held
 func (r *Request) unuse() {
+	// unblock a write in progress, it holds writeLock
+	if r.conn != nil {
+		r.conn.Close()
+	}
+
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
 	r.tunnel = nil
 	r.sreq = nil
 	r.tag++
 	r.isUsed = false
+	r.owner.metrics.reorderDepth.Add(-float64(r.queue.size()))
 	r.queue.clear()
 
-	if r.conn != nil {
-		r.conn.Close()
-		r.conn = nil
+	if r.user != nil {
+		r.user.Release()
+		r.user = nil
+	}
+
+	r.conn = nil
+
+	close(r.done)
+}
+
+// valid request is still the one of tag, writeLock held
+func (r *Request) valid(tag uint16) bool {
+	return r.isUsed && r.tag == tag
+}
+
+// isPending created on tunnel, but not answered by server and nothing
+// claimed to send, so it can be created again on another tunnel, both
+// owner.lock and writeLock held
+func (r *Request) isPending() bool {
+	return r.isUsed && !r.answered && atomic.LoadUint64(&r.bytesUp) == 0 &&
+		atomic.LoadInt64(&r.halfClosedAt) == 0
+}
+
+// claim tunnel of request tag to send n bytes read or the end of
+// read, counted under owner.lock, so failover doesn't move a request
+// with frames in flight, false if request is freed
+func (r *Request) claim(tag uint16, n int, end bool) (*Tunnel, bool) {
+	r.owner.lock.Lock()
+	defer r.owner.lock.Unlock()
+
+	if !r.isUsed || r.tag != tag || r.tunnel == nil {
+		return nil, false
+	}
+
+	atomic.AddUint64(&r.bytesUp, uint64(n))
+	if end {
+		r.halfClose()
 	}
+
+	return r.tunnel, true
 }
 
-func (r *Request) onServerFinished(lastSeqNo uint32) {
+// touch data passed, not idle
+func (r *Request) touch() {
+	atomic.StoreInt64(&r.lastActive, time.Now().UnixNano())
+}
+
+// halfClose one side finished, linger starts at the first
+func (r *Request) halfClose() {
+	atomic.CompareAndSwapInt64(&r.halfClosedAt, 0, time.Now().UnixNano())
+}
+
+// expired close reason if idle or half closed longer than allowed,
+// empty if not, zero durations are not checked, linger counts from
+// the half close or the last data after it, so a half closed request
+// still moving data is kept
+func (r *Request) expired(now time.Time, idle time.Duration, linger time.Duration) string {
+	if linger > 0 {
+		at := atomic.LoadInt64(&r.halfClosedAt)
+		if active := atomic.LoadInt64(&r.lastActive); at != 0 && active > at {
+			at = active
+		}
+
+		if at != 0 && now.Sub(time.Unix(0, at)) > linger {
+			return closeLinger
+		}
+	}
+
+	if idle > 0 {
+		at := atomic.LoadInt64(&r.lastActive)
+		if now.Sub(time.Unix(0, at)) > idle {
+			return closeIdle
+		}
+	}
+
+	return ""
+}
+
+func (r *Request) onServerFinished(tag uint16, lastSeqNo uint32) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	if !r.valid(tag) {
+		return
+	}
+
+	r.answered = true
+	r.halfClose()
 	r.lastSeqNo = lastSeqNo
 	if r.expectedSeq < lastSeqNo {
 		// we has more data to recv
 		r.pendingHalfClosed = true
 		log.Printf("req %d:%d onServerFinished pending, last:%d",
-			r.idx, r.tag, lastSeqNo)
+			r.idx, tag, lastSeqNo)
 	} else {
 		if r.conn != nil {
 			r.conn.CloseWrite()
@@ -85,101 +226,163 @@ func (r *Request) onServerFinished(lastSeqNo uint32) {
 	}
 }
 
-func (r *Request) onServerClosed(lastSeqNo uint32) bool {
+// onServerClosed true if all data is sent and request can be freed
+func (r *Request) onServerClosed(tag uint16, lastSeqNo uint32) bool {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	if !r.valid(tag) {
+		return false
+	}
+
+	r.answered = true
 	r.lastSeqNo = lastSeqNo
 	if r.expectedSeq < lastSeqNo {
 		// we has more data to recv
 		r.pendingClosed = true
 		log.Printf("req %d:%d onServerClosed pending, last:%d",
-			r.idx, r.tag, lastSeqNo)
+			r.idx, tag, lastSeqNo)
 		return false
 	}
 
 	return true
 }
 
-func (r *Request) onClientData(seq uint32, data []byte) {
-	if r.conn != nil {
-		// queue to heap
-		r.queue.append(seq, data)
+// onClientData send or hold data of seq, return quota reports due
+// and close reason if request should be freed, both are done by
+// caller without writeLock
+func (r *Request) onClientData(tag uint16, seq uint32, data []byte) (int, string) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
 
-		// loop heap
-		r.doSend()
+	if !r.valid(tag) || r.conn == nil {
+		return 0, ""
+	}
 
-		if r.pendingHalfClosed {
-			log.Printf("req %d:%d has pendingHalfClosed, expected:%d, last:%d",
-				r.idx, r.tag, r.expectedSeq, r.lastSeqNo)
-			if r.expectedSeq >= r.lastSeqNo && r.conn != nil {
-				r.conn.CloseWrite()
-			}
+	r.answered = true
+
+	reports := 0
+	if seq == r.expectedSeq && r.queue.size() == 0 && !r.inSending {
+		// in order, send from the message buffer directly
+		if !r.sendData(data, &reports) {
+			return reports, closeClientClosed
 		}
+	} else {
+		// data is in the tunnel read buffer, copy it to hold
+		buf := getBuffer(len(data))
+		copy(*buf, data)
+		r.queue.append(seq, buf)
+		r.owner.metrics.reorderDepth.Inc()
+	}
 
-		if r.pendingClosed {
-			log.Printf("req %d:%d has pendingClosed, expected:%d, last:%d",
-				r.idx, r.tag, r.expectedSeq, r.lastSeqNo)
-			if r.expectedSeq >= r.lastSeqNo && r.tunnel != nil {
-				r.tunnel.freeRequest(r.idx, r.tag)
-			}
+	// loop heap
+	if !r.doSend(&reports) {
+		return reports, closeClientClosed
+	}
+
+	if r.pendingHalfClosed {
+		log.Printf("req %d:%d has pendingHalfClosed, expected:%d, last:%d",
+			r.idx, tag, r.expectedSeq, r.lastSeqNo)
+		if r.expectedSeq >= r.lastSeqNo && r.conn != nil {
+			r.conn.CloseWrite()
+		}
+	}
+
+	if r.pendingClosed {
+		log.Printf("req %d:%d has pendingClosed, expected:%d, last:%d",
+			r.idx, tag, r.expectedSeq, r.lastSeqNo)
+		if r.expectedSeq >= r.lastSeqNo {
+			return reports, closeServerClosed
 		}
 	}
+
+	return reports, ""
 }
 
-func (r *Request) proxy() {
-	// log.Println("proxy ...")
-	c := r.conn
-	if c == nil {
-		log.Printf("request %d:%d failed, conn is nil",
-			r.idx, r.tag)
+// proxy read local conn, send data to the tunnel of request tag
+// until it is freed
+func (r *Request) proxy(tag uint16) {
+	a := r.owner
+	a.lock.Lock()
+	if !r.valid(tag) {
+		a.lock.Unlock()
+		log.Printf("request %d:%d failed, req is not used", r.idx, tag)
 		return
 	}
+	c, done, user := r.conn, r.done, r.user
+	t, dest := r.tunnel, r.sreq.DestAddr
+	a.lock.Unlock()
 
 	defer c.Close()
 
-	r.tunnel.sendRequestCreate(r)
+	t.sendRequestCreate(r.idx, tag, dest)
 
-	if !r.isUsed {
-		log.Printf("request %d:%d failed, req is not used",
-			r.idx, r.tag)
-		return
-	}
+	// read straight into a frame, header space reserved before data
+	cs := newChunkSizer(r.owner.chunkSize, r.owner.adaptiveChunk)
+	frame := getBuffer(codec.HeaderSize + cs.size)
+	defer func() {
+		putBuffer(frame)
+	}()
 
-	buf := make([]byte, 4096)
 	for {
-		n, err := c.Read(buf)
+		n, err := c.Read((*frame)[codec.HeaderSize:])
 
-		if !r.isUsed {
+		t, ok := r.claim(tag, n, err != nil || n == 0)
+		if !ok {
 			// request is free!
 			log.Printf("request %d:%d read, request is free, discard data:%d",
-				r.idx, r.tag, n)
-			break
-		}
-
-		t := r.tunnel
-		if t == nil {
-			log.Printf("request %d:%d read read, no tunnel valid, discard data:%d",
-				r.idx, r.tag, n)
+				r.idx, tag, n)
 			break
 		}
 
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("request %d:%d read, client half close", r.idx, r.tag)
-				t.onRequestHalfClosed(r)
+				log.Printf("request %d:%d read, client half close", r.idx, tag)
+				t.onRequestHalfClosed(r, tag)
+
+				// keep conn for server data until request is freed,
+				// by server close or linger timeout
+				<-done
 			} else {
-				log.Printf("request %d:%d  read failed:%v", r.idx, r.tag, err)
-				t.onRequestTerminate(r)
+				log.Printf("request %d:%d  read failed:%v", r.idx, tag, err)
+				t.onRequestTerminate(r, tag)
 			}
 
 			break
 		}
 
 		if n == 0 {
-			log.Printf("request %d:%d read, server half close", r.idx, r.tag)
-			t.onRequestHalfClosed(r)
+			log.Printf("request %d:%d read, server half close", r.idx, tag)
+			t.onRequestHalfClosed(r, tag)
 			break
 		}
 
-		t.onRequestData(r, buf[:n])
+		if user != nil {
+			if user.Exceeded() {
+				log.Printf("request %d:%d monthly quota exceeded", r.idx, tag)
+				t.onRequestTerminate(r, tag)
+				break
+			}
+
+			if d := user.AddUp(n); d > 0 {
+				timer := time.NewTimer(d)
+				select {
+				case <-timer.C:
+				case <-done:
+					// freed while throttled, by server or shutdown
+					timer.Stop()
+					log.Printf("request %d:%d freed while throttled", r.idx, tag)
+					return
+				}
+			}
+		}
+
+		t.onRequestData(r, tag, (*frame)[:codec.HeaderSize+n])
+
+		if cs.update(n) {
+			putBuffer(frame)
+			frame = getBuffer(codec.HeaderSize + cs.size)
+		}
 	}
 }
 
@@ -205,13 +408,16 @@ func writeAll(buf []byte, nc net.Conn) error {
 	return nil
 }
 
-func (r *Request) doSend() {
+// doSend send queued data in order, false if request is terminated,
+// writeLock held
+func (r *Request) doSend(reports *int) bool {
 	if r.inSending {
-		return
+		return true
 	}
 
 	// don't return without reset r.inSending
 	r.inSending = true
+	ok := true
 
 	for {
 		if r.queue.size() < 1 {
@@ -228,38 +434,94 @@ func (r *Request) doSend() {
 		// only send expected
 		if header.seqNo == r.expectedSeq {
 			header = r.queue.pop()
-			err := r.sendto(header.data)
-			// move to next seq
-			r.expectedSeq++
-			r.sendQuotaTick++
-
-			if err != nil {
-				log.Printf("request %d:%d sendto failed. force close:%v",
-					r.idx, r.tag, err)
-
-				// force free
-				if r.tunnel != nil {
-					r.tunnel.onRequestTerminate(r)
-				}
-
+			r.owner.metrics.reorderDepth.Dec()
+			ok = r.sendData(*header.data, reports)
+			putBuffer(header.data)
+			if !ok {
 				break
 			}
-
-			if r.sendQuotaTick == defaultQuotaReport {
-				r.sendQuotaTick = 0
-				r.tunnel.onQuotaReport(r, defaultQuotaReport)
-			}
 		} else {
 			break
 		}
 	}
 
 	r.inSending = false
+
+	return ok
 }
 
-func (r *Request) sendto(buf []byte) error {
+// sendData send next expected data to local conn, count a quota
+// report every quotaReport packets, false if request is terminated,
+// writeLock held
+func (r *Request) sendData(data []byte, reports *int) bool {
+	err := r.sendto(data)
+	// move to next seq
+	r.expectedSeq++
+	r.sendQuotaTick++
+
+	if err != nil {
+		log.Printf("request %d:%d sendto failed. force close:%v",
+			r.idx, r.tag, err)
+
+		return false
+	}
+
+	if r.sendQuotaTick >= r.owner.quotaReport {
+		r.sendQuotaTick = 0
+		*reports++
+	}
+
+	return true
+}
+
+// reportQuota report quota of request tag to server on t, held
+// while user is over download rate
+func (r *Request) reportQuota(t *Tunnel, tag uint16) {
+	quota := uint16(r.owner.quotaReport)
+
 	r.writeLock.Lock()
-	defer r.writeLock.Unlock()
+	ok, user := r.valid(tag), r.user
+	r.writeLock.Unlock()
+	if !ok {
+		return
+	}
+
+	var delay time.Duration
+	if user != nil {
+		delay = user.DownDelay()
+	}
+
+	if delay == 0 {
+		t.onQuotaReport(r, tag, quota)
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+		r.writeLock.Lock()
+		ok := r.valid(tag) && r.tunnel == t
+		r.writeLock.Unlock()
+
+		if ok {
+			t.onQuotaReport(r, tag, quota)
+		}
+	})
+}
+
+// sendto write data to conn, writeLock held
+func (r *Request) sendto(buf []byte) error {
+	if r.conn == nil {
+		return fmt.Errorf("request is free")
+	}
+
+	if u := r.user; u != nil {
+		if u.Exceeded() {
+			return fmt.Errorf("monthly quota exceeded")
+		}
+		u.AddDown(len(buf))
+	}
 
+	r.touch()
+	atomic.AddUint64(&r.bytesDown, uint64(len(buf)))
+	r.owner.metrics.bytesDown.Add(float64(len(buf)))
 	return writeAll(buf, r.conn)
 }
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExpiredLinger(t *testing.T) {
+	now := time.Now()
+	linger := 30 * time.Second
+	r := &Request{}
+
+	atomic.StoreInt64(&r.lastActive, now.Add(-time.Minute).UnixNano())
+	if reason := r.expired(now, 0, linger); reason != "" {
+		t.Fatalf("not half closed, expired:%s", reason)
+	}
+
+	// half closed long ago, data still passing the other way
+	atomic.StoreInt64(&r.halfClosedAt, now.Add(-time.Minute).UnixNano())
+	atomic.StoreInt64(&r.lastActive, now.Add(-time.Second).UnixNano())
+	if reason := r.expired(now, 0, linger); reason != "" {
+		t.Fatalf("active after half close, expired:%s", reason)
+	}
+
+	atomic.StoreInt64(&r.lastActive, now.Add(-2*linger).UnixNano())
+	if reason := r.expired(now, 0, linger); reason != closeLinger {
+		t.Fatalf("expired:%q, want %q", reason, closeLinger)
+	}
+}
+
+// TestFailoverClaimed a request with data read is not moved to
+// another tunnel, its frames went to the old one
+func TestFailoverClaimed(t *testing.T) {
+	c, ms := startTestClient(t, Config{TunnelCap: 2})
+	defer ms.Close()
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := c.DialContext(ctx, "tcp", "echo.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	q := c.account.reqq
+	var r *Request
+	for _, req := range q.requests() {
+		if _, _, ok := q.bound(req); ok {
+			r = req
+		}
+	}
+	if r == nil {
+		t.Fatal("no request bound")
+	}
+
+	tun, tag, _ := q.bound(r)
+	if !tun.failover(r, tag) {
+		t.Fatal("pending request not moved")
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&r.bytesUp) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("data not read")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tun, tag, _ = q.bound(r)
+	if tun.failover(r, tag) {
+		t.Fatal("request with data moved")
+	}
+}
+
+// BenchmarkRequestData echo through a request, local reads go by
+// proxy and onRequestData to the tunnel, server data back by
+// onClientData
+func BenchmarkRequestData(b *testing.B) {
+	c, ms := startTestClient(b, Config{})
+	defer ms.Close()
+	defer c.Close()
+
+	conn, err := c.DialContext(context.Background(), "tcp", "echo.test:80")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, 16*1024)
+	buf := make([]byte, len(data))
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(data); err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
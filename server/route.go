@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"lproxyc/guard"
+	"lproxyc/socks5"
+	"net"
+)
+
+const (
+	// defaultAccountName name of the account built from Config.URL and Config.UUID
+	defaultAccountName = "default"
+)
+
+// AccountConfig extra upstream account, requests are routed to it
+// by Routes
+type AccountConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Endpoints more urls raced with URL
+	Endpoints []string `json:"endpoints"`
+	UUID      string   `json:"uuid"`
+	// TunnelCap, TunnelMax and ReqCap, zero to use the client's
+	TunnelCap int `json:"tunnel_cap"`
+	TunnelMax int `json:"tunnel_max"`
+	ReqCap    int `json:"req_cap"`
+}
+
+// Route send requests matching Users and Sources to Account, an
+// empty list matches everything, routes are checked in order and
+// requests matching none go to the default account
+type Route struct {
+	Users   []string `json:"users"`
+	Sources []string `json:"sources"`
+	Account string   `json:"account"`
+}
+
+// route compiled Route
+type route struct {
+	users   map[string]bool
+	sources []*net.IPNet
+	account *Account
+}
+
+// router socks5 request handler, pick account by username or
+// source address
+type router struct {
+	def    *Account
+	routes []*route
+}
+
+func newRouter(def *Account, byName map[string]*Account, routes []Route) (*router, error) {
+	rt := &router{def: def}
+	for i, r := range routes {
+		a, ok := byName[r.Account]
+		if !ok {
+			return nil, fmt.Errorf("route %d: unknown account %q", i, r.Account)
+		}
+
+		cr := &route{account: a}
+		if len(r.Users) > 0 {
+			cr.users = make(map[string]bool, len(r.Users))
+			for _, u := range r.Users {
+				cr.users[u] = true
+			}
+		}
+
+		for _, s := range r.Sources {
+			n, err := guard.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: invalid source: %v", i, err)
+			}
+			cr.sources = append(cr.sources, n)
+		}
+
+		rt.routes = append(rt.routes, cr)
+	}
+
+	return rt, nil
+}
+
+func (r *route) match(user string, src net.IP) bool {
+	if r.users != nil && !r.users[user] {
+		return false
+	}
+
+	if len(r.sources) == 0 {
+		return true
+	}
+
+	if src == nil {
+		return false
+	}
+
+	for _, n := range r.sources {
+		if n.Contains(src) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pick account for request
+func (rt *router) pick(req *socks5.SocksRequest) *Account {
+	if len(rt.routes) == 0 {
+		return rt.def
+	}
+
+	var src net.IP
+	if addr, ok := req.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		src = addr.IP
+	}
+
+	user := req.Username()
+	for _, r := range rt.routes {
+		if r.match(user, src) {
+			return r.account
+		}
+	}
+
+	return rt.def
+}
+
+// HandleRequest implement socks5.RequestHandler
+func (rt *router) HandleRequest(req *socks5.SocksRequest) error {
+	return rt.pick(req).HandleRequest(req)
+}
+
+// Allocate implement socks5.Allocator
+func (rt *router) Allocate(req *socks5.SocksRequest) (func(), error) {
+	return rt.pick(req).Allocate(req)
+}
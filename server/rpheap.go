@@ -7,7 +7,8 @@ import (
 // RPacket request packet
 type RPacket struct {
 	seqNo uint32
-	data  []byte
+	// data pooled buffer, returned to pool after sent or cleared
+	data *[]byte
 }
 
 // An IntHeap is a min-heap of ints.
@@ -46,6 +47,10 @@ func newRPacketQueue() *RPacketQueue {
 }
 
 func (q *RPacketQueue) clear() {
+	for _, rp := range q.h {
+		putBuffer(rp.data)
+	}
+
 	q.h = make([]*RPacket, 0, 16)
 }
 
@@ -53,7 +58,7 @@ func (q *RPacketQueue) size() int {
 	return q.h.Len()
 }
 
-func (q *RPacketQueue) append(seq uint32, data []byte) {
+func (q *RPacketQueue) append(seq uint32, data *[]byte) {
 	rp := &RPacket{
 		seqNo: seq,
 		data:  data,
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultScaleRequests = 64
+	defaultScaleBacklog  = 4
+	defaultScaleCooldown = 60 * time.Second
+
+	scaleInterval = time.Second
+)
+
+// tunnelScale tunnel count of an account, between min and max, one
+// tunnel more than the load needs is kept as a pre-warmed standby
+type tunnelScale struct {
+	min int
+	max int
+	// requests average requests per tunnel to open more tunnels
+	requests int
+	// backlog average writes waiting per tunnel to open more tunnels
+	backlog int
+	// cooldown surplus tunnels are closed after it
+	cooldown time.Duration
+}
+
+// want tunnels for used requests and write backlog of active tunnels
+func (s *tunnelScale) want(used int, backlog int, active int) int {
+	n := (used+s.requests-1)/s.requests + 1
+	if active > 0 && backlog > s.backlog*active && n <= active {
+		n = active + 1
+	}
+
+	if n < s.min {
+		n = s.min
+	}
+	if n > s.max {
+		n = s.max
+	}
+
+	return n
+}
+
+// startRunner run tunnel of slot idx, slotLock held
+func (a *Account) startRunner(idx int) {
+	a.running[idx] = true
+	a.retiring[idx] = false
+	a.metrics.tunnelsDown.Inc()
+
+	a.runWG.Add(1)
+	go func() {
+		defer a.runWG.Done()
+		tunnelRunner(a.runCtx, a, idx)
+	}()
+}
+
+// retired slot idx is scaled down, its runner should exit
+func (a *Account) retired(idx int) bool {
+	a.slotLock.Lock()
+	defer a.slotLock.Unlock()
+
+	return a.retiring[idx]
+}
+
+// runnerExit runner of slot idx exited
+func (a *Account) runnerExit(idx int) {
+	a.slotLock.Lock()
+	a.running[idx] = false
+	a.retiring[idx] = false
+	a.slotLock.Unlock()
+
+	a.metrics.tunnelsDown.Dec()
+}
+
+// slotRunning tunnel of slot idx is running, connected or not
+func (a *Account) slotRunning(idx int) bool {
+	a.slotLock.Lock()
+	defer a.slotLock.Unlock()
+
+	return a.running[idx]
+}
+
+func tunnelScaler(ctx context.Context, a *Account) {
+	for sleepContext(ctx, scaleInterval) {
+		if a.isClosed() {
+			return
+		}
+
+		a.rescale(time.Now())
+	}
+}
+
+// rescale open tunnels at once when load grows, close one surplus
+// tunnel per cooldown when it drops
+func (a *Account) rescale(now time.Time) {
+	a.slotLock.Lock()
+	defer a.slotLock.Unlock()
+
+	active, backlog := 0, 0
+	var retired []*Tunnel
+	a.lock.Lock()
+	for i, t := range a.tunnels {
+		if !a.running[i] {
+			continue
+		}
+
+		if a.retiring[i] {
+			// drained, close it, runner exits
+			if t != nil && len(t.reqMap) == 0 && !t.reconnectNow {
+				retired = append(retired, t)
+			}
+			continue
+		}
+
+		active++
+		if t != nil {
+			backlog += int(atomic.LoadInt32(&t.backlog))
+		}
+	}
+	a.lock.Unlock()
+
+	for _, t := range retired {
+		log.Printf("tunnel %d retired, close", t.id)
+		t.reconnect()
+	}
+
+	used, _ := a.reqq.counts()
+	want := a.scale.want(used, backlog, active)
+
+	switch {
+	case want > active:
+		a.surplusSince = time.Time{}
+		log.Printf("tunnels scale up %d -> %d, requests:%d backlog:%d",
+			active, want, used, backlog)
+		a.scaleUp(want - active)
+	case want < active:
+		if a.surplusSince.IsZero() {
+			a.surplusSince = now
+			return
+		}
+
+		if now.Sub(a.surplusSince) >= a.scale.cooldown {
+			log.Printf("tunnels scale down %d -> %d", active, active-1)
+			a.scaleDown()
+			a.surplusSince = now
+		}
+	default:
+		a.surplusSince = time.Time{}
+	}
+}
+
+// scaleUp take back retiring tunnels first, then open new ones,
+// slotLock held
+func (a *Account) scaleUp(n int) {
+	a.lock.Lock()
+	for i, t := range a.tunnels {
+		if n == 0 {
+			break
+		}
+
+		if a.running[i] && a.retiring[i] && t != nil && !t.reconnectNow {
+			a.retiring[i] = false
+			t.draining = false
+			n--
+		}
+	}
+	a.lock.Unlock()
+
+	for i := range a.tunnels {
+		if n == 0 {
+			return
+		}
+
+		if !a.running[i] {
+			a.startRunner(i)
+			n--
+		}
+	}
+}
+
+// scaleDown retire the active tunnel with fewest requests, it takes
+// no new requests and is closed when drained, slotLock held
+func (a *Account) scaleDown() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	idx, fewest := -1, 0
+	for i, t := range a.tunnels {
+		if !a.running[i] || a.retiring[i] {
+			continue
+		}
+
+		n := 0
+		if t != nil {
+			n = len(t.reqMap)
+		}
+
+		if idx < 0 || n < fewest {
+			idx, fewest = i, n
+		}
+	}
+
+	if idx < 0 {
+		return
+	}
+
+	a.retiring[idx] = true
+	if t := a.tunnels[idx]; t != nil {
+		t.draining = true
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestScaleWant(t *testing.T) {
+	s := &tunnelScale{min: 2, max: 5, requests: 10, backlog: 4}
+
+	cases := []struct {
+		used, backlog, active int
+		want                  int
+	}{
+		// idle, at min
+		{0, 0, 2, 2},
+		// load of one tunnel, one standby
+		{5, 0, 2, 2},
+		{25, 0, 3, 4},
+		// capped at max
+		{1000, 0, 5, 5},
+		// write backlog opens one more
+		{15, 20, 3, 4},
+		{15, 12, 3, 3},
+	}
+
+	for _, c := range cases {
+		if got := s.want(c.used, c.backlog, c.active); got != c.want {
+			t.Fatalf("want(%d, %d, %d):%d, want %d",
+				c.used, c.backlog, c.active, got, c.want)
+		}
+	}
+}
+
+func waitSessions(t *testing.T, n func() int, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for n() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("sessions:%d, want %d", n(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRescale(t *testing.T) {
+	c, ms := startTestClient(t, Config{
+		TunnelCap:           1,
+		TunnelMax:           3,
+		TunnelScaleRequests: 2,
+		TunnelCooldown:      time.Hour,
+	})
+	defer ms.Close()
+	defer c.Close()
+
+	a := c.account
+
+	// idle, min tunnel only
+	a.rescale(time.Now())
+	waitSessions(t, ms.Sessions, 1)
+
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	dial := func(n int) {
+		for i := 0; i < n; i++ {
+			conn, err := c.DialContext(context.Background(), "tcp", "echo.test:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, conn)
+		}
+	}
+
+	// one request, its tunnel and a pre-warmed standby
+	dial(1)
+	a.rescale(time.Now())
+	waitSessions(t, ms.Sessions, 2)
+
+	// load over max is capped
+	dial(9)
+	a.rescale(time.Now())
+	waitSessions(t, ms.Sessions, 3)
+	a.rescale(time.Now())
+	waitSessions(t, ms.Sessions, 3)
+
+	// back to one request
+	for _, conn := range conns[1:] {
+		conn.Close()
+	}
+	conns = conns[:1]
+	waitUsed(t, a, 1)
+
+	// surplus is kept within cooldown
+	now := time.Now()
+	a.rescale(now)
+	a.rescale(now.Add(time.Minute))
+	if n := ms.Sessions(); n != 3 {
+		t.Fatalf("sessions:%d within cooldown, want 3", n)
+	}
+
+	// one idle tunnel retired per cooldown, closed once drained
+	a.rescale(now.Add(time.Hour))
+	a.rescale(now.Add(time.Hour))
+	waitSessions(t, ms.Sessions, 2)
+
+	// the standby is kept
+	a.rescale(now.Add(3 * time.Hour))
+	a.rescale(now.Add(5 * time.Hour))
+	a.rescale(now.Add(5 * time.Hour))
+	time.Sleep(100 * time.Millisecond)
+	if n := ms.Sessions(); n != 2 {
+		t.Fatalf("sessions:%d, want request tunnel and standby 2", n)
+	}
+
+	// idle, down to min
+	conns[0].Close()
+	conns = nil
+	waitUsed(t, a, 0)
+
+	a.rescale(now.Add(7 * time.Hour))
+	a.rescale(now.Add(9 * time.Hour))
+	a.rescale(now.Add(9 * time.Hour))
+	waitSessions(t, ms.Sessions, 1)
+}
+
+func waitUsed(t *testing.T, a *Account, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		used, _ := a.reqq.counts()
+		if used == want {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("requests used:%d, want %d", used, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
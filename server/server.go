@@ -1,26 +1,493 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 
+	"lproxyc/codec"
+	"lproxyc/fakeip"
+	"lproxyc/guard"
+	"lproxyc/policy"
+	"lproxyc/rewrite"
 	"lproxyc/socks5"
 )
 
-var (
-	account Account
-)
+// Config client config
+type Config struct {
+	// ListenAddr socks5 listen address, with Credentials, AuthLimiter,
+	// Guard and HandshakeTimeout, empty if only Listeners are used
+	ListenAddr string
+	// URL server url, scheme selects the transport
+	URL string
+	// Endpoints more urls of the same server, e.g. other hostnames,
+	// ips or a CDN, dialed in parallel with URL, the fastest is kept
+	Endpoints []string
+	UUID      string
+	// TunnelCap tunnels to build, the min tunnel count if TunnelMax
+	// is larger
+	TunnelCap int
+	// TunnelMax if larger than TunnelCap, tunnels are opened on load
+	// up to it, with one standby more than the load needs, and closed
+	// after TunnelCooldown when the load drops
+	TunnelMax int
+	// TunnelScaleRequests average requests per tunnel to open more
+	// tunnels, 0 for 64
+	TunnelScaleRequests int
+	// TunnelScaleBacklog average writes waiting per tunnel to open
+	// more tunnels, 0 for 4
+	TunnelScaleBacklog int
+	// TunnelCooldown surplus tunnels are closed after it, 0 for 60s
+	TunnelCooldown time.Duration
+	// ReqCap max concurrent requests per account, at most 65535
+	ReqCap int
+	// ReqInit request slots allocated at start, the table grows on
+	// demand up to ReqCap and shrinks back when idle, 0 for default
+	ReqInit int
+	// ReqWait time a request waits for a free slot when all ReqCap
+	// slots are used, 0 to fail at once
+	ReqWait time.Duration
+	// ReqWaitQueue max requests waiting for a slot, 0 for ReqCap
+	ReqWaitQueue int
+	// Grace time to wait requests finish when close
+	Grace time.Duration
+	// FakeIP if set, connects to fake ips are sent to server as
+	// the mapped domain
+	FakeIP *fakeip.Pool
+	// Rewriter if set, socks5 destinations are rewritten before
+	// requests are created
+	Rewriter socks5.AddressRewriter
+	// Credentials if set, socks5 username/password auth is required
+	Credentials socks5.CredentialStore
+	// AuthLimiter if set, limits failed authentications per source ip
+	AuthLimiter *socks5.AuthLimiter
+	// Policy if set, per-user limits are enforced on socks5 requests
+	Policy *policy.Manager
+	// Accounts extra upstream accounts, the account of URL and UUID
+	// is named "default"
+	Accounts []AccountConfig
+	// Routes choose account by socks5 username or source address
+	Routes []Route
+	// Guard if set, filters and limits accepted connections
+	Guard *guard.Guard
+	// HandshakeTimeout if set, socks5 connections must send their
+	// request within it
+	HandshakeTimeout time.Duration
+	// Listeners extra listeners with their own protocol and settings
+	Listeners []ListenerConfig
+	// IdleTimeout if set, requests without data for it are closed
+	IdleTimeout time.Duration
+	// LingerTimeout if set, requests half closed by either side are
+	// closed when no data passed for it since the half close
+	LingerTimeout time.Duration
+	// KeepAlive tcp keepalive period of accepted connections, 0 for
+	// the system default, negative to disable
+	KeepAlive time.Duration
+	// ChunkSize max bytes read from a local connection per data
+	// frame, 512 to 262144, 0 for 4096
+	ChunkSize int
+	// AdaptiveChunk if set, chunk size starts at 4096 and grows up to
+	// ChunkSize while a request transfers in bulk, ChunkSize must be
+	// over 4096
+	AdaptiveChunk bool
+	// QuotaReport packets received per quota report to server, must
+	// be less than the server send window, 0 for 20
+	QuotaReport int
+	// WSReadBufferSize, WSWriteBufferSize websocket io buffer sizes,
+	// 0 for 4096
+	WSReadBufferSize  int
+	WSWriteBufferSize int
+	// MaxFrameSize max tunnel message size in both directions, the
+	// server may lower it, larger server messages close the tunnel,
+	// 0 for 1MB, tcp/tls transports don't negotiate, it can't be over
+	// 1MB for them
+	MaxFrameSize int
+	// PingInterval tunnel ping interval, 0 for 30s
+	PingInterval time.Duration
+	// PingTimeout tunnel writes time out after it, a tunnel without
+	// inbound frames for PingInterval+PingTimeout is dead, pending
+	// requests move to other tunnels, 0 for 10s
+	PingTimeout time.Duration
+}
+
+// Client accept local proxy connections, proxy requests through tunnels
+type Client struct {
+	cfg       Config
+	account   *Account
+	accounts  []*Account
+	listeners []*listener
+	// admins admin api listeners, closed with the client
+	admins []net.Listener
+
+	lock    sync.Mutex
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	done    chan struct{}
+	started bool
+	closed  bool
+	err     error
+}
+
+// NewClient create client, call Start to run it
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.URL == "" || cfg.UUID == "" {
+		return nil, fmt.Errorf("url and uuid are required")
+	}
+
+	if cfg.TunnelCap < 1 || cfg.ReqCap < 1 || cfg.ReqCap > maxReqCap {
+		return nil, fmt.Errorf("invalid tunnel capacity %d or request capacity %d",
+			cfg.TunnelCap, cfg.ReqCap)
+	}
+
+	if cfg.ReqInit < 1 {
+		cfg.ReqInit = defaultReqInit
+	}
+
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = defaultChunkSize
+	}
+	if cfg.ChunkSize < minChunkSize || cfg.ChunkSize > maxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d", cfg.ChunkSize)
+	}
+	if cfg.AdaptiveChunk && cfg.ChunkSize <= adaptiveStartChunk {
+		return nil, fmt.Errorf("adaptive chunk needs chunk size over %d, got %d",
+			adaptiveStartChunk, cfg.ChunkSize)
+	}
+
+	if cfg.MaxFrameSize == 0 {
+		cfg.MaxFrameSize = codec.DefaultMaxFrame
+	}
+	if cfg.MaxFrameSize < codec.MinMaxFrame {
+		return nil, fmt.Errorf("invalid max frame size %d", cfg.MaxFrameSize)
+	}
+
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = defaultPingInterval
+	}
+	if cfg.PingTimeout <= 0 {
+		cfg.PingTimeout = defaultPingTimeout
+	}
+
+	if cfg.QuotaReport == 0 {
+		cfg.QuotaReport = defaultQuotaReport
+	}
+	if cfg.QuotaReport < 1 || cfg.QuotaReport > 65535 {
+		return nil, fmt.Errorf("invalid quota report interval %d", cfg.QuotaReport)
+	}
+
+	c := &Client{
+		cfg:  cfg,
+		done: make(chan struct{}),
+	}
+
+	if cfg.TunnelScaleRequests < 1 {
+		cfg.TunnelScaleRequests = defaultScaleRequests
+	}
+	if cfg.TunnelScaleBacklog < 1 {
+		cfg.TunnelScaleBacklog = defaultScaleBacklog
+	}
+	if cfg.TunnelCooldown <= 0 {
+		cfg.TunnelCooldown = defaultScaleCooldown
+	}
+
+	c.account = newAccount(defaultAccountName, cfg.ReqInit, cfg.ReqCap,
+		cfg.UUID, append([]string{cfg.URL}, cfg.Endpoints...), cfg.TunnelCap, cfg.TunnelMax)
+	c.accounts = []*Account{c.account}
+	byName := map[string]*Account{defaultAccountName: c.account}
+
+	for _, ac := range cfg.Accounts {
+		if ac.URL == "" || ac.UUID == "" {
+			return nil, fmt.Errorf("account %q: url and uuid are required", ac.Name)
+		}
+
+		if _, ok := byName[ac.Name]; ok || ac.Name == "" {
+			return nil, fmt.Errorf("account name %q empty or duplicated", ac.Name)
+		}
+
+		tunnelCap, tunnelMax, reqCap := ac.TunnelCap, ac.TunnelMax, ac.ReqCap
+		if tunnelCap < 1 {
+			tunnelCap = cfg.TunnelCap
+		}
+		if tunnelMax < 1 {
+			tunnelMax = cfg.TunnelMax
+		}
+		if reqCap < 1 {
+			reqCap = cfg.ReqCap
+		}
+		if reqCap > maxReqCap {
+			return nil, fmt.Errorf("account %q: invalid request capacity %d",
+				ac.Name, reqCap)
+		}
+
+		a := newAccount(ac.Name, cfg.ReqInit, reqCap, ac.UUID,
+			append([]string{ac.URL}, ac.Endpoints...), tunnelCap, tunnelMax)
+		c.accounts = append(c.accounts, a)
+		byName[ac.Name] = a
+	}
+
+	for _, a := range c.accounts {
+		a.fakeIP = cfg.FakeIP
+		a.policy = cfg.Policy
+		a.idleTimeout = cfg.IdleTimeout
+		a.lingerTimeout = cfg.LingerTimeout
+		a.scale.requests = cfg.TunnelScaleRequests
+		a.scale.backlog = cfg.TunnelScaleBacklog
+		a.scale.cooldown = cfg.TunnelCooldown
+		a.pingInterval = cfg.PingInterval
+		a.pingTimeout = cfg.PingTimeout
+		a.chunkSize = cfg.ChunkSize
+		a.adaptiveChunk = cfg.AdaptiveChunk
+		a.quotaReport = cfg.QuotaReport
+		a.transport = transportOptions{
+			wsReadBufferSize:  cfg.WSReadBufferSize,
+			wsWriteBufferSize: cfg.WSWriteBufferSize,
+			maxFrameSize:      cfg.MaxFrameSize,
+		}
+		for _, ep := range a.endpoints {
+			if err := a.transport.checkMaxFrame(ep.url); err != nil {
+				return nil, fmt.Errorf("account %q: %v", a.name, err)
+			}
+		}
+
+		a.reqq.waitTimeout = cfg.ReqWait
+		a.reqq.maxWaiters = cfg.ReqWaitQueue
+		if a.reqq.maxWaiters < 1 {
+			a.reqq.maxWaiters = a.reqq.maxCap
+		}
+	}
+
+	rewriter := cfg.Rewriter
+	if cfg.FakeIP != nil {
+		// reverse fake ip first, so that rewriters and rules see the domain
+		chain := rewrite.Chain{fakeIPRewriter{c.account}}
+		if cfg.Rewriter != nil {
+			chain = append(chain, cfg.Rewriter)
+		}
+		rewriter = chain
+	}
+
+	var rules socks5.RuleSet
+	if cfg.Policy != nil {
+		rules = cfg.Policy
+	}
+
+	var lcs []ListenerConfig
+	if cfg.ListenAddr != "" {
+		lcs = append(lcs, ListenerConfig{
+			Addr:             cfg.ListenAddr,
+			Protocol:         ProtocolSOCKS5,
+			Credentials:      cfg.Credentials,
+			AuthLimiter:      cfg.AuthLimiter,
+			Guard:            cfg.Guard,
+			HandshakeTimeout: cfg.HandshakeTimeout,
+		})
+	}
+	lcs = append(lcs, cfg.Listeners...)
+
+	if len(lcs) == 0 {
+		return nil, fmt.Errorf("no listener")
+	}
+
+	for _, lc := range lcs {
+		ln, err := c.newListener(lc, byName, rewriter, rules)
+		if err != nil {
+			return nil, err
+		}
+		c.listeners = append(c.listeners, ln)
+	}
+
+	return c, nil
+}
+
+// Start listen and build tunnels, return after the listener is ready,
+// the client runs until ctx is done or Close is called
+func (c *Client) Start(ctx context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-// CreateSocks5erver start http server
+	if c.closed {
+		return fmt.Errorf("client closed")
+	}
+
+	if c.started {
+		return fmt.Errorf("client already started")
+	}
+
+	for i, ln := range c.listeners {
+		if err := ln.listen(); err != nil {
+			for _, opened := range c.listeners[:i] {
+				opened.close()
+			}
+			return err
+		}
+	}
+
+	c.started = true
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+
+	for _, a := range c.accounts {
+		a.buildTunnels(runCtx, &c.wg)
+	}
+
+	if c.cfg.Policy != nil {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.cfg.Policy.Run(runCtx)
+		}()
+	}
+
+	for _, ln := range c.listeners {
+		c.wg.Add(1)
+		go func(ln *listener) {
+			defer c.wg.Done()
+
+			err := ln.serve()
+			if err != nil {
+				log.Printf("listener %s stopped: %v", ln.cfg.Addr, err)
+				c.lock.Lock()
+				c.err = err
+				c.lock.Unlock()
+				go c.Close()
+			}
+		}(ln)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.done:
+		}
+	}()
+
+	return nil
+}
+
+// Addr address of the first listener, nil before Start
+func (c *Client) Addr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.started {
+		return nil
+	}
+
+	return c.listeners[0].l.Addr()
+}
+
+// Addrs addresses of all listeners, in config order, nil before Start
+func (c *Client) Addrs() []net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.started {
+		return nil
+	}
+
+	addrs := make([]net.Addr, len(c.listeners))
+	for i, ln := range c.listeners {
+		addrs[i] = ln.l.Addr()
+	}
+
+	return addrs
+}
+
+// Done closed when client is closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close stop accepting socks connections, give requests grace period
+// to finish, then close remaining requests and tunnels, wait all
+// components to exit, return the error that stopped the listener if any
+func (c *Client) Close() error {
+	c.lock.Lock()
+	c.closeAdmins()
+	if !c.started {
+		// nothing to stop, but never start and release Done waiters
+		if !c.closed {
+			c.closed = true
+			close(c.done)
+		}
+		c.lock.Unlock()
+		return nil
+	}
+
+	if c.closed {
+		c.lock.Unlock()
+		<-c.done
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.err
+	}
+	c.closed = true
+	c.lock.Unlock()
+
+	for _, ln := range c.listeners {
+		ln.close()
+	}
+
+	var swg sync.WaitGroup
+	for _, a := range c.accounts {
+		swg.Add(1)
+		go func(a *Account) {
+			defer swg.Done()
+			a.shutdown(c.cfg.Grace)
+		}(a)
+	}
+	swg.Wait()
+
+	c.cancel()
+	c.wg.Wait()
+
+	if c.cfg.Policy != nil {
+		if err := c.cfg.Policy.Save(); err != nil {
+			log.Println("save usage failed:", err)
+		}
+	}
+
+	log.Println("client closed")
+	close(c.done)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.err
+}
+
+// CreateSocks5erver start socks5 server, block until it stops,
+// exit process if failed
+//
+// Deprecated: use NewClient, which returns errors and can be closed
 func CreateSocks5erver(listenAddr string, url string, uuid string, tunCap int, reqCap int) {
-	account := newAccount(reqCap, uuid, url, tunCap)
-	account.buildTunnels()
+	createSocks5erver(context.Background(), listenAddr, url, uuid, tunCap, reqCap)
+}
+
+// createSocks5erver CreateSocks5erver, also stop when ctx is done
+func createSocks5erver(ctx context.Context, listenAddr string, url string, uuid string, tunCap int, reqCap int) {
+	c, err := NewClient(Config{
+		ListenAddr: listenAddr,
+		URL:        url,
+		UUID:       uuid,
+		TunnelCap:  tunCap,
+		ReqCap:     reqCap,
+	})
+
+	if err == nil {
+		err = c.Start(ctx)
+	}
 
-	config := &socks5.Config{ReqHandler: account}
-	s, err := socks5.New(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("socks server listen at:%s", listenAddr)
-	log.Fatal(s.ListenAndServe("tcp", listenAddr))
+	<-c.Done()
 }
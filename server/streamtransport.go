@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	frameBinary = 0
+	framePing   = 1
+	framePong   = 2
+	frameHello  = 3
+
+	// frame header: type + payload length
+	frameHeaderSize = 1 + 4
+
+	// streamHandshakeTimeout bound of dial, tls handshake and hello
+	// if ctx has no deadline, same as the websocket handshake timeout
+	streamHandshakeTimeout = 45 * time.Second
+)
+
+// streamTransport length-prefixed framing over plain TCP or TLS,
+// the first frame sent to server is a hello frame carrying the
+// request uri(path and query, include uuid)
+type streamTransport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// header and message buffers reused by ReadMessage
+	rheader [frameHeaderSize]byte
+	rbuf    []byte
+	// wbuf frame buffer reused by writes, writes are serialized
+	wbuf []byte
+	// maxFrame max payload size, no negotiation, server is told by
+	// the hello uri and has no reply to lower it, so it is never over
+	// codec.DefaultMaxFrame
+	maxFrame int
+
+	pingHandler func(msg []byte)
+	pongHandler func(msg []byte)
+}
+
+func dialStreamTransport(ctx context.Context, u *url.URL, opts transportOptions) (Transport, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "tls" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(streamHandshakeTimeout)
+	}
+
+	d := net.Dialer{Deadline: deadline}
+	c, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	// a server stalling the handshake must not block the runner forever
+	c.SetDeadline(deadline)
+
+	if u.Scheme == "tls" {
+		tc := tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		c = tc
+	}
+
+	st := newStreamTransport(c, opts.maxFrame())
+	err = st.writeFrame(frameHello, []byte(u.RequestURI()))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.SetDeadline(time.Time{})
+
+	return st, nil
+}
+
+func newStreamTransport(c net.Conn, maxFrame int) *streamTransport {
+	return &streamTransport{
+		conn:        c,
+		reader:      bufio.NewReader(c),
+		maxFrame:    maxFrame,
+		pingHandler: func(msg []byte) {},
+		pongHandler: func(msg []byte) {},
+	}
+}
+
+func (s *streamTransport) writeFrame(ft byte, msg []byte) error {
+	n := frameHeaderSize + len(msg)
+	if cap(s.wbuf) < n {
+		s.wbuf = make([]byte, n)
+	}
+
+	buf := s.wbuf[:n]
+	buf[0] = ft
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(msg)))
+	copy(buf[frameHeaderSize:], msg)
+
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+func (s *streamTransport) ReadMessage() ([]byte, error) {
+	header := s.rheader[:]
+	for {
+		if _, err := io.ReadFull(s.reader, header); err != nil {
+			return nil, err
+		}
+
+		length := binary.LittleEndian.Uint32(header[1:])
+		if length > uint32(s.maxFrame) {
+			return nil, fmt.Errorf("%w:%d", errFrameTooLarge, length)
+		}
+
+		if cap(s.rbuf) < int(length) {
+			s.rbuf = make([]byte, length)
+		}
+
+		msg := s.rbuf[:length]
+		if _, err := io.ReadFull(s.reader, msg); err != nil {
+			return nil, err
+		}
+
+		switch header[0] {
+		case frameBinary:
+			return msg, nil
+		case framePing:
+			s.pingHandler(msg)
+		case framePong:
+			s.pongHandler(msg)
+		default:
+			return nil, fmt.Errorf("unsupport frame type:%d", header[0])
+		}
+	}
+}
+
+func (s *streamTransport) WriteMessage(msg []byte) error {
+	return s.writeFrame(frameBinary, msg)
+}
+
+func (s *streamTransport) WritePing(msg []byte) error {
+	return s.writeFrame(framePing, msg)
+}
+
+func (s *streamTransport) WritePong(msg []byte) error {
+	return s.writeFrame(framePong, msg)
+}
+
+func (s *streamTransport) MaxMessageSize() int {
+	return s.maxFrame
+}
+
+func (s *streamTransport) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *streamTransport) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
+func (s *streamTransport) SetPingHandler(h func(msg []byte)) {
+	s.pingHandler = h
+}
+
+func (s *streamTransport) SetPongHandler(h func(msg []byte)) {
+	s.pongHandler = h
+}
+
+func (s *streamTransport) Shutdown() error {
+	return s.conn.Close()
+}
+
+func (s *streamTransport) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lproxyc/codec"
+	"net/url"
+	"time"
+)
+
+var (
+	// errFrameTooLarge message over the negotiated max frame size
+	errFrameTooLarge = errors.New("frame too large")
+)
+
+// Transport message-oriented tunnel transport, the cmd protocol
+// is carried in binary messages, ping/pong are used for keepalive
+type Transport interface {
+	// ReadMessage read next binary message, ping/pong handlers
+	// are called inside ReadMessage, the message buffer is reused,
+	// it is valid until the next ReadMessage
+	ReadMessage() ([]byte, error)
+	// WriteMessage write a binary message, writes must not be
+	// concurrent, msg can be reused after it returns
+	WriteMessage(msg []byte) error
+	// WritePing write a ping message
+	WritePing(msg []byte) error
+	// WritePong write a pong message
+	WritePong(msg []byte) error
+	// MaxMessageSize negotiated max binary message size, reads over
+	// it fail with errFrameTooLarge, writes must not exceed it
+	MaxMessageSize() int
+
+	// SetReadDeadline deadline of reads, a timed out transport is broken
+	SetReadDeadline(t time.Time) error
+	// SetWriteDeadline deadline of writes, a timed out transport is broken
+	SetWriteDeadline(t time.Time) error
+
+	SetPingHandler(h func(msg []byte))
+	SetPongHandler(h func(msg []byte))
+
+	// Shutdown tell peer we are closing if supported, then close
+	Shutdown() error
+	Close() error
+}
+
+// transportOptions transport tuning, zero values use defaults
+type transportOptions struct {
+	// wsReadBufferSize, wsWriteBufferSize websocket io buffer sizes
+	wsReadBufferSize  int
+	wsWriteBufferSize int
+	// maxFrameSize max message size we accept and send
+	maxFrameSize int
+}
+
+// maxFrame max frame size, default if not set
+func (o transportOptions) maxFrame() int {
+	if o.maxFrameSize > 0 {
+		return o.maxFrameSize
+	}
+
+	return codec.DefaultMaxFrame
+}
+
+// checkMaxFrame tcp/tls don't negotiate max frame size, the server
+// has no reply to lower it, so a size over the default it surely
+// accepts is rejected for them
+func (o transportOptions) checkMaxFrame(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+
+	if (u.Scheme == "tcp" || u.Scheme == "tls") && o.maxFrame() > codec.DefaultMaxFrame {
+		return fmt.Errorf("max frame size %d over %d, %s transport doesn't negotiate it",
+			o.maxFrame(), codec.DefaultMaxFrame, u.Scheme)
+	}
+
+	return nil
+}
+
+// dialTransport dial to server, transport is selected by url scheme:
+// ws/wss use websocket, tcp/tls use length-prefixed framing
+func dialTransport(ctx context.Context, rawurl string, opts transportOptions) (Transport, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+		return dialWSTransport(ctx, rawurl, opts)
+	case "tcp", "tls":
+		return dialStreamTransport(ctx, u, opts)
+	default:
+		return nil, fmt.Errorf("unsupport transport scheme:%s", u.Scheme)
+	}
+}
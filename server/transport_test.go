@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"lproxyc/codec"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestStreamMaxFrame(t *testing.T) {
+	cfg := Config{
+		ListenAddr:   "127.0.0.1:0",
+		URL:          "tcp://127.0.0.1:1/tunnel",
+		UUID:         "test",
+		TunnelCap:    1,
+		ReqCap:       64,
+		MaxFrameSize: codec.DefaultMaxFrame * 2,
+	}
+
+	if _, err := NewClient(cfg); err == nil {
+		t.Fatal("tcp transport accepted max frame over default")
+	}
+
+	cfg.MaxFrameSize = codec.DefaultMaxFrame
+	if _, err := NewClient(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.URL = "ws://127.0.0.1:1/tunnel"
+	cfg.MaxFrameSize = codec.DefaultMaxFrame * 2
+	if _, err := NewClient(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkWSReadMessage read data messages of a websocket tunnel
+func BenchmarkWSReadMessage(b *testing.B) {
+	msg := make([]byte, 16*1024)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		for {
+			if err := c.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	tr, err := dialWSTransport(context.Background(), url, transportOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tr.Close()
+
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := tr.ReadMessage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
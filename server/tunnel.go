@@ -2,38 +2,53 @@ package server
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"lproxyc/codec"
+	"lproxyc/socks5"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	cMDNone              = 0
-	cMDReqData           = 1
-	cMDReqCreated        = 2
-	cMDReqClientClosed   = 3
-	cMDReqClientFinished = 4
-	cMDReqServerFinished = 5
-	cMDReqServerClosed   = 6
-	cMDReqClientQuota    = 7
+	defaultPingInterval = 30 * time.Second
+	defaultPingTimeout  = 10 * time.Second
 )
 
 // Tunnel tunnel
 type Tunnel struct {
 	id   int
-	conn *websocket.Conn
+	conn Transport
+
+	// rtt in nano and pings not answered, accessed atomically
+	rtt      int64
+	waitping int32
 
 	writeLock sync.Mutex
-	waitping  int
+
+	// state flags and reqMap are guarded by owner.lock
+
+	// draining take no new requests, rebuilt when all requests finished
+	draining bool
+	// reconnectNow closed on purpose, rebuild without waiting
+	reconnectNow bool
+	// broken read loop ended, take no new requests
+	broken bool
+	// backlog writes waiting for writeLock, accessed atomically
+	backlog int32
 
 	owner  *Account
 	reqMap map[uint16]*Request
+
+	// endpoint server endpoint of conn
+	endpoint *endpoint
 }
 
-func newTunnel(id int, conn *websocket.Conn, o *Account) *Tunnel {
+func newTunnel(id int, conn Transport, o *Account) *Tunnel {
 
 	t := &Tunnel{
 		id:     id,
@@ -42,14 +57,14 @@ func newTunnel(id int, conn *websocket.Conn, o *Account) *Tunnel {
 		reqMap: make(map[uint16]*Request),
 	}
 
-	conn.SetPingHandler(func(data string) error {
-		t.writePong([]byte(data))
-		return nil
+	conn.SetPingHandler(func(data []byte) {
+		t.renewReadDeadline()
+		t.writePong(data)
 	})
 
-	conn.SetPongHandler(func(data string) error {
-		t.onPong([]byte(data))
-		return nil
+	conn.SetPongHandler(func(data []byte) {
+		t.renewReadDeadline()
+		t.onPong(data)
 	})
 
 	return t
@@ -59,16 +74,27 @@ func (t *Tunnel) serve() {
 	// loop read websocket message
 	c := t.conn
 	for {
-		_, message, err := c.ReadMessage()
+		t.renewReadDeadline()
+		message, err := c.ReadMessage()
 		if err != nil {
-			log.Println("Tunnel read failed:", err)
+			var ne net.Error
+			if errors.Is(err, errFrameTooLarge) {
+				t.onProtocolError(err)
+			} else if errors.As(err, &ne) && ne.Timeout() {
+				log.Printf("tunnel %d dead, no frame within %v", t.id, t.owner.deadTimeout())
+				if t.endpoint != nil {
+					t.endpoint.failed()
+				}
+			} else {
+				log.Println("Tunnel read failed:", err)
+			}
 			break
 		}
 
 		// log.Println("Tunnel recv message, len:", len(message))
 		err = t.onTunnelMessage(message)
 		if err != nil {
-			log.Println("Tunnel onTunnelMessage failed:", err)
+			t.onProtocolError(err)
 			break
 		}
 	}
@@ -76,24 +102,32 @@ func (t *Tunnel) serve() {
 	t.onClose()
 }
 
-func (t *Tunnel) keepalive() {
-	if t.waitping > 3 {
-		t.conn.Close()
-		return
-	}
+// onProtocolError server broke the protocol, the tunnel is closed
+// and rebuilt
+func (t *Tunnel) onProtocolError(err error) {
+	log.Printf("tunnel %d protocol error: %v", t.id, err)
+	t.owner.metrics.protocolErrors.Inc()
+}
+
+// renewReadDeadline tunnel is dead if no frame, data or control,
+// arrives within ping interval and timeout
+func (t *Tunnel) renewReadDeadline() {
+	t.conn.SetReadDeadline(time.Now().Add(t.owner.deadTimeout()))
+}
 
+// keepalive send ping, the pong renews the read deadline, waitping
+// counts pings not answered yet
+func (t *Tunnel) keepalive() {
 	if t.conn == nil {
 		return
 	}
 
-	t.writeLock.Lock()
-	now := time.Now().Unix()
+	now := time.Now().UnixNano()
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, uint64(now))
-	t.conn.WriteMessage(websocket.PingMessage, b)
-	t.writeLock.Unlock()
+	t.send(framePing, b)
 
-	t.waitping++
+	atomic.AddInt32(&t.waitping, 1)
 }
 
 func (t *Tunnel) writePong(msg []byte) {
@@ -101,9 +135,7 @@ func (t *Tunnel) writePong(msg []byte) {
 		return
 	}
 
-	t.writeLock.Lock()
-	t.conn.WriteMessage(websocket.PongMessage, msg)
-	t.writeLock.Unlock()
+	t.send(framePong, msg)
 }
 
 func (t *Tunnel) write(msg []byte) {
@@ -111,154 +143,291 @@ func (t *Tunnel) write(msg []byte) {
 		return
 	}
 
+	t.send(frameBinary, msg)
+}
+
+// send write a frame of type ft with write deadline, a failed write
+// leaves the transport broken, so the tunnel is closed
+func (t *Tunnel) send(ft byte, msg []byte) {
+	var err error
+
+	atomic.AddInt32(&t.backlog, 1)
 	t.writeLock.Lock()
-	t.conn.WriteMessage(websocket.BinaryMessage, msg)
+	atomic.AddInt32(&t.backlog, -1)
+	t.conn.SetWriteDeadline(time.Now().Add(t.owner.pingTimeout))
+	switch ft {
+	case framePing:
+		err = t.conn.WritePing(msg)
+	case framePong:
+		err = t.conn.WritePong(msg)
+	default:
+		err = t.conn.WriteMessage(msg)
+	}
 	t.writeLock.Unlock()
+
+	if err != nil {
+		log.Printf("tunnel %d write failed, close: %v", t.id, err)
+		t.conn.Close()
+	}
 }
 
 func (t *Tunnel) onPong(msg []byte) {
-	t.waitping = 0
+	atomic.StoreInt32(&t.waitping, 0)
+
+	if len(msg) == 8 {
+		sent := int64(binary.LittleEndian.Uint64(msg))
+		rtt := time.Duration(time.Now().UnixNano() - sent)
+		atomic.StoreInt64(&t.rtt, int64(rtt))
+		t.owner.metrics.pingRTT(t.id, rtt.Seconds())
+	}
 }
 
+// pingStats round trip time of the last pong and pings not answered
+func (t *Tunnel) pingStats() (time.Duration, int) {
+	return time.Duration(atomic.LoadInt64(&t.rtt)), int(atomic.LoadInt32(&t.waitping))
+}
+
+// onClose free requests of the broken tunnel, requests not answered
+// by server yet are created again on a healthy tunnel
 func (t *Tunnel) onClose() {
+	a := t.owner
+
+	type bound struct {
+		r   *Request
+		tag uint16
+	}
+
+	a.lock.Lock()
+	t.broken = true
+	reqs := make([]bound, 0, len(t.reqMap))
 	for _, r := range t.reqMap {
-		t.freeRequest(r.idx, r.tag)
+		reqs = append(reqs, bound{r, r.tag})
 	}
+	a.lock.Unlock()
 
-	t.reqMap = make(map[uint16]*Request)
+	for _, b := range reqs {
+		if t.failover(b.r, b.tag) {
+			continue
+		}
+
+		t.freeRequest(b.r.idx, b.tag, closeTunnelBroken)
+	}
+}
+
+// failover move pending request r to a healthy tunnel and create
+// it there, false if r is not pending or no tunnel takes it
+func (t *Tunnel) failover(r *Request, tag uint16) bool {
+	a := t.owner
+
+	a.lock.Lock()
+	r.writeLock.Lock()
+	if a.closed || r.tag != tag || r.tunnel != t || !r.isPending() {
+		r.writeLock.Unlock()
+		a.lock.Unlock()
+		return false
+	}
+
+	nt := a.getTunnel()
+	if nt == nil {
+		r.writeLock.Unlock()
+		a.lock.Unlock()
+		return false
+	}
+
+	delete(t.reqMap, r.idx)
+	nt.reqMap[r.idx] = r
+	r.tunnel = nt
+	dest := r.sreq.DestAddr
+	r.writeLock.Unlock()
+	a.lock.Unlock()
+
+	log.Printf("request %d:%d failover, tunnel %d -> %d", r.idx, tag, t.id, nt.id)
+	a.metrics.failovers.Inc()
+
+	nt.sendRequestCreate(r.idx, tag, dest)
+
+	return true
 }
 
 func (t *Tunnel) onTunnelMessage(message []byte) error {
-	if len(message) < 5 {
-		return fmt.Errorf("invalid tunnel message")
+	m, err := codec.DecodeServerMessage(message)
+	if err != nil {
+		if errors.Is(err, codec.ErrUnknownCmd) {
+			log.Printf("onTunnelMessage, %v", err)
+			return nil
+		}
+
+		return fmt.Errorf("invalid tunnel message:%v", err)
 	}
 
-	cmd := message[0]
-	idx := binary.LittleEndian.Uint16(message[1:])
-	tag := binary.LittleEndian.Uint16(message[3:])
-
-	switch cmd {
-	case cMDReqData:
-		t.handleRequestData(idx, tag, message[5:])
-	case cMDReqServerFinished:
-		t.handleServerFinished(idx, tag, message[5:])
-	case cMDReqServerClosed:
-		t.handleServerClosed(idx, tag, message[5:])
-	default:
-		log.Printf("onTunnelMessage, unsupport tunnel cmd:%d", cmd)
+	switch msg := m.(type) {
+	case *codec.ServerData:
+		t.handleRequestData(msg)
+	case *codec.ServerEnd:
+		if msg.Cmd == codec.CmdReqServerFinished {
+			t.handleServerFinished(msg)
+		} else {
+			t.handleServerClosed(msg)
+		}
 	}
 
 	return nil
 }
 
-func (t *Tunnel) handleRequestData(idx uint16, tag uint16, message []byte) {
-	req, err := t.owner.reqq.get(idx, tag)
+func (t *Tunnel) handleRequestData(msg *codec.ServerData) {
+	req, err := t.owner.reqq.get(msg.Idx, msg.Tag)
 	if err != nil {
 		log.Println("handleRequestData, get req failed:", err)
 		return
 	}
 
-	seqno := binary.LittleEndian.Uint32(message)
-	req.onClientData(seqno, message[4:])
+	reports, reason := req.onClientData(msg.Tag, msg.Seq, msg.Data)
+	for i := 0; i < reports; i++ {
+		req.reportQuota(t, msg.Tag)
+	}
+
+	switch reason {
+	case "":
+	case closeServerClosed:
+		t.freeRequest(msg.Idx, msg.Tag, reason)
+	default:
+		t.terminateRequest(msg.Idx, msg.Tag, reason)
+	}
 }
 
-func (t *Tunnel) handleServerFinished(idx uint16, tag uint16, message []byte) {
-	req, err := t.owner.reqq.get(idx, tag)
+func (t *Tunnel) handleServerFinished(msg *codec.ServerEnd) {
+	req, err := t.owner.reqq.get(msg.Idx, msg.Tag)
 	if err != nil {
 		//log.Println("handleRequestData, get req failed:", err)
 		return
 	}
 
-	lastSeqNo := binary.LittleEndian.Uint32(message)
-	req.onServerFinished(lastSeqNo)
+	req.onServerFinished(msg.Tag, msg.LastSeqNo)
 }
 
-func (t *Tunnel) handleServerClosed(idx uint16, tag uint16, message []byte) {
-	req, err := t.owner.reqq.get(idx, tag)
+func (t *Tunnel) handleServerClosed(msg *codec.ServerEnd) {
+	req, err := t.owner.reqq.get(msg.Idx, msg.Tag)
 	if err != nil {
 		//log.Println("handleRequestData, get req failed:", err)
 		return
 	}
 
-	lastSeqNo := binary.LittleEndian.Uint32(message)
-	if req.onServerClosed(lastSeqNo) {
-		t.freeRequest(req.idx, req.tag)
+	if req.onServerClosed(msg.Tag, msg.LastSeqNo) {
+		t.freeRequest(msg.Idx, msg.Tag, closeServerClosed)
 	}
 }
 
-func (t *Tunnel) freeRequest(idx uint16, tag uint16) {
-	err := t.owner.reqq.free(idx, tag)
+func (t *Tunnel) freeRequest(idx uint16, tag uint16, reason string) {
+	fields, err := t.owner.reqq.free(idx, tag, reason)
 	if err != nil {
 		//log.Println("freeRequest, get req failed:", err)
 		return
 	}
+
+	logAccess(fields)
+	t.owner.metrics.reqClosed(reason)
+}
+
+func (t *Tunnel) onRequestTerminate(req *Request, tag uint16) {
+	t.terminateRequest(req.idx, tag, closeClientClosed)
 }
 
-func (t *Tunnel) onRequestTerminate(req *Request) {
+func (t *Tunnel) terminateRequest(idx uint16, tag uint16, reason string) {
 	// send close to client
-	buf := make([]byte, 5)
-	buf[0] = cMDReqClientClosed
-	binary.LittleEndian.PutUint16(buf[1:], req.idx)
-	binary.LittleEndian.PutUint16(buf[3:], req.tag)
+	t.write(codec.NewClientEnd(codec.CmdReqClientClosed, idx, tag).Encode())
 
-	t.write(buf)
+	t.freeRequest(idx, tag, reason)
+}
 
-	t.freeRequest(req.idx, req.tag)
+// drain take no new requests, existing requests can finish
+func (t *Tunnel) drain() {
+	t.owner.lock.Lock()
+	t.draining = true
+	t.owner.lock.Unlock()
 }
 
-func (t *Tunnel) onRequestHalfClosed(req *Request) {
-	// send half-close to client
-	buf := make([]byte, 5)
-	buf[0] = cMDReqClientFinished
-	binary.LittleEndian.PutUint16(buf[1:], req.idx)
-	binary.LittleEndian.PutUint16(buf[3:], req.tag)
+// drained draining and all requests finished
+func (t *Tunnel) drained() bool {
+	t.owner.lock.Lock()
+	defer t.owner.lock.Unlock()
 
-	t.write(buf)
+	return t.draining && len(t.reqMap) == 0
 }
 
-func (t *Tunnel) onQuotaReport(req *Request, quota uint16) {
-	buf := make([]byte, 5+2)
-	buf[0] = cMDReqClientQuota
-	binary.LittleEndian.PutUint16(buf[1:], req.idx)
-	binary.LittleEndian.PutUint16(buf[3:], req.tag)
-	binary.LittleEndian.PutUint16(buf[5:], quota)
+// shutdown close conn with close message
+func (t *Tunnel) shutdown() {
+	t.writeLock.Lock()
+	t.conn.Shutdown()
+	t.writeLock.Unlock()
+}
+
+// reconnect close conn, tunnelRunner rebuild it immediately
+func (t *Tunnel) reconnect() {
+	t.owner.lock.Lock()
+	t.reconnectNow = true
+	t.owner.lock.Unlock()
+
+	t.conn.Close()
+}
+
+// reconnecting closed by reconnect
+func (t *Tunnel) reconnecting() bool {
+	t.owner.lock.Lock()
+	defer t.owner.lock.Unlock()
 
-	t.write(buf)
+	return t.reconnectNow
 }
 
-func (t *Tunnel) onRequestData(req *Request, data []byte) {
-	buf := make([]byte, 5+len(data))
-	buf[0] = cMDReqData
-	binary.LittleEndian.PutUint16(buf[1:], req.idx)
-	binary.LittleEndian.PutUint16(buf[3:], req.tag)
-	copy(buf[5:], data)
+func (t *Tunnel) onRequestHalfClosed(req *Request, tag uint16) {
+	req.halfClose()
+	// send half-close to client
+	t.write(codec.NewClientEnd(codec.CmdReqClientFinished, req.idx, tag).Encode())
+}
 
-	t.write(buf)
+func (t *Tunnel) onQuotaReport(req *Request, tag uint16, quota uint16) {
+	t.owner.metrics.quotaReports.Inc()
+	t.write(codec.NewClientQuota(req.idx, tag, quota).Encode())
 }
 
-func (t *Tunnel) sendRequestCreate(req *Request) {
-	var addressLength int
-	address := req.sreq.DestAddr
+// onRequestData send data frame, frame has codec.HeaderSize bytes
+// reserved before data, header is filled in place, frames over the
+// max message size are split
+func (t *Tunnel) onRequestData(req *Request, tag uint16, frame []byte) {
+	n := len(frame) - codec.HeaderSize
+	req.touch()
+	t.owner.metrics.bytesUp.Add(float64(n))
+
+	h := codec.Header{Cmd: codec.CmdReqData, Idx: req.idx, Tag: tag}
+	max := t.conn.MaxMessageSize()
+	for {
+		if len(frame) <= max {
+			h.Put(frame)
+			t.write(frame)
+			return
+		}
+
+		h.Put(frame)
+		t.write(frame[:max])
+
+		// next header goes over the tail of the part just sent
+		frame = frame[max-codec.HeaderSize:]
+	}
+}
+
+func (t *Tunnel) sendRequestCreate(idx uint16, tag uint16, address *socks5.AddrSpec) {
 	var addressBytes []byte
 	if address.FQDN != "" {
-		addressLength = len(address.FQDN)
 		addressBytes = []byte(address.FQDN)
 	} else {
-		addressLength = len(address.IP)
 		addressBytes = address.IP
 	}
 
-	// log.Printf("sendRequestCreate, addressLength:%d", addressLength)
-
-	buf := make([]byte, 5+1+1+addressLength+2) // addressType + address + port
-	buf[0] = cMDReqCreated
-	binary.LittleEndian.PutUint16(buf[1:], req.idx)
-	binary.LittleEndian.PutUint16(buf[3:], req.tag)
-	buf[5] = 1                   // address type always is 1
-	buf[6] = byte(addressLength) // address type always is 1
-
-	copy(buf[7:], addressBytes)
-	binary.LittleEndian.PutUint16(buf[7+addressLength:], uint16(address.Port))
+	m := codec.NewReqCreated(idx, tag, addressBytes, uint16(address.Port))
+	if err := m.Validate(); err != nil {
+		log.Printf("sendRequestCreate, req %d:%d failed:%v", idx, tag, err)
+		t.freeRequest(idx, tag, closeInvalid)
+		return
+	}
 
-	t.write(buf)
+	t.write(m.Encode())
 }
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"lproxyc/codec"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsMessageBufferSize initial message read buffer, grown as needed
+	wsMessageBufferSize = 32 * 1024
+)
+
+// wsTransport websocket transport
+type wsTransport struct {
+	conn *websocket.Conn
+
+	// rbuf message buffer reused by ReadMessage
+	rbuf []byte
+	// maxFrame negotiated max message size
+	maxFrame int
+}
+
+func dialWSTransport(ctx context.Context, url string, opts transportOptions) (Transport, error) {
+	d := *websocket.DefaultDialer
+	d.ReadBufferSize = opts.wsReadBufferSize
+	d.WriteBufferSize = opts.wsWriteBufferSize
+
+	// the handshake doesn't watch ctx, close the conn to abort it
+	// when ctx is done, e.g. another endpoint won the race, the ctx
+	// passed to the dial func is canceled when DialContext returns
+	handshaked := make(chan struct{})
+	d.NetDialContext = func(dctx context.Context, network, addr string) (net.Conn, error) {
+		var nd net.Dialer
+		conn, err := nd.DialContext(dctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-handshaked:
+			}
+		}()
+
+		return conn, nil
+	}
+
+	c, resp, err := d.DialContext(ctx, url, nil)
+	close(handshaked)
+	if err != nil {
+		return nil, err
+	}
+
+	// server may lower our max frame size, never raise it
+	maxFrame := opts.maxFrame()
+	if v, err := strconv.Atoi(resp.Header.Get(codec.MaxFrameHeader)); err == nil &&
+		v < maxFrame {
+		if v < codec.MinMaxFrame {
+			c.Close()
+			return nil, fmt.Errorf("server max frame size %d too small", v)
+		}
+		maxFrame = v
+	}
+	c.SetReadLimit(int64(maxFrame))
+
+	return &wsTransport{
+		conn:     c,
+		rbuf:     make([]byte, 0, wsMessageBufferSize),
+		maxFrame: maxFrame,
+	}, nil
+}
+
+func (w *wsTransport) ReadMessage() ([]byte, error) {
+	_, r, err := w.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	// stream into the reused buffer, not a new one per message
+	w.rbuf, err = readAll(r, w.rbuf)
+	if err == websocket.ErrReadLimit {
+		return nil, fmt.Errorf("%w: over %d", errFrameTooLarge, w.maxFrame)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return w.rbuf, nil
+}
+
+func (w *wsTransport) MaxMessageSize() int {
+	return w.maxFrame
+}
+
+func (w *wsTransport) WriteMessage(msg []byte) error {
+	return w.conn.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+func (w *wsTransport) WritePing(msg []byte) error {
+	return w.conn.WriteMessage(websocket.PingMessage, msg)
+}
+
+func (w *wsTransport) WritePong(msg []byte) error {
+	return w.conn.WriteMessage(websocket.PongMessage, msg)
+}
+
+func (w *wsTransport) SetReadDeadline(t time.Time) error {
+	return w.conn.SetReadDeadline(t)
+}
+
+func (w *wsTransport) SetWriteDeadline(t time.Time) error {
+	return w.conn.SetWriteDeadline(t)
+}
+
+func (w *wsTransport) SetPingHandler(h func(msg []byte)) {
+	w.conn.SetPingHandler(func(data string) error {
+		h([]byte(data))
+		return nil
+	})
+}
+
+func (w *wsTransport) SetPongHandler(h func(msg []byte)) {
+	w.conn.SetPongHandler(func(data string) error {
+		h([]byte(data))
+		return nil
+	})
+}
+
+func (w *wsTransport) Shutdown() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "client shutdown")
+	w.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+
+	return w.conn.Close()
+}
+
+func (w *wsTransport) Close() error {
+	return w.conn.Close()
+}
@@ -16,7 +16,8 @@ const (
 )
 
 var (
-	errUserAuthFailed  = fmt.Errorf("User authentication failed")
+	// ErrUserAuthFailed wrong username or password
+	ErrUserAuthFailed  = fmt.Errorf("User authentication failed")
 	errNoSupportedAuth = fmt.Errorf("No supported authentication mechanism")
 )
 
@@ -31,19 +32,22 @@ type AuthContext struct {
 	Payload map[string]string
 }
 
-type authenticator interface {
-	authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error)
-	getCode() uint8
+// Authenticator negotiates one socks5 auth method
+type Authenticator interface {
+	Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error)
+	GetCode() uint8
 }
 
 // NoAuthAuthenticator is used to handle the "No Authentication" mode
 type NoAuthAuthenticator struct{}
 
-func (a NoAuthAuthenticator) getCode() uint8 {
+// GetCode implement Authenticator
+func (a NoAuthAuthenticator) GetCode() uint8 {
 	return noAuth
 }
 
-func (a NoAuthAuthenticator) authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+// Authenticate implement Authenticator
+func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	_, err := writer.Write([]byte{socks5Version, noAuth})
 	return &AuthContext{noAuth, nil}, err
 }
@@ -54,11 +58,13 @@ type UserPassAuthenticator struct {
 	Credentials CredentialStore
 }
 
-func (a UserPassAuthenticator) getCode() uint8 {
+// GetCode implement Authenticator
+func (a UserPassAuthenticator) GetCode() uint8 {
 	return userPassAuth
 }
 
-func (a UserPassAuthenticator) authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+// Authenticate implement Authenticator
+func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	// Tell the client to use user/pass auth
 	if _, err := writer.Write([]byte{socks5Version, userPassAuth}); err != nil {
 		return nil, err
@@ -95,7 +101,7 @@ func (a UserPassAuthenticator) authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Verify the password
-	if a.Credentials.valid(string(user), string(pass)) {
+	if a.Credentials.Valid(string(user), string(pass)) {
 		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
 			return nil, err
 		}
@@ -103,7 +109,7 @@ func (a UserPassAuthenticator) authenticate(reader io.Reader, writer io.Writer)
 		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
 			return nil, err
 		}
-		return nil, errUserAuthFailed
+		return nil, ErrUserAuthFailed
 	}
 
 	// Done
@@ -122,7 +128,7 @@ func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext,
 	for _, method := range methods {
 		cator, found := s.authMethods[method]
 		if found {
-			return cator.authenticate(bufConn, conn)
+			return cator.Authenticate(bufConn, conn)
 		}
 	}
 
@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// BufConn conn whose reads come from a reader that may hold bytes
+// already read from the conn, by a bufio.Reader or a peek
+type BufConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// NewBufConn new conn reading from r, writes go to c
+func NewBufConn(c net.Conn, r io.Reader) *BufConn {
+	return &BufConn{Conn: c, r: r}
+}
+
+// Read implement net.Conn
+func (c *BufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite half close, if the wrapped conn supports it
+func (c *BufConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// CloseWrite half close c, if it supports it
+func CloseWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return fmt.Errorf("%T can't close write", c)
+}
+
+// RemoteIP source ip of conn, the whole address if it has no port
+func RemoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
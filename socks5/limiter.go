@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// limiter entries are pruned when the table grows over this
+	limiterPruneSize = 1024
+)
+
+// AuthLimiter count failed authentications per source ip, a source
+// reaching MaxFailures within Window is blocked until Window elapsed
+// since its first failure
+type AuthLimiter struct {
+	MaxFailures int
+	Window      time.Duration
+
+	lock     sync.Mutex
+	failures map[string]*authFailures
+}
+
+type authFailures struct {
+	count int
+	first time.Time
+}
+
+// NewAuthLimiter new limiter
+func NewAuthLimiter(maxFailures int, window time.Duration) *AuthLimiter {
+	return &AuthLimiter{
+		MaxFailures: maxFailures,
+		Window:      window,
+		failures:    make(map[string]*authFailures),
+	}
+}
+
+// Allow return false if ip is blocked
+func (l *AuthLimiter) Allow(ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	f, ok := l.failures[ip]
+	if !ok {
+		return true
+	}
+
+	if time.Since(f.first) >= l.Window {
+		delete(l.failures, ip)
+		return true
+	}
+
+	return f.count < l.MaxFailures
+}
+
+// Fail record a failed authentication
+func (l *AuthLimiter) Fail(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	f, ok := l.failures[ip]
+	if !ok || now.Sub(f.first) >= l.Window {
+		if len(l.failures) >= limiterPruneSize {
+			l.prune(now)
+		}
+
+		f = &authFailures{first: now}
+		l.failures[ip] = f
+	}
+
+	f.count++
+}
+
+// Reset forget failures after a successful authentication
+func (l *AuthLimiter) Reset(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.failures, ip)
+}
+
+func (l *AuthLimiter) prune(now time.Time) {
+	for ip, f := range l.failures {
+		if now.Sub(f.first) >= l.Window {
+			delete(l.failures, ip)
+		}
+	}
+}
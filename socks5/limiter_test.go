@@ -0,0 +1,57 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	l := NewAuthLimiter(3, 100*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		l.Fail("1.2.3.4")
+	}
+	if !l.Allow("1.2.3.4") {
+		t.Fatal("blocked below max failures")
+	}
+
+	l.Fail("1.2.3.4")
+	if l.Allow("1.2.3.4") {
+		t.Fatal("not blocked at max failures")
+	}
+
+	// other sources are not affected
+	if !l.Allow("5.6.7.8") {
+		t.Fatal("other source blocked")
+	}
+
+	// unblocked once window elapsed since the first failure
+	time.Sleep(150 * time.Millisecond)
+	if !l.Allow("1.2.3.4") {
+		t.Fatal("still blocked after window")
+	}
+
+	// success forgets failures
+	l.Fail("1.2.3.4")
+	l.Fail("1.2.3.4")
+	l.Reset("1.2.3.4")
+	l.Fail("1.2.3.4")
+	l.Fail("1.2.3.4")
+	if !l.Allow("1.2.3.4") {
+		t.Fatal("failures before reset counted")
+	}
+}
+
+func TestAuthLimiterPrune(t *testing.T) {
+	l := NewAuthLimiter(1, 10*time.Millisecond)
+	for i := 0; i < limiterPruneSize; i++ {
+		l.Fail(string(rune(i)))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	l.Fail("1.2.3.4")
+
+	if n := len(l.failures); n != 1 {
+		t.Fatalf("entries:%d, want expired ones pruned", n)
+	}
+}
@@ -11,7 +11,8 @@ import (
 )
 
 const (
-	connectCommand   = uint8(1)
+	// ConnectCommand socks5 CONNECT, the only command served
+	ConnectCommand   = uint8(1)
 	bindCommand      = uint8(2)
 	associateCommand = uint8(3)
 	ipv4Address      = uint8(1)
@@ -31,15 +32,56 @@ const (
 	addrTypeNotSupported
 )
 
+// reply codes for ReplyError
+const (
+	ReplyServerFailure      = serverFailure
+	ReplyRuleFailure        = ruleFailure
+	ReplyNetworkUnreachable = networkUnreachable
+	ReplyHostUnreachable    = hostUnreachable
+	ReplyConnectionRefused  = connectionRefused
+)
+
 var (
 	errUnrecognizedAddrType = fmt.Errorf("Unrecognized address type")
 )
 
+// ReplyError error with the reply code sent to client
+type ReplyError struct {
+	Code uint8
+	Err  error
+}
+
+func (e *ReplyError) Error() string {
+	return e.Err.Error()
+}
+
+// ReplyCode reply code of err, ReplyServerFailure if err is not
+// a *ReplyError
+func ReplyCode(err error) uint8 {
+	if re, ok := err.(*ReplyError); ok {
+		return re.Code
+	}
+	return serverFailure
+}
+
+// Allocator optional interface of RequestHandler, resources of req
+// are allocated before success is replied, so that failures get
+// a proper reply, the returned run proxies the request
+type Allocator interface {
+	Allocate(req *SocksRequest) (run func(), err error)
+}
+
 // AddressRewriter is used to rewrite a destination transparently
 type AddressRewriter interface {
 	Rewrite(ctx context.Context, request *SocksRequest) (context.Context, *AddrSpec)
 }
 
+// RuleSet is used to provide custom rules to allow or prohibit actions,
+// prohibited requests get a ruleFailure reply
+type RuleSet interface {
+	Allow(ctx context.Context, req *SocksRequest) (context.Context, bool)
+}
+
 // AddrSpec is used to return the target AddrSpec
 // which may be specified as IPv4, IPv6, or a FQDN
 type AddrSpec struct {
@@ -77,6 +119,47 @@ type SocksRequest struct {
 	DestAddr *AddrSpec
 
 	Conn net.Conn
+
+	ctx context.Context
+}
+
+// Context returns the request context, set by the AddressRewriter
+func (req *SocksRequest) Context() context.Context {
+	if req.ctx != nil {
+		return req.ctx
+	}
+	return context.Background()
+}
+
+// Username authenticated username, empty if auth-less
+func (req *SocksRequest) Username() string {
+	if req.AuthContext == nil || req.AuthContext.Payload == nil {
+		return ""
+	}
+	return req.AuthContext.Payload["Username"]
+}
+
+// Prepare apply rewriter then rules to req, both can be nil, return
+// false if req is not allowed. Front ends other than socks5 use it to
+// share the same pipeline
+func Prepare(req *SocksRequest, rewriter AddressRewriter, rules RuleSet) bool {
+	if rewriter != nil {
+		ctx, dest := rewriter.Rewrite(req.Context(), req)
+		req.ctx = ctx
+		if dest != nil {
+			req.DestAddr = dest
+		}
+	}
+
+	if rules != nil {
+		ctx, ok := rules.Allow(req.Context(), req)
+		req.ctx = ctx
+		if !ok {
+			return false
+		}
+	}
+
+	return true
 }
 
 // NewRequest creates a new Request from the tcp connection
@@ -112,7 +195,7 @@ func NewRequest(bufConn io.Reader, conn net.Conn) (*SocksRequest, error) {
 func (s *Server) handleRequest(req *SocksRequest, conn net.Conn) error {
 	// Switch on the command
 	switch req.Command {
-	case connectCommand:
+	case ConnectCommand:
 		return s.handleConnect(req)
 	case bindCommand:
 		return s.handleBind(req)
@@ -128,12 +211,39 @@ func (s *Server) handleRequest(req *SocksRequest, conn net.Conn) error {
 
 // handleConnect is used to handle a connect command
 func (s *Server) handleConnect(req *SocksRequest) error {
-	// Send success
 	conn := req.Conn
+	allocator, ok := s.config.ReqHandler.(Allocator)
+	if !ok {
+		// Send success
+		if err := sendReply(conn, successReply, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+
+		s.endHandshake(conn)
+		if err := s.config.ReqHandler.HandleRequest(req); err != nil {
+			return fmt.Errorf("Failed to HandleRequest: %v", err)
+		}
+		return nil
+	}
+
+	run, err := allocator.Allocate(req)
+	if err != nil {
+		if err := sendReply(conn, ReplyCode(err), nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
+	}
+
+	// Send success
 	if err := sendReply(conn, successReply, nil); err != nil {
+		// conn is broken, run fails at once and releases the request
+		run()
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 
+	s.endHandshake(conn)
+	run()
+
 	return nil
 }
 
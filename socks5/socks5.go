@@ -6,6 +6,8 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -14,6 +16,11 @@ const (
 	socks5Version = uint8(5)
 )
 
+var (
+	// ErrServerClosed returned by Serve after Close
+	ErrServerClosed = fmt.Errorf("socks: Server closed")
+)
+
 // RequestHandler request handler
 type RequestHandler interface {
 	HandleRequest(req *SocksRequest) error
@@ -24,12 +31,27 @@ type Config struct {
 	// AuthMethods can be provided to implement custom authentication
 	// By default, "auth-less" mode is enabled.
 	// For password-based auth use UserPassAuthenticator.
-	authMethods []authenticator
+	AuthMethods []Authenticator
 
 	// If provided, username/password authentication is enabled,
 	// by appending a UserPassAuthenticator to AuthMethods. If not provided,
 	// and AUthMethods is nil, then "auth-less" mode is enabled.
-	credentials CredentialStore
+	Credentials CredentialStore
+
+	// AuthLimiter if set, source ips with too many failed
+	// authentications are rejected for a while
+	AuthLimiter *AuthLimiter
+
+	// Rewriter can be used to transparently change the request
+	// destination before it is passed to ReqHandler
+	Rewriter AddressRewriter
+
+	// Rules if set, requests not allowed are rejected after rewriting
+	Rules RuleSet
+
+	// HandshakeTimeout if set, connections that don't finish
+	// negotiation and request within it are closed
+	HandshakeTimeout time.Duration
 
 	ReqHandler RequestHandler
 }
@@ -38,17 +60,22 @@ type Config struct {
 // the details of the SOCKS5 protocol
 type Server struct {
 	config      *Config
-	authMethods map[uint8]authenticator
+	authMethods map[uint8]Authenticator
+
+	// lock guards listener and closed
+	lock     sync.Mutex
+	listener net.Listener
+	closed   bool
 }
 
 // New creates a new Server and potentially returns an error
 func New(conf *Config) (*Server, error) {
 	// Ensure we have at least one authentication method enabled
-	if len(conf.authMethods) == 0 {
-		if conf.credentials != nil {
-			conf.authMethods = []authenticator{&UserPassAuthenticator{conf.credentials}}
+	if len(conf.AuthMethods) == 0 {
+		if conf.Credentials != nil {
+			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{conf.Credentials}}
 		} else {
-			conf.authMethods = []authenticator{&NoAuthAuthenticator{}}
+			conf.AuthMethods = []Authenticator{&NoAuthAuthenticator{}}
 		}
 	}
 
@@ -56,10 +83,10 @@ func New(conf *Config) (*Server, error) {
 		config: conf,
 	}
 
-	server.authMethods = make(map[uint8]authenticator)
+	server.authMethods = make(map[uint8]Authenticator)
 
-	for _, a := range conf.authMethods {
-		server.authMethods[a.getCode()] = a
+	for _, a := range conf.AuthMethods {
+		server.authMethods[a.GetCode()] = a
 	}
 
 	return server, nil
@@ -76,9 +103,21 @@ func (s *Server) ListenAndServe(network, addr string) error {
 
 // Serve is used to serve connections from a listener
 func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.lock.Unlock()
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
 		go func() {
@@ -90,6 +129,27 @@ func (s *Server) Serve(l net.Listener) error {
 	}
 }
 
+// Close stop accepting new connections, connections
+// being served are not affected
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Close()
+}
+
+func (s *Server) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.closed
+}
+
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) error {
 	// log.Println("socks5 ServeConn")
@@ -97,6 +157,10 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	defer conn.Close()
 	bufConn := bufio.NewReader(conn)
 
+	if s.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	}
+
 	// Read the version byte
 	version := []byte{0}
 	if _, err := bufConn.Read(version); err != nil {
@@ -111,8 +175,25 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return err
 	}
 
+	// Reject sources that failed too many times
+	limiter := s.config.AuthLimiter
+	ip := RemoteIP(conn)
+	if limiter != nil && !limiter.Allow(ip) {
+		err := fmt.Errorf("too many failed authentications from %s", ip)
+		log.Printf("[ERR] socks: %v", err)
+		return err
+	}
+
 	// Authenticate the connection
 	authContext, err := s.authenticate(conn, bufConn)
+	if limiter != nil {
+		if err == ErrUserAuthFailed {
+			limiter.Fail(ip)
+		} else if err == nil {
+			limiter.Reset(ip)
+		}
+	}
+
 	if err != nil {
 		err = fmt.Errorf("Failed to authenticate: %v", err)
 		log.Printf("[ERR] socks: %v", err)
@@ -130,6 +211,14 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	}
 	request.AuthContext = authContext
 
+	// Apply any address rewrites, then check if this is allowed
+	if !Prepare(request, s.config.Rewriter, s.config.Rules) {
+		if err := sendReply(conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Request to %v blocked by rules", request.DestAddr)
+	}
+
 	// Process the client request
 	if err := s.handleRequest(request, conn); err != nil {
 		err = fmt.Errorf("Failed to handle request: %v", err)
@@ -137,10 +226,12 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return err
 	}
 
-	err = s.config.ReqHandler.HandleRequest(request)
-	if err != nil {
-		return fmt.Errorf("Failed to HandleRequest: %v", err)
-	}
-
 	return nil
 }
+
+// endHandshake clear handshake deadline before proxying
+func (s *Server) endHandshake(conn net.Conn) {
+	if s.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+}
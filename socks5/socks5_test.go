@@ -0,0 +1,46 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeClose(t *testing.T) {
+	s, err := New(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Fatalf("Serve:%v, want %v", err, ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve not stopped by Close")
+	}
+
+	// closed before serve
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Serve(l); err != ErrServerClosed {
+		t.Fatalf("Serve after Close:%v, want %v", err, ErrServerClosed)
+	}
+}
@@ -6,13 +6,18 @@ import (
 	"os/signal"
 )
 
-func waitForSignal() {
+func waitForSignal(done <-chan struct{}) {
 	for {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, os.Kill)
 
-		// Block until a signal is received.
-		s := <-c
+		// Block until a signal is received, or client stopped by itself
+		var s os.Signal
+		select {
+		case s = <-c:
+		case <-done:
+			return
+		}
 		fmt.Println("Got signal:", s)
 
 		if s == os.Kill {